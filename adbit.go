@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	clearAD = flag.Bool("clear-ad", false,
+		"Clear the AD bit of the responses from backends not in -trusted-upstreams, and to queries without AD or DO")
+	trustedUpstreams = flag.String("trusted-upstreams", "",
+		"Backends trusted to validate DNSSEC, whose AD bit is relayed with -clear-ad (host:port,...)")
+)
+
+// trustedAD are the -trusted-upstreams backends.
+var trustedAD = make(map[string]bool)
+
+// parseTrustedUpstreams parses -trusted-upstreams.
+func parseTrustedUpstreams() error {
+	if *trustedUpstreams == "" {
+		return nil
+	}
+	for _, addr := range strings.Split(*trustedUpstreams, ",") {
+		if !validBackend(addr) {
+			return fmt.Errorf("invalid -trusted-upstreams backend %q, must be host:port or unix:/path", addr)
+		}
+		trustedAD[addr] = true
+	}
+	return nil
+}
+
+// wantsAD returns whether the client of req understands the AD bit, having
+// set AD or DO (RFC 6840 section 5.8).
+func wantsAD(req *dns.Msg) bool {
+	if req.AuthenticatedData {
+		return true
+	}
+	opt := req.IsEdns0()
+	return opt != nil && opt.Do()
+}
+
+// keepAD returns whether the AD bit of a response from upstream to req is
+// relayed, "" for a response not from a backend.
+func keepAD(req *dns.Msg, upstream string) bool {
+	return !*clearAD || wantsAD(req) && (upstream == "" || trustedAD[upstream])
+}
+
+// filterAD clears the AD bit of resp from upstream to req unless relayed.
+func filterAD(req, resp *dns.Msg, upstream string) {
+	if resp.AuthenticatedData && !keepAD(req, upstream) {
+		resp.AuthenticatedData = false
+		countMetric("ad.cleared")
+	}
+}
+
+// filterADWire is filterAD on a wire response, whose AD bit is bit 5 of the
+// fourth byte.
+func filterADWire(req *dns.Msg, resp []byte, upstream string) {
+	if len(resp) > 3 && resp[3]&0x20 != 0 && !keepAD(req, upstream) {
+		resp[3] &^= 0x20
+		countMetric("ad.cleared")
+	}
+}
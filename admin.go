@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+
+	"github.com/miekg/dns"
+)
+
+var adminAddress = flag.String("admin-address", "",
+	"Address of the HTTP admin endpoint (host:port), e.g. /test?name=foo.example.com&type=A&client=10.1.2.3")
+
+// adminMux serves the admin endpoints.
+var adminMux = http.NewServeMux()
+
+func init() {
+	adminMux.HandleFunc("/test", adminTest)
+}
+
+// startAdmin serves the admin endpoint, if any, in background.
+func startAdmin() error {
+	if *adminAddress == "" {
+		return nil
+	}
+	l, handler, err := listenHTTP("admin", *adminAddress, *adminAllow, *adminAuth, *adminClientCA, adminMux)
+	if err != nil {
+		return err
+	}
+	go func() {
+		logf("admin: %v", http.Serve(l, handler))
+	}()
+	return nil
+}
+
+// testDecision is how a view would handle a query.
+type testDecision struct {
+	View     string   `json:"view"`
+	Steps    []string `json:"steps"`    // in evaluation order
+	Decision string   `json:"decision"` // the last step
+}
+
+// adminTest simulates the evaluation of a query in each view, as the query
+// subcommand, and returns the decisions as JSON without sending anything.
+func adminTest(w http.ResponseWriter, r *http.Request) {
+	q, client, err := parseExplain(r.FormValue("name"), r.FormValue("type"), r.FormValue("client"))
+	if err == nil && r.FormValue("name") == "" {
+		err = fmt.Errorf("missing name")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var decisions []testDecision
+	for _, name := range clientViews(client) {
+		steps := views[name].live().explain(client, q)
+		decisions = append(decisions, testDecision{View: name, Steps: steps, Decision: steps[len(steps)-1]})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Name       string         `json:"name"`
+		Type       string         `json:"type"`
+		Client     string         `json:"client"`
+		Generation uint64         `json:"generation"`
+		Views      []testDecision `json:"views"`
+	}{q.Name, dns.TypeToString[q.Qtype], client.String(), configGeneration.Load(), decisions})
+}
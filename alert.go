@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	routeAlerts  flagStringList
+	alertWebhook = flag.String("alert-webhook", "",
+		"URL to POST a JSON notification to when a -route-alert fires or resolves")
+	alertExec = flag.String("alert-exec", "",
+		"Command run when a -route-alert fires or resolves, with arguments: firing|resolved route rcode percent")
+)
+
+func init() {
+	flag.Var(&routeAlerts, "route-alert", "Alert when the share of responses of a route with an rcode is above a threshold "+
+		"over a window, e.g. SERVFAIL>10%/1m ([view/]domain=RCODE>N%[/duration])")
+}
+
+// Alert states, as notified.
+const (
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+// alertMinResponses is the minimum number of responses of a window for an
+// alert to fire, so that one failure of an idle route is not an outage.
+const alertMinResponses = 10
+
+// alertTimeout is the timeout of a -alert-webhook notification.
+const alertTimeout = 10 * time.Second
+
+// alert watches the share of the responses of a route with an rcode, over
+// consecutive windows.
+type alert struct {
+	route     *routeEntry
+	rcode     int
+	threshold float64 // ratio
+	window    time.Duration
+
+	sync.Mutex
+	responses int // in the current window
+	matched   int // with rcode, in the current window
+	firing    bool
+}
+
+// parseAlert parses RCODE>N%[/duration], the window defaulting to a minute.
+func parseAlert(r *routeEntry, s string) (*alert, error) {
+	a := &alert{route: r, window: time.Minute}
+	kv := strings.SplitN(s, ">", 2)
+	if len(kv) != 2 {
+		return nil, fmt.Errorf("must be RCODE>N%%[/duration]")
+	}
+	rcode, ok := dns.StringToRcode[strings.ToUpper(kv[0])]
+	if !ok {
+		return nil, fmt.Errorf("unknown rcode %v", kv[0])
+	}
+	a.rcode = rcode
+	threshold := kv[1]
+	if s := strings.SplitN(kv[1], "/", 2); len(s) == 2 {
+		window, err := time.ParseDuration(s[1])
+		if err != nil {
+			return nil, err
+		}
+		if window <= 0 {
+			return nil, fmt.Errorf("window must be positive")
+		}
+		threshold, a.window = s[0], window
+	}
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(threshold, "%"), 64)
+	if err != nil || !strings.HasSuffix(threshold, "%") || percent < 0 || percent >= 100 {
+		return nil, fmt.Errorf("invalid threshold %q, must be a percentage below 100%%", threshold)
+	}
+	a.threshold = percent / 100
+	return a, nil
+}
+
+// alerts of all routes.
+var alerts []*alert
+
+// startAlerts watches the -route-alert windows in background.
+func startAlerts() {
+	for _, a := range alerts {
+		go a.watch()
+	}
+}
+
+// countRcode counts a response of r to a client for its alerts.
+func (r *routeEntry) countRcode(rcode int) {
+	for _, a := range r.alerts {
+		a.Lock()
+		a.responses++
+		if rcode == a.rcode {
+			a.matched++
+		}
+		a.Unlock()
+	}
+}
+
+// watch evaluates the alert at the end of each window: it fires when the
+// share of rcode is above the threshold, and resolves at the end of the
+// first window which is not.
+func (a *alert) watch() {
+	for range time.Tick(a.window) {
+		a.Lock()
+		responses, matched := a.responses, a.matched
+		a.responses, a.matched = 0, 0
+		above := responses >= alertMinResponses && float64(matched) > a.threshold*float64(responses)
+		changed := above != a.firing
+		a.firing = above
+		a.Unlock()
+		if !changed {
+			continue
+		}
+		state := alertResolved
+		if above {
+			state = alertFiring
+		}
+		ratio := 0.0
+		if responses > 0 {
+			ratio = float64(matched) / float64(responses)
+		}
+		a.notify(state, ratio, responses)
+	}
+}
+
+// notify logs and notifies a transition of the alert, in background.
+func (a *alert) notify(state string, ratio float64, responses int) {
+	route, rcode := routeName(a.route), dns.RcodeToString[a.rcode]
+	percent := strconv.FormatFloat(ratio*100, 'f', 1, 64)
+	logf("alert: %v%v %v %v%% of %d responses over %v, threshold %v%%",
+		state, a.route.logFields(), rcode, percent, responses, a.window, a.threshold*100)
+	countMetric(metricName("alert", state))
+	if *alertExec != "" {
+		go func() {
+			if out, err := exec.Command(*alertExec, state, route, rcode, percent).CombinedOutput(); err != nil {
+				logf("alert: -alert-exec %v: %v: %s", state, err, out)
+			}
+		}()
+	}
+	if *alertWebhook != "" {
+		b, err := json.Marshal(struct {
+			State     string  `json:"state"`
+			Route     string  `json:"route"`
+			Tag       string  `json:"tag,omitempty"`
+			Rcode     string  `json:"rcode"`
+			Ratio     float64 `json:"ratio"`
+			Threshold float64 `json:"threshold"`
+			Responses int     `json:"responses"`
+			Window    string  `json:"window"`
+		}{state, route, a.route.tag, rcode, ratio, a.threshold, responses, a.window.String()})
+		if err != nil {
+			logf("alert: %v", err)
+			return
+		}
+		go func() {
+			client := tlsPolicy.httpClient(alertTimeout)
+			defer client.CloseIdleConnections()
+			resp, err := client.Post(*alertWebhook, "application/json", bytes.NewReader(b))
+			if err != nil {
+				logf("alert: -alert-webhook %v: %v", state, err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				logf("alert: -alert-webhook %v: %v", state, resp.Status)
+			}
+		}()
+	}
+}
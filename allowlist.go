@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+var (
+	allowlistFile = flag.String("allowlist", "",
+		"File of the only domains resolved with their subdomains, one per line, others get NXDOMAIN")
+	allowDomains = flag.String("allow-domains", "",
+		"The only domains resolved with their subdomains, as with -allowlist (domain,...)")
+)
+
+// allowlist is the domains resolved in allowlist-only mode, nil if disabled.
+var allowlist map[string]bool
+
+// parseAllowlist parses the -allowlist and -allow-domains flags.
+func parseAllowlist() error {
+	if *allowlistFile == "" && *allowDomains == "" {
+		return nil
+	}
+	allowlist = make(map[string]bool)
+	if *allowlistFile != "" {
+		if err := loadDomainList(*allowlistFile, allowlist); err != nil {
+			return fmt.Errorf("invalid -allowlist: %v", err)
+		}
+	}
+	if *allowDomains != "" {
+		for _, domain := range strings.Split(*allowDomains, ",") {
+			allowlist[routeDomain(strings.TrimPrefix(domain, "."))] = true
+		}
+	}
+	return nil
+}
+
+// notAllowlisted returns whether allowlist-only mode refuses to resolve name.
+func notAllowlisted(name string) bool {
+	return allowlist != nil && !domainListed(allowlist, normalizeName(name))
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var answerFilters flagStringList
+
+func init() {
+	flag.Var(&answerFilters, "answer-filter", "Filter the A/AAAA answers of a route pointing inside CIDRs, "+
+		"stripping them or answering NXDOMAIN or rewriting them to an IP ([view/]domain=cidr,... [strip|nxdomain|rewrite=ip])")
+}
+
+// Answer filter actions.
+const (
+	filterStrip    = "strip"    // remove the records
+	filterNXDomain = "nxdomain" // answer NXDOMAIN instead
+	filterRewrite  = "rewrite"  // replace the address, e.g. by a sinkhole
+)
+
+// answerFilter matches answers by address.
+type answerFilter struct {
+	nets    []*net.IPNet
+	action  string
+	rewrite net.IP
+}
+
+// parseAnswerFilter parses cidr,... [strip|nxdomain|rewrite=ip].
+func parseAnswerFilter(s string) (*answerFilter, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, fmt.Errorf("must be cidr,... [strip|nxdomain|rewrite=ip]")
+	}
+	nets, err := parseCIDRs(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	f := &answerFilter{nets: nets, action: filterStrip}
+	if len(fields) == 1 {
+		return f, nil
+	}
+	kv := strings.SplitN(fields[1], "=", 2)
+	f.action = kv[0]
+	switch {
+	case f.action == filterStrip && len(kv) == 1, f.action == filterNXDomain && len(kv) == 1:
+	case f.action == filterRewrite && len(kv) == 2:
+		if f.rewrite = net.ParseIP(kv[1]); f.rewrite == nil {
+			return nil, fmt.Errorf("invalid rewrite IP %v", kv[1])
+		}
+	default:
+		return nil, fmt.Errorf("unknown action %v, must be strip, nxdomain or rewrite=ip", fields[1])
+	}
+	return f, nil
+}
+
+// answerIP returns the address of an A or AAAA record, nil for other types.
+func answerIP(rr dns.RR) net.IP {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A
+	case *dns.AAAA:
+		return rr.AAAA
+	}
+	return nil
+}
+
+// apply filters the answers of resp and returns whether it should be
+// answered NXDOMAIN instead. A rewrite to an IP of another family strips.
+func (f *answerFilter) apply(resp *dns.Msg) bool {
+	answers := resp.Answer[:0]
+	for _, rr := range resp.Answer {
+		ip := answerIP(rr)
+		if ip == nil || !containsIP(f.nets, ip) {
+			answers = append(answers, rr)
+			continue
+		}
+		switch f.action {
+		case filterNXDomain:
+			return true
+		case filterRewrite:
+			if a, ok := rr.(*dns.A); ok && f.rewrite.To4() != nil {
+				a.A = f.rewrite.To4()
+				answers = append(answers, a)
+			} else if aaaa, ok := rr.(*dns.AAAA); ok && f.rewrite.To4() == nil {
+				aaaa.AAAA = f.rewrite
+				answers = append(answers, aaaa)
+			}
+		}
+	}
+	resp.Answer = answers
+	return false
+}
+
+// filterAnswers applies the answer filter of r, if any, to resp and returns
+// whether the query was answered NXDOMAIN instead.
+func (v *view) filterAnswers(r *routeEntry, w dns.ResponseWriter, req, resp *dns.Msg) bool {
+	if r.answerFilter == nil || !r.answerFilter.apply(resp) {
+		return false
+	}
+	q := req.Question[0]
+	logf("answer filter: %s %s from %s: nxdomain", displayName(q.Name), dns.TypeToString[q.Qtype], clientLabel(w, req))
+	v.block(w, req, dns.RcodeNameError, "answer-filter")
+	return true
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/miekg/dns"
+)
+
+var authoritativeOnly = flag.Bool("authoritative-only", false,
+	"Only answer from the local records, DHCP leases and imported local zones, "+
+		"refusing all other queries with an extended DNS error (Not Authoritative) instead of forwarding or failing them")
+
+// checkForwarding makes a proxy with nowhere to forward queries obvious:
+// without -authoritative-only, each view without any route or default
+// server is logged, as all queries not answered locally would fail.
+func checkForwarding() {
+	for _, name := range viewNames() {
+		v := views[name]
+		if *authoritativeOnly {
+			if len(v.routes) > 0 || v.defaultRoute != nil || len(v.scopedDefaults) > 0 {
+				log.Printf("WARNING: -authoritative-only, the routes and default servers of view %q are not used", name)
+			}
+			continue
+		}
+		if len(v.routes) == 0 && v.defaultRoute == nil && len(v.scopedDefaults) == 0 {
+			log.Printf("WARNING: view %q has no route and no default server, queries not answered locally fail with SERVFAIL, "+
+				"see -authoritative-only", name)
+		}
+	}
+}
+
+// refuseNotAuthoritative answers req with REFUSED in -authoritative-only
+// mode, with an extended DNS error saying why for clients with EDNS,
+// counted in the authoritative_only.refused metric.
+func (v *view) refuseNotAuthoritative(w dns.ResponseWriter, req *dns.Msg) {
+	m := v.replyMsg(req, dns.RcodeRefused)
+	m.RecursionAvailable = false
+	if opt := req.IsEdns0(); opt != nil {
+		m.SetEdns0(opt.UDPSize(), false)
+		m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_EDE{
+			InfoCode:  dns.ExtendedErrorCodeNotAuthoritative,
+			ExtraText: "authoritative-only: " + displayName(req.Question[0].Name) + " is not a local name",
+		})
+	}
+	countMetric("authoritative_only.refused")
+	w.WriteMsg(m)
+	v.sinkQuery(w, req, m, nil, "", false, "")
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	lbStrategy = flag.String("lb", lbRandom,
+		"Order in which the backends of a route are tried: random, round-robin, or failover in the order given")
+	routeLBs flagStringList
+)
+
+func init() {
+	flag.Var(&routeLBs, "route-lb", "Order in which the backends of a route are tried, instead of -lb, "+
+		"weighted for a random order by weight ([view/]domain=random|round-robin|failover|weighted=N,...)")
+}
+
+// Load balancing strategies.
+const (
+	lbRandom     = "random"
+	lbRoundRobin = "round-robin"
+	lbFailover   = "failover"
+	lbWeighted   = "weighted"
+)
+
+// balancing is the load balancing of the backends of a route.
+type balancing struct {
+	strategy string
+	weights  []int // weighted, one per backend
+}
+
+// defaultBalancing is -lb.
+var defaultBalancing *balancing
+
+// parseBalancing checks -lb and applies -route-lb to the routes.
+func parseBalancing() error {
+	switch *lbStrategy {
+	case lbRandom, lbRoundRobin, lbFailover:
+		defaultBalancing = &balancing{strategy: *lbStrategy}
+	default:
+		return fmt.Errorf("invalid -lb %v, must be random, round-robin or failover", *lbStrategy)
+	}
+	return setRouteOption("route-lb", routeLBs, func(r *routeEntry, s string) (err error) {
+		r.balancing, err = parseRouteBalancing(s, len(r.backends))
+		return err
+	})
+}
+
+// parseRouteBalancing parses the strategy of a route with n backends.
+func parseRouteBalancing(s string, n int) (*balancing, error) {
+	switch s {
+	case lbRandom, lbRoundRobin, lbFailover:
+		return &balancing{strategy: s}, nil
+	}
+	weights, ok := strings.CutPrefix(s, lbWeighted+"=")
+	if !ok {
+		return nil, fmt.Errorf("unknown strategy %v, must be random, round-robin, failover or weighted=N,...", s)
+	}
+	b := &balancing{strategy: lbWeighted}
+	for _, w := range strings.Split(weights, ",") {
+		weight, err := strconv.Atoi(w)
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid weight %q, must be an integer, 0 to drain the backend", w)
+		}
+		b.weights = append(b.weights, weight)
+	}
+	if len(b.weights) != n {
+		return nil, fmt.Errorf("%d weights for %d backends", len(b.weights), n)
+	}
+	return b, nil
+}
+
+// roundRobin are the round-robin positions by list of backends, shared by
+// the routes to the same backends.
+var roundRobin sync.Map // of *atomic.Uint64
+
+// order returns the indexes of backends in the order to try them.
+func (b *balancing) order(backends []string) []int {
+	if b == nil {
+		b = defaultBalancing
+	}
+	n := len(backends)
+	order := make([]int, n)
+	switch {
+	case n == 0:
+		return nil
+	case b == nil || b.strategy == lbRandom:
+		return rand.Perm(n)
+	case b.strategy == lbRoundRobin:
+		key := strings.Join(backends, ",")
+		p, ok := roundRobin.Load(key)
+		if !ok {
+			p, _ = roundRobin.LoadOrStore(key, new(atomic.Uint64))
+		}
+		start := int((p.(*atomic.Uint64).Add(1) - 1) % uint64(n))
+		for i := range order {
+			order[i] = (start + i) % n
+		}
+	case b.strategy == lbFailover:
+		for i := range order {
+			order[i] = i
+		}
+	case b.strategy == lbWeighted:
+		// A random order where each next backend is drawn by weight among
+		// the remaining ones, those of weight 0 last.
+		remaining := make([]int, n)
+		for i := range remaining {
+			remaining[i] = i
+		}
+		for k := range order {
+			total := 0
+			for _, i := range remaining {
+				total += b.weights[i]
+			}
+			pick := 0
+			if total > 0 {
+				for x := rand.Intn(total); ; pick++ {
+					if x -= b.weights[remaining[pick]]; x < 0 {
+						break
+					}
+				}
+			}
+			order[k] = remaining[pick]
+			remaining = append(remaining[:pick], remaining[pick+1:]...)
+		}
+	}
+	return order
+}
+
+// backendOrder returns the indexes of the backends of r in the order of its
+// balancing, those up before those down so that a dead backend is only
+// tried as a last resort, but for one query in turn every downHoldDown.
+// Without -route-lb, the backends of a route mixing encrypted and plain
+// ones are tried in order, as fallbacks.
+func (r *routeEntry) backendOrder() []int {
+	now := time.Now()
+	down := make([]bool, len(r.backends))
+	for i, addr := range r.backends {
+		down[i] = !getUpstream(addr).tryAfter(r.downFailures(), now)
+	}
+	b := r.balancing
+	if b == nil && mixesTransports(r.backends) {
+		b = &balancing{strategy: lbFailover}
+	}
+	order := b.order(r.backends)
+	sort.SliceStable(order, func(i, j int) bool {
+		return !down[order[i]] && down[order[j]]
+	})
+	return order
+}
+
+func (b *balancing) String() string {
+	if b == nil {
+		b = defaultBalancing
+	}
+	if b == nil {
+		return lbRandom
+	}
+	if b.strategy != lbWeighted {
+		return b.strategy
+	}
+	var weights []string
+	for _, w := range b.weights {
+		weights = append(weights, strconv.Itoa(w))
+	}
+	return lbWeighted + "=" + strings.Join(weights, ",")
+}
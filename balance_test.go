@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackendOrderReinstates(t *testing.T) {
+	r := &routeEntry{
+		backends:  []string{"192.0.2.1:53", "192.0.2.2:53"},
+		balancing: &balancing{strategy: lbFailover},
+	}
+	first := func() int { return r.backendOrder()[0] }
+	u := getUpstream(r.backends[0])
+	for i := 0; i < downFailures; i++ {
+		if got := first(); got != 0 {
+			t.Fatalf("after %d failures, tried %d first, want 0", i, got)
+		}
+		u.observe(0, errors.New("timeout"))
+	}
+	if got := first(); got != 1 {
+		t.Fatalf("down, tried %d first, want 1", got)
+	}
+
+	// After the hold-down, it takes one query, then waits again.
+	u.Lock()
+	u.held = time.Now().Add(-downHoldDown)
+	u.Unlock()
+	if got := first(); got != 0 {
+		t.Fatalf("after the hold-down, tried %d first, want 0", got)
+	}
+	if got := first(); got != 1 {
+		t.Fatalf("after its trial, tried %d first, want 1", got)
+	}
+
+	u.observe(time.Millisecond, nil)
+	for i := 0; i < 3; i++ {
+		if got := first(); got != 0 {
+			t.Fatalf("recovered, tried %d first, want 0", got)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var routeBlackouts flagStringList
+
+func init() {
+	flag.Var(&routeBlackouts, "route-blackout", "Times when a route never goes upstream, e.g. metered uplink hours, "+
+		"answering from the responses kept outside of them and REFUSED otherwise ([view/]domain=hh:mm-hh:mm,...)")
+}
+
+// blackoutEntries is the maximum number of responses kept by a route with
+// blackout windows.
+const blackoutEntries = 10000
+
+// blackout are the windows of a route answering only from the responses
+// it keeps until their TTL expires.
+type blackout struct {
+	windows []timeRange
+	store   *responseStore
+}
+
+// parseBlackout parses hh:mm-hh:mm,...
+func parseBlackout(s string) (*blackout, error) {
+	b := &blackout{store: newResponseStore(blackoutEntries)}
+	for _, r := range strings.Split(s, ",") {
+		t, err := parseTimeRange(r)
+		if err != nil {
+			return nil, err
+		}
+		b.windows = append(b.windows, t)
+	}
+	return b, nil
+}
+
+// active returns whether now is in a blackout window.
+func (b *blackout) active(now time.Time) bool {
+	for _, t := range b.windows {
+		if t.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// answerBlackout answers req of a route in a blackout window from the
+// responses it kept, REFUSED if none, and returns whether it answered.
+func (v *view) answerBlackout(r *routeEntry, w dns.ResponseWriter, req *dns.Msg) bool {
+	if r.blackout == nil || !r.blackout.active(time.Now()) {
+		return false
+	}
+	resp := r.blackout.store.get(questionKey(req.Question[0]), req)
+	if resp == nil {
+		v.refuse(w, req)
+		return true
+	}
+	filterAD(req, resp, "")
+	if w.RemoteAddr().Network() == "udp" {
+		resp.Truncate(udpSize(req))
+	}
+	w.WriteMsg(resp)
+	v.sinkQuery(w, req, resp, r, "", true, "")
+	return true
+}
+
+// storeKey identifies the responses to a question.
+type storeKey struct {
+	name   string // normalized
+	qtype  uint16
+	qclass uint16
+	route  *routeEntry // for a store shared by routes
+	do, cd bool        // DO and CD bits of the query, for a store shared by clients
+	subnet string      // EDNS client subnet sent, for a store shared by clients
+}
+
+// storedResponse is a response with when it expires.
+type storedResponse struct {
+	resp    *dns.Msg
+	stored  time.Time
+	expires time.Time
+}
+
+// responseStore keeps responses until their TTL expires. When full, the
+// expired responses are removed at most every storeExpiry, else an
+// arbitrary one is evicted.
+type responseStore struct {
+	sync.Mutex
+	max     int
+	entries map[storeKey]*storedResponse
+	expired time.Time // last removal of the expired responses
+}
+
+const storeExpiry = time.Second
+
+func newResponseStore(max int) *responseStore {
+	return &responseStore{max: max, entries: make(map[storeKey]*storedResponse)}
+}
+
+func questionKey(q dns.Question) storeKey {
+	return storeKey{name: normalizeName(q.Name), qtype: q.Qtype, qclass: q.Qclass}
+}
+
+// responseTTL returns how long resp can be kept: the lowest TTL of its
+// records, the SOA minimum for a negative response, false if it cannot be
+// kept.
+func responseTTL(resp *dns.Msg) (time.Duration, bool) {
+	if resp.Truncated || resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return 0, false
+	}
+	ttl, found := uint32(0), false
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			h := rr.Header()
+			if h.Rrtype == dns.TypeOPT {
+				continue
+			}
+			t := h.Ttl
+			if soa, ok := rr.(*dns.SOA); ok && len(resp.Answer) == 0 && soa.Minttl < t {
+				t = soa.Minttl
+			}
+			if !found || t < ttl {
+				ttl, found = t, true
+			}
+		}
+	}
+	if !found || ttl == 0 {
+		return 0, false
+	}
+	return time.Duration(ttl) * time.Second, true
+}
+
+// put keeps resp for ttl.
+func (s *responseStore) put(key storeKey, resp *dns.Msg, ttl time.Duration) {
+	now := time.Now()
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.entries[key]; !ok && len(s.entries) >= s.max {
+		if now.Sub(s.expired) >= storeExpiry {
+			s.expire(now)
+		}
+		for evicted := range s.entries {
+			if len(s.entries) < s.max {
+				break
+			}
+			delete(s.entries, evicted)
+		}
+	}
+	s.entries[key] = &storedResponse{resp: resp.Copy(), stored: now, expires: now.Add(ttl)}
+}
+
+// expire removes the expired responses, with the lock held.
+func (s *responseStore) expire(now time.Time) {
+	s.expired = now
+	for key, e := range s.entries {
+		if !now.Before(e.expires) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// len returns the number of responses kept, including expired ones.
+func (s *responseStore) len() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.entries)
+}
+
+// get returns the response kept for key as a response to req, with its
+// TTLs decremented by the time kept, nil if none or expired.
+func (s *responseStore) get(key storeKey, req *dns.Msg) *dns.Msg {
+	now := time.Now()
+	s.Lock()
+	e, ok := s.entries[key]
+	if ok && !now.Before(e.expires) {
+		delete(s.entries, key)
+		ok = false
+	}
+	s.Unlock()
+	if !ok {
+		return nil
+	}
+	resp := e.resp.Copy()
+	resp.Id = req.Id
+	resp.Question = req.Question
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	for _, section := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range section {
+			switch h := rr.Header(); {
+			case h.Rrtype == dns.TypeOPT:
+			case h.Ttl > elapsed:
+				h.Ttl -= elapsed
+			default:
+				h.Ttl = 0
+			}
+		}
+	}
+	return resp
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	blockPageIPs = flag.String("block-page", "",
+		"Answer the A/AAAA queries blocked by a policy with these IPs, of the -block-page-address server, instead of NXDOMAIN or REFUSED (ip,[ip])")
+	blockPageAddress = flag.String("block-page-address", "",
+		"Address of the HTTP server showing the blocked by policy page to the clients sent to -block-page, e.g. :80")
+	blockPageTLSAddress = flag.String("block-page-tls-address", "",
+		"Address of the same server over HTTPS with -tls-cert and -tls-key, which clients will not trust for the blocked names, e.g. :443")
+)
+
+// blockPageTTL is the TTL of the answers to blocked queries, short so that
+// clients resolve real addresses soon after a policy change.
+const blockPageTTL = 60
+
+// blockPageMax is the maximum number of recent blocks kept for the page,
+// the oldest being forgotten when full.
+const blockPageMax = 10000
+
+// blockPageBy are the policies whose blocks are answered with -block-page,
+// by name of the client rather than by the answers or the traffic.
+var blockPageBy = map[string]bool{
+	"allowlist": true,
+	"control":   true,
+	"feed":      true,
+	"group":     true,
+	"nod":       true,
+	"rule":      true,
+}
+
+// blockPage is the parsed -block-page configuration.
+type blockPage struct {
+	ipv4, ipv6 net.IP
+
+	sync.Mutex
+	recent map[string]blockedName // by name, without the root dot
+	order  []string               // of recent, oldest first
+}
+
+// blockedName is a recent block of a name, shown by the page.
+type blockedName struct {
+	by   string
+	when time.Time
+}
+
+var blockPageConfig *blockPage
+
+var blockPageTemplate = template.Must(template.New("blocked").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Blocked by policy</title></head>
+<body>
+<h1>Blocked by policy</h1>
+<p><b>{{.Name}}</b> is blocked by the DNS policy of this network{{if .By}} ({{.By}}, {{.When.Format "2006-01-02 15:04:05 MST"}}){{end}}.</p>
+<p>Contact your network administrator if you think it should not be.</p>
+</body>
+</html>
+`))
+
+// parseBlockPage parses the block page flags and starts its servers.
+func parseBlockPage() error {
+	if *blockPageIPs == "" {
+		if *blockPageAddress != "" || *blockPageTLSAddress != "" {
+			return fmt.Errorf("-block-page-address and -block-page-tls-address need -block-page")
+		}
+		return nil
+	}
+	b := &blockPage{recent: make(map[string]blockedName)}
+	for _, s := range strings.Split(*blockPageIPs, ",") {
+		ip := net.ParseIP(s)
+		switch {
+		case ip == nil:
+			return fmt.Errorf("invalid -block-page IP %v", s)
+		case ip.To4() != nil:
+			b.ipv4 = ip.To4()
+		default:
+			b.ipv6 = ip
+		}
+	}
+	if *blockPageAddress != "" {
+		l, err := net.Listen("tcp", *blockPageAddress)
+		if err != nil {
+			return fmt.Errorf("-block-page-address: %v", err)
+		}
+		go func() {
+			logf("block page: %v", http.Serve(l, b))
+		}()
+	}
+	if *blockPageTLSAddress != "" {
+		if *tlsCert == "" || *tlsKey == "" {
+			return fmt.Errorf("-block-page-tls-address needs -tls-cert and -tls-key")
+		}
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			return fmt.Errorf("-tls-cert: %v", err)
+		}
+		config, err := serverTLSConfig(cert)
+		if err != nil {
+			return err
+		}
+		l, err := tls.Listen("tcp", *blockPageTLSAddress, config)
+		if err != nil {
+			return fmt.Errorf("-block-page-tls-address: %v", err)
+		}
+		go func() {
+			logf("block page: %v", http.Serve(l, b))
+		}()
+	}
+	blockPageConfig = b
+	return nil
+}
+
+// answer returns the answer to req blocked by a policy: the -block-page
+// IPs, and no records for the other types.
+func (b *blockPage) answer(v *view, req *dns.Msg) *dns.Msg {
+	m := v.replyMsg(req, dns.RcodeSuccess)
+	q := req.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: blockPageTTL}
+	switch {
+	case q.Qtype == dns.TypeA && b.ipv4 != nil:
+		m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: b.ipv4})
+	case q.Qtype == dns.TypeAAAA && b.ipv6 != nil:
+		m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: b.ipv6})
+	}
+	return m
+}
+
+// remember keeps by what policy a name was blocked, for the page.
+func (b *blockPage) remember(name, by string) {
+	name = strings.TrimSuffix(normalizeName(name), ".")
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.recent[name]; !ok {
+		if len(b.order) >= blockPageMax {
+			delete(b.recent, b.order[0])
+			b.order = b.order[1:]
+		}
+		b.order = append(b.order, name)
+	}
+	b.recent[name] = blockedName{by: by, when: time.Now()}
+}
+
+// ServeHTTP shows the blocked by policy page of the name the client asked
+// for, with the policy which blocked it if recent.
+func (b *blockPage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := r.Host
+	if host, _, err := net.SplitHostPort(name); err == nil {
+		name = host
+	}
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	b.Lock()
+	blocked := b.recent[name]
+	b.Unlock()
+	countMetric("blockpage.served")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	blockPageTemplate.Execute(w, struct {
+		Name string
+		By   string
+		When time.Time
+	}{name, blocked.by, blocked.when})
+}
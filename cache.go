@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	cacheSize = flag.Int("cache", 0,
+		"Maximum number of responses cached, 0 for no cache")
+	cacheMinTTL = flag.Duration("cache-min-ttl", 0,
+		"Minimum time a response is cached, even if its TTL is lower")
+	cacheMaxTTL = flag.Duration("cache-max-ttl", time.Hour,
+		"Maximum time a response is cached, even if its TTL is higher")
+	cacheNegativeTTL = flag.Duration("cache-negative-ttl", 5*time.Minute,
+		"Maximum time an NXDOMAIN or NODATA response is cached")
+	cacheServfail = flag.Duration("cache-servfail", 0,
+		"Time a SERVFAIL response of a backend is cached, 0 for never")
+)
+
+// cache are the responses of all routes, nil without -cache.
+var cache *responseStore
+
+// parseCache checks the -cache flags and creates the cache.
+func parseCache() error {
+	if *cacheSize <= 0 {
+		return nil
+	}
+	if *cacheMinTTL < 0 || *cacheMaxTTL <= 0 || *cacheNegativeTTL < 0 || *cacheServfail < 0 {
+		return fmt.Errorf("invalid -cache-min-ttl, -cache-max-ttl, -cache-negative-ttl or -cache-servfail, must be positive")
+	}
+	if *cacheMinTTL > *cacheMaxTTL {
+		return fmt.Errorf("invalid -cache-min-ttl %v, above -cache-max-ttl %v", *cacheMinTTL, *cacheMaxTTL)
+	}
+	cache = newResponseStore(*cacheSize)
+	return nil
+}
+
+// cacheKey returns the key of the responses to req forwarded by r, which
+// differ by route, by the DNSSEC bits and by the client subnet sent.
+func cacheKey(r *routeEntry, w dns.ResponseWriter, req *dns.Msg) storeKey {
+	key := questionKey(req.Question[0])
+	key.route = r
+	key.subnet = r.subnetKey(w, req)
+	key.cd = req.CheckingDisabled
+	if opt := req.IsEdns0(); opt != nil {
+		key.do = opt.Do()
+	}
+	return key
+}
+
+// answerCache answers req of r from the cache and returns whether it did,
+// counting the cache.hits and cache.misses metrics.
+func (v *view) answerCache(r *routeEntry, w dns.ResponseWriter, req *dns.Msg) bool {
+	if cache == nil {
+		return false
+	}
+	resp := cache.get(cacheKey(r, w, req), req)
+	if resp == nil {
+		countMetric("cache.misses")
+		return false
+	}
+	countMetric("cache.hits")
+	filterAD(req, resp, "")
+	if w.RemoteAddr().Network() == "udp" {
+		resp.Truncate(udpSize(req))
+	}
+	w.WriteMsg(resp)
+	r.countRcode(resp.Rcode)
+	v.sinkQuery(w, req, resp, r, "", true, "")
+	return true
+}
+
+// cacheResponse caches the response to req forwarded by r for its TTL,
+// within -cache-min-ttl and -cache-max-ttl, or -cache-negative-ttl for
+// NXDOMAIN and NODATA, and a SERVFAIL for -cache-servfail.
+func cacheResponse(r *routeEntry, w dns.ResponseWriter, req, resp *dns.Msg) {
+	if cache == nil {
+		return
+	}
+	if resp.Rcode == dns.RcodeServerFailure {
+		if *cacheServfail > 0 && !resp.Truncated {
+			cache.put(cacheKey(r, w, req), resp, *cacheServfail)
+		}
+		return
+	}
+	ttl, ok := responseTTL(resp)
+	if !ok {
+		return
+	}
+	if ttl < *cacheMinTTL {
+		ttl = *cacheMinTTL
+	}
+	if ttl > *cacheMaxTTL {
+		ttl = *cacheMaxTTL
+	}
+	if negative := resp.Rcode == dns.RcodeNameError || len(resp.Answer) == 0; negative && ttl > *cacheNegativeTTL {
+		ttl = *cacheNegativeTTL
+	}
+	if ttl > 0 {
+		cache.put(cacheKey(r, w, req), resp, ttl)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	probeCapabilities = flag.Bool("probe-capabilities", false,
+		"Probe the backends for EDNS, TCP, DNS over TLS on port 853 and DNS over HTTPS at /dns-query, "+
+			"on startup and every -capability-interval")
+	capabilityInterval = flag.Duration("capability-interval", time.Hour,
+		"Interval between probes of the capabilities of the backends")
+	autoTransports = flag.String("auto-transport", "",
+		"Transports in order of preference to query each backend with, those it supports per -probe-capabilities, "+
+			"instead of the transport of the client (e.g. tls,https,tcp)")
+)
+
+// capabilityTimeout is the timeout of each capability probe.
+const capabilityTimeout = 5 * time.Second
+
+// capabilities are the transports and features supported by a backend, as
+// probed with a . NS query: any response means the transport is supported.
+type capabilities struct {
+	edns  bool // UDP response with an OPT record
+	udp   bool
+	tcp   bool
+	tls   bool
+	https bool
+}
+
+// supports returns whether the backend supports a transport.
+func (c *capabilities) supports(transport string) bool {
+	switch transport {
+	case transportUDP:
+		return c.udp
+	case transportTCP:
+		return c.tcp
+	case transportTLS:
+		return c.tls
+	case transportHTTPS:
+		return c.https
+	}
+	return false
+}
+
+// capability is a named capability and whether it is supported.
+type capability struct {
+	name string
+	ok   bool
+}
+
+func (c *capabilities) list() []capability {
+	return []capability{{"edns", c.edns}, {transportUDP, c.udp}, {transportTCP, c.tcp}, {transportTLS, c.tls}, {transportHTTPS, c.https}}
+}
+
+func (c *capabilities) String() string {
+	var supported []string
+	for _, f := range c.list() {
+		if f.ok {
+			supported = append(supported, f.name)
+		}
+	}
+	if len(supported) == 0 {
+		return "none"
+	}
+	return strings.Join(supported, ",")
+}
+
+var preferredTransports []string
+
+// parseAutoTransport parses -auto-transport, which implies probing.
+func parseAutoTransport() error {
+	if *autoTransports == "" {
+		return nil
+	}
+	transports, err := parseEscalation(*autoTransports)
+	if err != nil {
+		return fmt.Errorf("invalid -auto-transport: %v", err)
+	}
+	preferredTransports = transports
+	*probeCapabilities = true
+	return nil
+}
+
+// autoTransport returns the -auto-transport transports supported by the
+// backend at addr in order of preference, nil if off, not yet probed or
+// supporting none of them so that the transport of the client is used.
+func autoTransport(addr string) []string {
+	if preferredTransports == nil {
+		return nil
+	}
+	c := getUpstream(addr).capabilities()
+	if c == nil {
+		return nil
+	}
+	var transports []string
+	for _, t := range preferredTransports {
+		if c.supports(t) {
+			transports = append(transports, t)
+		}
+	}
+	return transports
+}
+
+// startCapabilityProbes probes the capabilities of every known backend
+// now and every -capability-interval, in background.
+func startCapabilityProbes() {
+	if !*probeCapabilities {
+		return
+	}
+	go func() {
+		for ; ; time.Sleep(*capabilityInterval) {
+			upstreamsMu.Lock()
+			var addrs []string
+			for addr := range upstreams {
+				addrs = append(addrs, addr)
+			}
+			upstreamsMu.Unlock()
+			for _, addr := range addrs {
+				go func(addr string) {
+					c := probeCapabilitiesOf(addr)
+					if getUpstream(addr).setCapabilities(c) {
+						logf("capabilities: %v %v", addr, c)
+					}
+				}(addr)
+			}
+		}
+	}()
+}
+
+// probeCapabilitiesOf probes each transport of the backend at addr, only
+// EDNS and the stream socket of a unix backend, and only its own transport
+// for a tls:// or https:// backend.
+func probeCapabilitiesOf(addr string) *capabilities {
+	req := new(dns.Msg)
+	req.SetQuestion(".", dns.TypeNS)
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	c := &capabilities{}
+	probe := func(f func(ctx context.Context) (*dns.Msg, error)) *dns.Msg {
+		ctx, cancel := context.WithTimeout(context.Background(), capabilityTimeout)
+		defer cancel()
+		resp, err := f(ctx)
+		if err != nil {
+			return nil
+		}
+		return resp
+	}
+	if isEncryptedBackend(addr) {
+		ok := probe(func(ctx context.Context) (*dns.Msg, error) {
+			return queryEncrypted(ctx, addr, nil, req)
+		}) != nil
+		if strings.HasPrefix(addr, tlsPrefix) {
+			c.tls = ok
+		} else {
+			c.https = ok
+		}
+		return c
+	}
+	for _, transport := range []string{transportUDP, transportTCP} {
+		resp := probe(func(ctx context.Context) (*dns.Msg, error) {
+			client, dial := upstreamClient(addr, transport)
+			resp, _, err := client.ExchangeContext(ctx, req, dial)
+			return resp, err
+		})
+		if resp == nil {
+			continue
+		}
+		if resp.IsEdns0() != nil {
+			c.edns = true
+		}
+		if transport == transportUDP {
+			c.udp = true
+		} else {
+			c.tcp = true
+		}
+	}
+	if strings.HasPrefix(addr, unixPrefix) {
+		return c
+	}
+	c.tls = probe(func(ctx context.Context) (*dns.Msg, error) {
+		resp, _, err := queryTLS(ctx, withPort(addr, "853"), nil, req)
+		return resp, err
+	}) != nil
+	c.https = probe(func(ctx context.Context) (*dns.Msg, error) {
+		return queryHTTPS(ctx, dohURL(addr), req)
+	}) != nil
+	return c
+}
+
+// setCapabilities records the probed capabilities of the backend and
+// returns whether they changed.
+func (u *upstream) setCapabilities(c *capabilities) bool {
+	u.Lock()
+	defer u.Unlock()
+	changed := u.caps == nil || *u.caps != *c
+	u.caps = c
+	return changed
+}
+
+// capabilities returns the probed capabilities of the backend, nil if
+// not probed yet.
+func (u *upstream) capabilities() *capabilities {
+	u.Lock()
+	defer u.Unlock()
+	return u.caps
+}
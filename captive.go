@@ -0,0 +1,126 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	captivePortal = flag.String("captive-portal", "",
+		"Captive portal mode: answer all A/AAAA queries with the portal IPs (ip,[ip])")
+	captiveAllow = flag.String("captive-allow", "",
+		"Domains resolved normally in captive portal mode, with their subdomains (domain,...)")
+	captiveExempt = flag.String("captive-exempt", "",
+		"Clients not subject to the captive portal, e.g. once onboarded (ip|cidr,...)")
+)
+
+// captiveTTL is the TTL of captive portal answers, short so that clients
+// resolve real addresses soon after they are onboarded.
+const captiveTTL = 1
+
+// captiveDetectionNames are the names probed by operating systems to detect
+// a captive portal. They always get the portal answer with a zero TTL,
+// even below an allowed domain, otherwise clients would not see the portal.
+var captiveDetectionNames = map[string]bool{
+	"captive.apple.com.":             true,
+	"www.apple.com.":                 true,
+	"connectivitycheck.gstatic.com.": true,
+	"connectivitycheck.android.com.": true,
+	"clients3.google.com.":           true,
+	"www.gstatic.com.":               true,
+	"www.msftconnecttest.com.":       true,
+	"www.msftncsi.com.":              true,
+	"ipv6.msftconnecttest.com.":      true,
+	"detectportal.firefox.com.":      true,
+	"nmcheck.gnome.org.":             true,
+	"network-test.debian.org.":       true,
+	"connectivity-check.ubuntu.com.": true,
+	"conncheck.opensuse.org.":        true,
+	"networkcheck.kde.org.":          true,
+	"spectrum.s3.amazonaws.com.":     true,
+}
+
+// captive is the parsed captive portal configuration.
+type captive struct {
+	ipv4, ipv6 net.IP
+	allowed    []string // domains, normalized
+	exempt     []*net.IPNet
+}
+
+var captiveConfig *captive
+
+// parseCaptive parses the captive portal flags.
+func parseCaptive() error {
+	if *captivePortal == "" {
+		return nil
+	}
+	c := &captive{}
+	for _, s := range strings.Split(*captivePortal, ",") {
+		ip := net.ParseIP(s)
+		switch {
+		case ip == nil:
+			return fmt.Errorf("invalid -captive-portal IP %v", s)
+		case ip.To4() != nil:
+			c.ipv4 = ip.To4()
+		default:
+			c.ipv6 = ip
+		}
+	}
+	if *captiveAllow != "" {
+		for _, domain := range strings.Split(*captiveAllow, ",") {
+			c.allowed = append(c.allowed, routeDomain(strings.TrimPrefix(domain, ".")))
+		}
+	}
+	if *captiveExempt != "" {
+		exempt, err := parseCIDRs(*captiveExempt)
+		if err != nil {
+			return fmt.Errorf("invalid -captive-exempt: %v", err)
+		}
+		c.exempt = exempt
+	}
+	captiveConfig = c
+	return nil
+}
+
+// isAllowed returns whether name is an allowed domain or below one.
+func (c *captive) isAllowed(name string) bool {
+	for _, domain := range c.allowed {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// captiveMsg returns the answer to req from client with the portal
+// addresses, nil if the client is exempt or the name allowed.
+func (v *view) captiveMsg(client net.IP, req *dns.Msg) *dns.Msg {
+	c := captiveConfig
+	if c == nil || containsIP(c.exempt, client) {
+		return nil
+	}
+	q := req.Question[0]
+	name := normalizeName(q.Name)
+	detection := captiveDetectionNames[name]
+	if !detection && c.isAllowed(name) {
+		return nil
+	}
+	ttl := uint32(captiveTTL)
+	if detection {
+		ttl = 0
+	}
+	m := v.replyMsg(req, dns.RcodeSuccess)
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: ttl}
+	switch {
+	case q.Qtype == dns.TypeA && c.ipv4 != nil:
+		m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: c.ipv4})
+	case q.Qtype == dns.TypeAAAA && c.ipv6 != nil:
+		m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: c.ipv6})
+	}
+	// Other types get an empty answer.
+	return m
+}
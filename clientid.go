@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	clientIDOption = flag.Int("client-id-option", 0,
+		"EDNS option code carrying a client identity set by CPEs, e.g. 65001, removed before forwarding (default: none)")
+	clientNamesFile = flag.String("client-names", "",
+		"File of client names by IP or CIDR, one \"ip|cidr name\" per line, the first matching applies")
+)
+
+// clientName is the name of clients from the -client-names file.
+type clientName struct {
+	nets []*net.IPNet
+	name string
+}
+
+var clientNames []clientName
+
+// loadClientNames checks -client-id-option and loads the -client-names file.
+func loadClientNames() error {
+	if *clientIDOption < 0 || *clientIDOption > 0xffff {
+		return fmt.Errorf("invalid -client-id-option %v", *clientIDOption)
+	}
+	if *clientNamesFile == "" {
+		return nil
+	}
+	f, err := os.Open(*clientNamesFile)
+	if err != nil {
+		return fmt.Errorf("-client-names: %v", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("-client-names: invalid line %q, must be ip|cidr name", line)
+		}
+		nets, err := parseCIDRs(fields[0])
+		if err != nil {
+			return fmt.Errorf("-client-names: %v", err)
+		}
+		clientNames = append(clientNames, clientName{nets: nets, name: fields[1]})
+	}
+	return scanner.Err()
+}
+
+// ednsClientID returns the client identity of the -client-id-option EDNS
+// option of req, as text if printable else in hex, "" if none.
+func ednsClientID(req *dns.Msg) string {
+	if *clientIDOption == 0 {
+		return ""
+	}
+	opt := req.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+	for _, o := range opt.Option {
+		local, ok := o.(*dns.EDNS0_LOCAL)
+		if !ok || local.Code != uint16(*clientIDOption) || len(local.Data) == 0 {
+			continue
+		}
+		id := string(local.Data)
+		if strings.IndexFunc(id, func(r rune) bool { return !unicode.IsPrint(r) || unicode.IsSpace(r) }) >= 0 {
+			return hex.EncodeToString(local.Data)
+		}
+		return id
+	}
+	return ""
+}
+
+// clientID returns the identity of the client which sent req: from its
+// EDNS option, else from the -client-names file, "" if unknown.
+func clientID(w dns.ResponseWriter, req *dns.Msg) string {
+	return clientIDOf(remoteIP(w), req)
+}
+
+// clientIDOf is clientID for a query from client.
+func clientIDOf(client net.IP, req *dns.Msg) string {
+	if id := ednsClientID(req); id != "" {
+		return id
+	}
+	return namedClient(client)
+}
+
+// namedClient returns the name of a client IP in the -client-names file,
+// "" if none.
+func namedClient(ip net.IP) string {
+	for _, c := range clientNames {
+		if containsIP(c.nets, ip) {
+			return c.name
+		}
+	}
+	return ""
+}
+
+// clientLabel returns how to log the client which sent req: its identity
+// if known, else its IP.
+func clientLabel(w dns.ResponseWriter, req *dns.Msg) string {
+	if id := clientID(w, req); id != "" {
+		return id
+	}
+	return addrHost(w.RemoteAddr())
+}
+
+// stripClientID returns req without its -client-id-option EDNS option, so
+// that the identity of clients is not sent to the backends.
+func stripClientID(req *dns.Msg) *dns.Msg {
+	if ednsClientID(req) == "" {
+		return req
+	}
+	m := req.Copy()
+	opt := m.IsEdns0()
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != uint16(*clientIDOption) {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+	return m
+}
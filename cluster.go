@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	clusterListen = flag.String("cluster-listen", "",
+		"UDP address where to receive the backend health gossiped by cluster peers (host:port)")
+	clusterPeers = flag.String("cluster-peers", "",
+		"Cluster peers to gossip the state of the backends to (host:port,...)")
+	clusterSecret = flag.String("cluster-secret", "",
+		"Secret shared by the cluster peers, authenticating their gossip")
+	clusterInterval = flag.Duration("cluster-interval", 2*time.Second, "Interval between gossips to the cluster peers")
+)
+
+// clusterMaxSkew is the maximum age of a gossip message, older ones are
+// ignored to prevent replays.
+const clusterMaxSkew = 30 * time.Second
+
+// gossip is the state a node sends to its peers: the backends it sees down.
+// It is sent as JSON after the hex HMAC-SHA256 of the JSON and a space.
+type gossip struct {
+	Node string   `json:"node"`
+	Time int64    `json:"time"` // unix seconds
+	Down []string `json:"down"`
+	Up   []string `json:"up"`
+}
+
+// clusterReportTTL is how long a peer report that a backend is down holds
+// without being refreshed, so that a dead peer does not keep it down.
+func clusterReportTTL() time.Duration {
+	return 3 * *clusterInterval
+}
+
+// startCluster receives and sends gossip in background. Only the health of
+// the backends is shared: rate limits and caches are each node's own.
+func startCluster() error {
+	if *clusterListen == "" && *clusterPeers == "" {
+		return nil
+	}
+	if *clusterSecret == "" {
+		return fmt.Errorf("-cluster-secret is required with -cluster-listen and -cluster-peers")
+	}
+	node, _ := os.Hostname()
+	if *clusterListen != "" {
+		conn, err := net.ListenPacket("udp", *clusterListen)
+		if err != nil {
+			return fmt.Errorf("-cluster-listen: %v", err)
+		}
+		node += "/" + conn.LocalAddr().String()
+		go receiveGossip(conn, node)
+	}
+	if *clusterPeers != "" {
+		var peers []string
+		for _, peer := range strings.Split(*clusterPeers, ",") {
+			if !validHostPort(peer) {
+				return fmt.Errorf("invalid -cluster-peers host:port %v", peer)
+			}
+			peers = append(peers, peer)
+		}
+		go sendGossip(peers, node)
+	}
+	return nil
+}
+
+func signGossip(b []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(*clusterSecret))
+	mac.Write(b)
+	return []byte(fmt.Sprintf("%x", mac.Sum(nil)))
+}
+
+// sendGossip sends the local state of the backends to peers every
+// -cluster-interval.
+func sendGossip(peers []string, node string) {
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		logf("cluster: %v", err)
+		return
+	}
+	for range time.Tick(*clusterInterval) {
+		g := gossip{Node: node, Time: time.Now().Unix()}
+		upstreamsMu.Lock()
+		for addr, u := range upstreams {
+			u.Lock()
+			if u.locallyDown() {
+				g.Down = append(g.Down, addr)
+			} else {
+				g.Up = append(g.Up, addr)
+			}
+			u.Unlock()
+		}
+		upstreamsMu.Unlock()
+		b, err := json.Marshal(g)
+		if err != nil {
+			logf("cluster: %v", err)
+			continue
+		}
+		msg := append(append(signGossip(b), ' '), b...)
+		for _, peer := range peers {
+			addr, err := net.ResolveUDPAddr("udp", peer)
+			if err == nil {
+				_, err = conn.WriteTo(msg, addr)
+			}
+			if err != nil {
+				logf("cluster: %v: %v", peer, err)
+			}
+		}
+	}
+}
+
+// receiveGossip applies the state gossiped by peers.
+func receiveGossip(conn net.PacketConn, node string) {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			logf("cluster: %v", err)
+			return
+		}
+		g, err := parseGossip(buf[:n])
+		if err != nil {
+			logf("cluster: from %v: %v", from, err)
+			continue
+		}
+		if g.Node == node {
+			continue
+		}
+		for _, addr := range g.Down {
+			getUpstream(addr).report(g.Node, true)
+		}
+		for _, addr := range g.Up {
+			upstreamsMu.Lock()
+			u, ok := upstreams[addr]
+			upstreamsMu.Unlock()
+			if ok {
+				u.report(g.Node, false)
+			}
+		}
+	}
+}
+
+func parseGossip(msg []byte) (*gossip, error) {
+	i := strings.IndexByte(string(msg), ' ')
+	if i < 0 || !hmac.Equal(msg[:i], signGossip(msg[i+1:])) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	g := &gossip{}
+	if err := json.Unmarshal(msg[i+1:], g); err != nil {
+		return nil, err
+	}
+	if age := time.Since(time.Unix(g.Time, 0)); age > clusterMaxSkew || age < -clusterMaxSkew {
+		return nil, fmt.Errorf("message from %v is %v old", g.Node, age)
+	}
+	return g, nil
+}
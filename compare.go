@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	compareQueries = flag.String("compare", "",
+		"Send these identical queries to all the backends every -compare-interval and export their comparative latency "+
+			"and answer consistency at /compare of -admin-address (name[/type],...)")
+	compareInterval = flag.Duration("compare-interval", 5*time.Minute, "Interval between the -compare rounds")
+)
+
+// compareBuckets are the upper bounds of the latency buckets of the
+// comparison heatmap, the last bucket counting the slower responses.
+var compareBuckets = []time.Duration{
+	5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond, time.Second,
+}
+
+// comparison is the latency and answer consistency of a backend over the
+// -compare rounds.
+type comparison struct {
+	buckets  []int // by compareBuckets, then slower
+	errors   int
+	answered int // responses compared to the others
+	agreed   int // of answered, the same as most backends
+	last     []compareResult
+}
+
+// compareResult is the response of a backend to a -compare query in the
+// last round.
+type compareResult struct {
+	Query string  `json:"query"`
+	RTT   float64 `json:"rtt_ms"`
+	Agree bool    `json:"agree"`
+	Error string  `json:"error,omitempty"`
+
+	answer string
+}
+
+var (
+	compareList []dns.Question // parsed -compare
+
+	comparisonsMu sync.Mutex
+	comparisons   = make(map[string]*comparison) // by upstream address
+	compareRounds int
+)
+
+func init() {
+	adminMux.HandleFunc("/compare", adminCompare)
+}
+
+// startCompare parses -compare and runs its rounds every -compare-interval,
+// in background.
+func startCompare() error {
+	if *compareQueries == "" {
+		return nil
+	}
+	if *compareInterval <= 0 {
+		return fmt.Errorf("invalid -compare-interval %v, must be positive", *compareInterval)
+	}
+	for _, s := range strings.Split(*compareQueries, ",") {
+		name, typ, _ := strings.Cut(s, "/")
+		qtype := dns.TypeA
+		if typ != "" {
+			t, ok := dns.StringToType[strings.ToUpper(typ)]
+			if !ok {
+				return fmt.Errorf("invalid -compare %v: unknown type %v", s, typ)
+			}
+			qtype = t
+		}
+		if _, ok := dns.IsDomainName(name); !ok {
+			return fmt.Errorf("invalid -compare %v: invalid name", s)
+		}
+		compareList = append(compareList, dns.Question{Name: dns.Fqdn(name), Qtype: qtype, Qclass: dns.ClassINET})
+	}
+	go func() {
+		for ; ; time.Sleep(*compareInterval) {
+			compareRound()
+		}
+	}()
+	return nil
+}
+
+// compareRound sends each -compare query to all the known backends at once
+// and records how fast they answered and whether their answer is the one
+// of most backends, the answer records of the type asked whatever their
+// TTL with the rcode.
+func compareRound() {
+	upstreamsMu.Lock()
+	var addrs []string
+	for addr := range upstreams {
+		addrs = append(addrs, addr)
+	}
+	upstreamsMu.Unlock()
+	sort.Strings(addrs)
+	results := make(map[string][]compareResult, len(addrs))
+	for _, q := range compareList {
+		round := make([]compareResult, len(addrs))
+		var wg sync.WaitGroup
+		for i, addr := range addrs {
+			wg.Add(1)
+			go func(i int, addr string) {
+				defer wg.Done()
+				round[i] = compareQuery(addr, q)
+			}(i, addr)
+		}
+		wg.Wait()
+		answers := make(map[string]int)
+		for _, r := range round {
+			if r.Error == "" {
+				answers[r.answer]++
+			}
+		}
+		var most string
+		for answer, n := range answers {
+			if n > answers[most] || n == answers[most] && answer < most {
+				most = answer
+			}
+		}
+		for i, addr := range addrs {
+			round[i].Agree = round[i].Error == "" && round[i].answer == most
+			results[addr] = append(results[addr], round[i])
+		}
+	}
+
+	comparisonsMu.Lock()
+	defer comparisonsMu.Unlock()
+	compareRounds++
+	for addr, last := range results {
+		c, ok := comparisons[addr]
+		if !ok {
+			c = &comparison{buckets: make([]int, len(compareBuckets)+1)}
+			comparisons[addr] = c
+		}
+		c.last = last
+		for _, r := range last {
+			if r.Error != "" {
+				c.errors++
+				continue
+			}
+			rtt := time.Duration(r.RTT * float64(time.Millisecond))
+			c.buckets[sort.Search(len(compareBuckets), func(i int) bool { return rtt <= compareBuckets[i] })]++
+			c.answered++
+			if r.Agree {
+				c.agreed++
+			}
+		}
+	}
+}
+
+// compareQuery sends a -compare query to a backend over UDP.
+func compareQuery(addr string, q dns.Question) compareResult {
+	r := compareResult{Query: strings.TrimSuffix(q.Name, ".") + "/" + dns.TypeToString[q.Qtype]}
+	req := new(dns.Msg)
+	req.SetQuestion(q.Name, q.Qtype)
+	start := time.Now()
+	resp, err := queryUpstream(addr, "udp", req)
+	r.RTT = float64(time.Since(start)) / float64(time.Millisecond)
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	var answer []string
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == q.Qtype {
+			answer = append(answer, strings.TrimPrefix(rr.String(), rr.Header().String()))
+		}
+	}
+	sort.Strings(answer)
+	r.answer = dns.RcodeToString[resp.Rcode] + " " + strings.Join(answer, " ")
+	return r
+}
+
+// agreement returns the share of the responses of c which were the same as
+// most backends, 1 without any.
+func (c *comparison) agreement() float64 {
+	if c.answered == 0 {
+		return 1
+	}
+	return float64(c.agreed) / float64(c.answered)
+}
+
+// compareGauges returns the mean latency of each backend in the last
+// -compare round and its agreement over all rounds, as the
+// compare.ADDR.rtt_ms and compare.ADDR.agreement gauges.
+func compareGauges() map[string]float64 {
+	comparisonsMu.Lock()
+	defer comparisonsMu.Unlock()
+	gauges := make(map[string]float64)
+	for addr, c := range comparisons {
+		var total float64
+		var n int
+		for _, r := range c.last {
+			if r.Error == "" {
+				total += r.RTT
+				n++
+			}
+		}
+		if n > 0 {
+			gauges[metricName("compare", addr, "rtt_ms")] = total / float64(n)
+		}
+		gauges[metricName("compare", addr, "agreement")] = c.agreement()
+	}
+	return gauges
+}
+
+// adminCompare exports the -compare latency heatmap, the responses of each
+// backend by latency bucket over all rounds, with their agreement and the
+// results of the last round, as JSON or with format=csv as one line per
+// backend.
+func adminCompare(w http.ResponseWriter, r *http.Request) {
+	if *compareQueries == "" {
+		http.Error(w, "no -compare queries", http.StatusNotFound)
+		return
+	}
+	var buckets []string
+	for _, b := range compareBuckets {
+		buckets = append(buckets, "<="+b.String())
+	}
+	buckets = append(buckets, ">"+compareBuckets[len(compareBuckets)-1].String())
+	comparisonsMu.Lock()
+	defer comparisonsMu.Unlock()
+	var addrs []string
+	for addr := range comparisons {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	if r.FormValue("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		out := csv.NewWriter(w)
+		out.Write(append(append([]string{"upstream"}, buckets...), "errors", "agreement"))
+		for _, addr := range addrs {
+			c := comparisons[addr]
+			line := []string{addr}
+			for _, n := range c.buckets {
+				line = append(line, strconv.Itoa(n))
+			}
+			line = append(line, strconv.Itoa(c.errors), strconv.FormatFloat(c.agreement(), 'f', 3, 64))
+			out.Write(line)
+		}
+		out.Flush()
+		return
+	}
+
+	type upstreamComparison struct {
+		Upstream  string          `json:"upstream"`
+		Buckets   []int           `json:"buckets"`
+		Errors    int             `json:"errors"`
+		Agreement float64         `json:"agreement"`
+		Last      []compareResult `json:"last"`
+	}
+	var list []upstreamComparison
+	for _, addr := range addrs {
+		c := comparisons[addr]
+		list = append(list, upstreamComparison{addr, c.buckets, c.errors, c.agreement(), c.last})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Rounds    int                  `json:"rounds"`
+		Buckets   []string             `json:"buckets"`
+		Upstreams []upstreamComparison `json:"upstreams"`
+	}{compareRounds, buckets, list})
+}
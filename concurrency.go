@@ -0,0 +1,22 @@
+package main
+
+import (
+	"flag"
+	"runtime"
+)
+
+var udpListenerCount = flag.Int("udp-listeners", 0,
+	"UDP sockets per listen address sharing the queries with SO_REUSEPORT, 0 for one per CPU on Linux and one elsewhere")
+
+// udpListeners returns the number of UDP sockets per listen address.
+// Queries are handled in their own goroutine, so the sockets are what
+// limits how many cores read queries in parallel.
+func udpListeners() int {
+	if *udpListenerCount > 0 {
+		return *udpListenerCount
+	}
+	if runtime.GOOS != "linux" {
+		return 1
+	}
+	return runtime.GOMAXPROCS(0)
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	configPath = flag.String("config", "",
+		"YAML file of listen addresses, routes, default servers and transfer ACLs, in addition to the flags, "+
+			"reloaded on SIGHUP")
+	defaultConfig = flag.Bool("default-config", false,
+		"Without -config, use the configuration embedded in release builds, default.yaml")
+)
+
+// configView is the configuration of a view in the -config file, whose
+// entries take the same values as the flags of the same name.
+type configView struct {
+	Addresses     []string `yaml:"addresses"` // views only, the default view has address
+	Sources       []string `yaml:"sources"`   // views only
+	Default       []string `yaml:"default"`
+	Route         []string `yaml:"route"`
+	AllowTransfer []string `yaml:"allow-transfer"`
+}
+
+// configRate are the rate limits of all views in the -config file.
+type configRate struct {
+	ClientRate string   `yaml:"client-rate"`
+	GlobalRate string   `yaml:"global-rate"`
+	RateSlip   *int     `yaml:"rate-slip"`
+	RateExempt []string `yaml:"rate-exempt"`
+}
+
+// configFile is the -config file.
+type configFile struct {
+	Address    string `yaml:"address"`
+	configView `yaml:",inline"`
+	configRate `yaml:",inline"`
+	Views      map[string]configView `yaml:"views"`
+}
+
+// loadedConfig is the -config file last applied.
+var loadedConfig *configFile
+
+// view returns the configuration of a view by name, "" for the default.
+func (c *configFile) view(name string) configView {
+	if name == "" {
+		return c.configView
+	}
+	return c.Views[name]
+}
+
+func readConfig(path string) (*configFile, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return decodeConfig(b)
+}
+
+func decodeConfig(b []byte) (*configFile, error) {
+	c := new(configFile)
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil {
+		return nil, err
+	}
+	if len(c.Addresses) > 0 {
+		return nil, fmt.Errorf("addresses is only for views, use address for the default view")
+	}
+	if len(c.Sources) > 0 {
+		return nil, fmt.Errorf("sources is only for views, the default view has the other clients")
+	}
+	for name := range c.Views {
+		if name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("invalid view name %q", name)
+		}
+	}
+	return c, nil
+}
+
+// parseConfig reads the -config file, or the embedded one with
+// -default-config, and adds its entries to the flags, as if given on the
+// command line. A listen address, default server, transfer ACL of a view or
+// rate limit cannot be given both in the file and in flags.
+func parseConfig() error {
+	var c *configFile
+	var err error
+	switch {
+	case *configPath != "":
+		if c, err = readConfig(*configPath); err != nil {
+			return fmt.Errorf("-config: %v", err)
+		}
+	case !*defaultConfig:
+		return nil
+	case embeddedConfig == nil:
+		return fmt.Errorf("-default-config: no configuration embedded, build with -tags release")
+	default:
+		if c, err = decodeConfig(embeddedConfig); err != nil {
+			return fmt.Errorf("-default-config: %v", err)
+		}
+	}
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	conflict := func(what string) error {
+		return fmt.Errorf("-config: %v given both in the file and in flags", what)
+	}
+	if c.Address != "" {
+		if set["address"] {
+			return conflict("address")
+		}
+		*address = c.Address
+	}
+	if len(c.Default) > 0 && len(defaultServers) > 0 {
+		return conflict("default")
+	}
+	defaultServers = append(defaultServers, c.Default...)
+	routeLists = append(routeLists, c.Route...)
+	if len(c.AllowTransfer) > 0 {
+		if set["allow-transfer"] {
+			return conflict("allow-transfer")
+		}
+		*allowTransfer = strings.Join(c.AllowTransfer, ",")
+	}
+	for _, rate := range []struct {
+		name  string
+		value string
+		flag  *string
+	}{
+		{"client-rate", c.ClientRate, clientRate},
+		{"global-rate", c.GlobalRate, globalRate},
+		{"rate-exempt", strings.Join(c.RateExempt, ","), rateExempt},
+	} {
+		if rate.value == "" {
+			continue
+		}
+		if set[rate.name] {
+			return conflict(rate.name)
+		}
+		*rate.flag = rate.value
+	}
+	if c.RateSlip != nil {
+		if set["rate-slip"] {
+			return conflict("rate-slip")
+		}
+		*rateSlip = *c.RateSlip
+	}
+	var names []string
+	for name := range c.Views {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cv := c.Views[name]
+		for _, s := range viewDefaults {
+			if len(cv.Default) > 0 && strings.HasPrefix(s, name+"=") {
+				return conflict("default of view " + name)
+			}
+		}
+		for _, s := range viewAllowTransfers {
+			if len(cv.AllowTransfer) > 0 && strings.HasPrefix(s, name+"=") {
+				return conflict("allow-transfer of view " + name)
+			}
+		}
+		if len(cv.Addresses) > 0 {
+			viewLists = append(viewLists, name+"="+strings.Join(cv.Addresses, ","))
+		} else {
+			viewLists = append(viewLists, name)
+		}
+		if len(cv.Sources) > 0 {
+			viewSourceLists = append(viewSourceLists, name+"="+strings.Join(cv.Sources, ","))
+		}
+		for _, s := range cv.Route {
+			viewRoutes = append(viewRoutes, name+"/"+s)
+		}
+		for _, s := range cv.Default {
+			viewDefaults = append(viewDefaults, name+"="+s)
+		}
+		if len(cv.AllowTransfer) > 0 {
+			viewAllowTransfers = append(viewAllowTransfers, name+"="+strings.Join(cv.AllowTransfer, ","))
+		}
+	}
+	loadedConfig = c
+	return nil
+}
+
+// watchConfig reloads the -config file on SIGHUP, in background.
+func watchConfig() {
+	if *configPath == "" {
+		return
+	}
+	for _, v := range views {
+		v.current = new(atomic.Pointer[view])
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reloadConfig(); err != nil {
+				logf("config: reload of %v: %v, keeping the previous configuration", *configPath, err)
+			}
+		}
+	}()
+}
+
+// reloadConfig reads the -config file again and swaps the routes, default
+// servers and transfer ACLs of each view. Listen addresses, views and rate
+// limits are only read on startup, changing them needs a restart.
+func reloadConfig() error {
+	c, err := readConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	old := loadedConfig
+	if c.Address != old.Address || len(c.Views) != len(old.Views) {
+		return fmt.Errorf("address or views changed, needs a restart")
+	}
+	if !reflect.DeepEqual(c.configRate, old.configRate) {
+		return fmt.Errorf("rate limits changed, needs a restart")
+	}
+	for name, cv := range c.Views {
+		if ov, ok := old.Views[name]; !ok || !slices.Equal(cv.Addresses, ov.Addresses) || !slices.Equal(cv.Sources, ov.Sources) {
+			return fmt.Errorf("view %v added or its addresses or sources changed, needs a restart", name)
+		}
+	}
+	next := make(map[string]*view)
+	for name, v := range views {
+		nv, err := v.live().reloaded(old.view(name), c.view(name))
+		if err != nil {
+			if name != "" {
+				err = fmt.Errorf("view %v: %v", name, err)
+			}
+			return err
+		}
+		next[name] = nv
+	}
+	for name, nv := range next {
+		nv.registerUpstreams()
+		views[name].current.Store(nv)
+	}
+	loadedConfig = c
+	if reflect.DeepEqual(c, old) {
+		return nil
+	}
+	configChanged(fmt.Sprintf("reloaded %v", *configPath))
+	return nil
+}
+
+// reloaded returns a copy of v with the routes, default servers and
+// transfer ACL from the file replaced, from old to c. A route still in the
+// file keeps its per-route flags and state, with its new backends if they
+// changed; the routes given in flags are kept.
+func (v *view) reloaded(old, c configView) (*view, error) {
+	oldRoutes := make(map[string]bool)
+	oldExceptions := make(map[string]bool)
+	for _, s := range old.Route {
+		if strings.HasPrefix(s, "!") {
+			oldExceptions[routeDomain(s[1:])] = true
+		} else if domain, _, err := parseRoute(s); err == nil {
+			oldRoutes[domain] = true
+		}
+	}
+	nv := *v
+	nv.routes = make(map[string]*routeEntry)
+	for domain, r := range v.routes {
+		if !oldRoutes[domain] {
+			nv.routes[domain] = r
+		}
+	}
+	nv.exceptions = nil
+	for _, except := range v.exceptions {
+		if !oldExceptions[except.domain] {
+			nv.exceptions = append(nv.exceptions, except)
+		}
+	}
+	for _, s := range c.Route {
+		if strings.HasPrefix(s, "!") {
+			nv.addException(s[1:])
+			continue
+		}
+		domain, r, err := parseRoute(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route: %v", err)
+		}
+		if prev, ok := v.routes[domain]; ok && oldRoutes[domain] {
+			if slices.Equal(prev.backends, r.backends) {
+				r = prev
+			} else {
+				if b := prev.balancing; b != nil && b.weights != nil && len(b.weights) != len(r.backends) {
+					return nil, fmt.Errorf("route %v has %d -route-lb weights for %d backends", domain, len(b.weights), len(r.backends))
+				}
+				updated := *prev
+				updated.backends = r.backends
+				r = &updated
+			}
+		} else {
+			r.fallback = *fallbackToDefault
+		}
+		nv.routes[domain] = r
+	}
+	nv.order = nil
+	nv.sortRoutes()
+	if !slices.Equal(old.Default, c.Default) {
+		nv.defaultRoute, nv.scopedDefaults = nil, nil
+		for _, s := range c.Default {
+			if err := nv.setDefault(s); err != nil {
+				return nil, fmt.Errorf("invalid default: %v", err)
+			}
+		}
+		if nv.defaultRoute == nil && *recursive {
+			nv.defaultRoute = recursiveRoute()
+		}
+	}
+	if !slices.Equal(old.AllowTransfer, c.AllowTransfer) {
+		nv.transferNets = nil
+		if len(c.AllowTransfer) > 0 {
+			nets, err := parseClientNets(strings.Join(c.AllowTransfer, ","))
+			if err != nil {
+				return nil, fmt.Errorf("invalid allow-transfer: %v", err)
+			}
+			nv.transferNets = nets
+		}
+	}
+	return &nv, nil
+}
+
+// live returns the current version of v, as last reloaded from -config.
+func (v *view) live() *view {
+	if v.current != nil {
+		if nv := v.current.Load(); nv != nil {
+			return nv
+		}
+	}
+	return v
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var consolePath = flag.String("console", "",
+	"Unix socket of an interactive console to inspect and change the proxy at runtime, e.g. with socat - UNIX-CONNECT:path")
+
+// consoleHelp lists the console commands.
+const consoleHelp = `routes [view]            routes of all views or of one view
+upstreams                health and counters of the backends
+listeners                state of the listeners
+rules                    firewall rules in evaluation order
+rule add <rule>          add a firewall rule, as with -rule
+rule del|disable|enable <n>
+query name [type [client]]
+promote|demote           HA transition to active or standby
+maintenance [on|off]     show or turn maintenance mode on or off
+help
+quit
+`
+
+// startConsole listens on the -console unix socket, if any, in background.
+func startConsole() error {
+	if *consolePath == "" {
+		return nil
+	}
+	os.Remove(*consolePath) // left over by a previous run
+	l, err := net.Listen("unix", *consolePath)
+	if err != nil {
+		return fmt.Errorf("-console: %v", err)
+	}
+	if err := os.Chmod(*consolePath, 0600); err != nil {
+		return fmt.Errorf("-console: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				logf("console: %v", err)
+				return
+			}
+			go serveConsole(conn)
+		}
+	}()
+	return nil
+}
+
+// serveConsole runs commands read from conn, one per line.
+func serveConsole(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for {
+		fmt.Fprint(conn, "> ")
+		if !scanner.Scan() {
+			return
+		}
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "quit" || args[0] == "exit" {
+			return
+		}
+		if err := runConsoleCommand(conn, args); err != nil {
+			fmt.Fprintf(conn, "error: %v\n", err)
+		}
+	}
+}
+
+func runConsoleCommand(out io.Writer, args []string) error {
+	switch args[0] {
+	case "help":
+		fmt.Fprint(out, consoleHelp)
+	case "routes":
+		return consoleRoutes(out, args[1:])
+	case "upstreams":
+		upstreamsMu.Lock()
+		var addrs []string
+		for addr := range upstreams {
+			addrs = append(addrs, addr)
+		}
+		upstreamsMu.Unlock()
+		sort.Strings(addrs)
+		for _, addr := range addrs {
+			ports := ""
+			if !strings.HasPrefix(addr, unixPrefix) && !isEncryptedBackend(addr) {
+				ports = " source_port=" + sourcePortOf(addr)
+			}
+			fmt.Fprintf(out, "%v %v%v\n", addr, getUpstream(addr), ports)
+		}
+	case "listeners":
+		for _, l := range listeners {
+			fmt.Fprintln(out, l)
+		}
+	case "rules":
+		rulesMu.RLock()
+		defer rulesMu.RUnlock()
+		for i, r := range rules {
+			state := ""
+			if r.disabled {
+				state = " (disabled)"
+			}
+			fmt.Fprintf(out, "%d: %v%v\n", i+1, r.text, state)
+		}
+	case "rule":
+		return consoleRule(out, args[1:])
+	case "query":
+		return explainQuery(out, args[1:])
+	case "promote":
+		setHAState(haActive)
+	case "demote":
+		setHAState(haStandby)
+	case "maintenance":
+		return consoleMaintenance(out, args[1:])
+	default:
+		return fmt.Errorf("unknown command %v, try help", args[0])
+	}
+	return nil
+}
+
+func consoleMaintenance(out io.Writer, args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "on":
+			setMaintenance(true)
+		case "off":
+			setMaintenance(false)
+		default:
+			return fmt.Errorf("usage: maintenance [on|off]")
+		}
+	}
+	state := "off"
+	if maintenance.Load() {
+		state = "on"
+	}
+	fmt.Fprintln(out, state)
+	return nil
+}
+
+func consoleRoutes(out io.Writer, args []string) error {
+	var names []string
+	for name := range views {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(args) > 0 {
+		if _, ok := views[args[0]]; !ok {
+			return fmt.Errorf("no view %v", args[0])
+		}
+		names = args[:1]
+	}
+	fmt.Fprintf(out, "generation %d\n", configGeneration.Load())
+	for _, name := range names {
+		fmt.Fprintf(out, "view %q:\n", name)
+		for _, line := range views[name].live().routeTable() {
+			fmt.Fprintf(out, "  %v\n", line)
+		}
+	}
+	return nil
+}
+
+// routeTable returns the exceptions, routes and default servers of v, one
+// per line in matching order.
+func (v *view) routeTable() []string {
+	var lines []string
+	for _, except := range v.exceptions {
+		lines = append(lines, fmt.Sprintf("!%v", except.domain))
+	}
+	for _, r := range v.order {
+		tag := ""
+		if r.tag != "" {
+			tag = " tag " + r.tag
+		}
+		lb := ""
+		if len(r.backends) > 1 {
+			lb = " lb " + r.balancing.String()
+		}
+		if r.pool != nil {
+			lb += " pool " + r.pool.name
+		}
+		if r.stub != nil {
+			lb += fmt.Sprintf(" stub zone, name servers %v", r.stub.nameServers())
+		}
+		lines = append(lines, fmt.Sprintf("%v (priority %d%s%s): %v", r.domain, r.priority, tag, lb, r.backends))
+	}
+	for _, r := range v.scopedDefaults {
+		lines = append(lines, fmt.Sprintf("default for %v: backends %v", r.domain, r.backends))
+	}
+	return append(lines, v.explainDefault())
+}
+
+// consoleRule changes the firewall rules, effective for the next queries.
+func consoleRule(out io.Writer, args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: rule add <rule> | rule del|disable|enable <n>")
+	}
+	if args[0] == "add" {
+		r, err := parseRule(strings.Join(args[1:], " "))
+		if err != nil {
+			return err
+		}
+		rulesMu.Lock()
+		defer rulesMu.Unlock()
+		rules = append(rules, r)
+		sortRules()
+		configChanged(fmt.Sprintf("console: rule add %q", r.text))
+		return nil
+	}
+	n, err := strconv.Atoi(args[1])
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	if err != nil || n < 1 || n > len(rules) {
+		return fmt.Errorf("no rule %v", args[1])
+	}
+	r := rules[n-1]
+	switch args[0] {
+	case "del":
+		rules = append(rules[:n-1:n-1], rules[n:]...)
+	case "disable":
+		r.disabled = true
+	case "enable":
+		r.disabled = false
+	default:
+		return fmt.Errorf("unknown rule command %v", args[0])
+	}
+	configChanged(fmt.Sprintf("console: rule %v %q", args[0], r.text))
+	return nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	controlName = flag.String("control-name", "",
+		"TXT record to pull signed route and blocklist updates from, resolved through the routes")
+	controlKey = flag.String("control-key", "",
+		"Ed25519 public key verifying -control-name updates (base64), see the control-keygen subcommand")
+	controlInterval = flag.Duration("control-interval", 5*time.Minute, "Interval between -control-name updates")
+)
+
+// A control update is a single TXT record whose strings concatenated are:
+//
+//	<seq> <base64 signature of "<seq> <commands>"> <commands>
+//
+// with commands separated by ";":
+//
+//	route [view/]domain=host:port,...  route a domain, as with -route
+//	block domain                       NXDOMAIN for domain and subdomains
+//
+// An update replaces all the commands of the previous one, it is applied
+// only if its sequence number is greater.
+
+// controlState is the last applied control update.
+type controlState struct {
+	seq     uint64
+	routes  map[string][]*routeEntry // by view name, in matching order
+	blocked map[string]bool          // domains and their subdomains
+}
+
+var (
+	controlMu sync.RWMutex
+	control   *controlState
+)
+
+// pullControl fetches -control-name now then every -control-interval,
+// in background.
+func pullControl() error {
+	if *controlName == "" {
+		return nil
+	}
+	b, err := base64.StdEncoding.DecodeString(*controlKey)
+	if err != nil || len(b) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid -control-key, must be a base64 Ed25519 public key")
+	}
+	key := ed25519.PublicKey(b)
+	name := routeDomain(*controlName)
+	update := func() {
+		if err := updateControl(name, key); err != nil {
+			logf("control: %v: %v", name, err)
+		}
+	}
+	update()
+	go func() {
+		for range time.Tick(*controlInterval) {
+			update()
+		}
+	}()
+	return nil
+}
+
+// updateControl resolves the control TXT record and applies it if newer.
+func updateControl(name string, key ed25519.PublicKey) error {
+	r := views[""].live().match(name)
+	if r == nil {
+		return errNoRoute
+	}
+	req := new(dns.Msg)
+	req.SetQuestion(name, dns.TypeTXT)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, _, xerr := r.exchange(ctx, "tcp", req)
+	if xerr != nil {
+		return xerr
+	}
+	var txts []*dns.TXT
+	for _, rr := range resp.Answer {
+		if txt, ok := rr.(*dns.TXT); ok {
+			txts = append(txts, txt)
+		}
+	}
+	if len(txts) != 1 {
+		return fmt.Errorf("%d TXT records, want 1", len(txts))
+	}
+	state, err := parseControl(strings.Join(txts[0].Txt, ""), key)
+	if err != nil {
+		return err
+	}
+	controlMu.Lock()
+	defer controlMu.Unlock()
+	if control != nil && state.seq <= control.seq {
+		return nil
+	}
+	control = state
+	configChanged(fmt.Sprintf("control: %v: applied update %d", name, state.seq))
+	return nil
+}
+
+// parseControl verifies and parses a control update.
+func parseControl(s string, key ed25519.PublicKey) (*controlState, error) {
+	fields := strings.SplitN(s, " ", 3)
+	if len(fields) != 3 {
+		return nil, fmt.Errorf("invalid update, must be seq signature commands")
+	}
+	seq, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sequence number %v", fields[0])
+	}
+	sig, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil || !ed25519.Verify(key, []byte(fields[0]+" "+fields[2]), sig) {
+		return nil, fmt.Errorf("invalid signature of update %d", seq)
+	}
+	state := &controlState{seq: seq, routes: make(map[string][]*routeEntry), blocked: make(map[string]bool)}
+	for _, command := range strings.Split(fields[2], ";") {
+		args := strings.Fields(command)
+		if len(args) == 0 {
+			continue
+		}
+		if len(args) != 2 {
+			return nil, fmt.Errorf("invalid command %q", command)
+		}
+		switch args[0] {
+		case "route":
+			name, s := "", args[1]
+			if parts := strings.SplitN(s, "/", 2); len(parts) == 2 && !strings.Contains(parts[0], "=") {
+				name, s = parts[0], parts[1]
+			}
+			if _, ok := views[name]; !ok {
+				return nil, fmt.Errorf("invalid command %q: no -view %v", command, name)
+			}
+			_, r, err := parseRoute(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid command %q: %v", command, err)
+			}
+			r.fallback = *fallbackToDefault
+			state.routes[name] = append(state.routes[name], r)
+		case "block":
+			state.blocked[routeDomain(strings.TrimPrefix(args[1], "."))] = true
+		default:
+			return nil, fmt.Errorf("unknown command %q", args[0])
+		}
+	}
+	for _, routes := range state.routes {
+		sort.SliceStable(routes, func(i, j int) bool {
+			return len(routes[i].domain) > len(routes[j].domain)
+		})
+	}
+	return state, nil
+}
+
+// controlRoute returns the route of the control update for a normalized
+// name in a view, nil if none.
+func controlRoute(view, name string) *routeEntry {
+	controlMu.RLock()
+	defer controlMu.RUnlock()
+	if control == nil {
+		return nil
+	}
+	for _, r := range control.routes[view] {
+		if r.matches(name) {
+			return r
+		}
+	}
+	return nil
+}
+
+// controlBlocked returns whether the control update blocks a query name.
+func controlBlocked(name string) bool {
+	controlMu.RLock()
+	defer controlMu.RUnlock()
+	return control != nil && domainListed(control.blocked, normalizeName(name))
+}
+
+// controlKeygen implements the control-keygen subcommand, printing a new
+// private key for control-sign and its public key for -control-key.
+func controlKeygen(out io.Writer) error {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "private %v\npublic %v\n",
+		base64.StdEncoding.EncodeToString(priv.Seed()), base64.StdEncoding.EncodeToString(pub))
+	return nil
+}
+
+// controlSign implements the control-sign subcommand: control-sign
+// private-key seq commands. It prints the TXT record data of the update.
+func controlSign(out io.Writer, args []string) error {
+	if len(args) < 3 {
+		return fmt.Errorf("usage: control-sign private-key seq commands")
+	}
+	seed, err := base64.StdEncoding.DecodeString(args[0])
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return fmt.Errorf("invalid private key, see control-keygen")
+	}
+	if _, err := strconv.ParseUint(args[1], 10, 64); err != nil {
+		return fmt.Errorf("invalid sequence number %v", args[1])
+	}
+	signed := args[1] + " " + strings.Join(args[2:], " ")
+	sig := ed25519.Sign(ed25519.NewKeyFromSeed(seed), []byte(signed))
+	update := args[1] + " " + base64.StdEncoding.EncodeToString(sig) + signed[len(args[1]):]
+	// TXT strings are at most 255 bytes.
+	var chunks []string
+	for len(update) > 255 {
+		chunks = append(chunks, strconv.Quote(update[:255]))
+		update = update[255:]
+	}
+	chunks = append(chunks, strconv.Quote(update))
+	fmt.Fprintln(out, strings.Join(chunks, " "))
+	return nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"time"
+)
+
+var (
+	udpDeadline = flag.Duration("udp-deadline", 3*time.Second,
+		"Time after which a UDP client has given up on a query, and the proxy stops forwarding it")
+	tcpDeadline = flag.Duration("tcp-deadline", 8*time.Second,
+		"Time after which a TCP client has given up on a query, the idle timeout of its connection")
+)
+
+// queryContext returns the context of a query received over transport,
+// done when its client has given up so that retries and failover stop.
+func queryContext(transport string) (context.Context, context.CancelFunc) {
+	d := *udpDeadline
+	if transport == "tcp" {
+		d = *tcpDeadline
+	}
+	return context.WithTimeout(context.Background(), d)
+}
@@ -0,0 +1,7 @@
+//go:build !release
+
+package main
+
+// embeddedConfig is only embedded in release builds, see
+// defaultconfig_release.go.
+var embeddedConfig []byte
@@ -0,0 +1,10 @@
+//go:build release
+
+package main
+
+import _ "embed"
+
+// embeddedConfig is default.yaml, the configuration of -default-config.
+//
+//go:embed default.yaml
+var embeddedConfig []byte
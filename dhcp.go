@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	dhcpLeaseFiles flagStringList
+	dhcpDomain     = flag.String("dhcp-domain", "lan",
+		"Domain under which the hostnames of the -dhcp-leases are answered")
+	dhcpRefresh = flag.Duration("dhcp-refresh", 10*time.Second,
+		"Interval between checks of the -dhcp-leases files for changes")
+)
+
+func init() {
+	flag.Var(&dhcpLeaseFiles, "dhcp-leases", "DHCP lease file of dnsmasq, ISC dhcpd or Kea (CSV) whose hostnames "+
+		"are answered under -dhcp-domain, with their PTR (path)")
+}
+
+// leaseTTL is the TTL of answers from DHCP leases, short as leases change.
+const leaseTTL = 60
+
+// lease is a DHCP lease with a hostname.
+type lease struct {
+	name    string // fully qualified under -dhcp-domain, lowercase
+	ip      net.IP
+	expires time.Time // zero for never
+}
+
+func (l *lease) valid(now time.Time) bool {
+	return l.expires.IsZero() || now.Before(l.expires)
+}
+
+// leaseTable are the leases of all files, by name and by reverse name.
+type leaseTable struct {
+	byName map[string][]*lease
+	byAddr map[string]*lease
+}
+
+var (
+	leaseDomain  string
+	leaseMu      sync.RWMutex
+	leases       = &leaseTable{}
+	leaseModTime = make(map[string]time.Time) // by file, last loaded
+)
+
+// watchLeases loads the -dhcp-leases files, then reloads them when they
+// change, in background.
+func watchLeases() error {
+	if len(dhcpLeaseFiles) == 0 {
+		return nil
+	}
+	leaseDomain = routeDomain(strings.Trim(*dhcpDomain, "."))
+	if leaseDomain == "." {
+		return fmt.Errorf("invalid -dhcp-domain %q", *dhcpDomain)
+	}
+	if err := loadLeases(); err != nil {
+		return err
+	}
+	go func() {
+		for range time.Tick(*dhcpRefresh) {
+			if !leasesChanged() {
+				continue
+			}
+			if err := loadLeases(); err != nil {
+				logf("dhcp: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// leasesChanged returns whether a lease file was modified since loaded.
+func leasesChanged() bool {
+	for _, path := range dhcpLeaseFiles {
+		fi, err := os.Stat(path)
+		if err != nil || !fi.ModTime().Equal(leaseModTime[path]) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadLeases parses all the lease files and swaps the leases, the later
+// files and leases replacing the earlier ones for the same address.
+func loadLeases() error {
+	byIP := make(map[string]*lease)
+	for _, path := range dhcpLeaseFiles {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		leaseModTime[path] = fi.ModTime()
+		parsed, err := parseLeaseFile(path)
+		if err != nil {
+			return fmt.Errorf("%v: %v", path, err)
+		}
+		for _, l := range parsed {
+			byIP[l.ip.String()] = l
+		}
+	}
+	t := &leaseTable{byName: make(map[string][]*lease), byAddr: make(map[string]*lease)}
+	for ip, l := range byIP {
+		t.byName[l.name] = append(t.byName[l.name], l)
+		if reverse, err := dns.ReverseAddr(ip); err == nil {
+			t.byAddr[reverse] = l
+		}
+	}
+	leaseMu.Lock()
+	leases = t
+	leaseMu.Unlock()
+	return nil
+}
+
+// parseLeaseFile parses a lease file, detecting its format.
+func parseLeaseFile(path string) ([]*lease, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := string(b)
+	switch {
+	case strings.HasPrefix(s, "address,"):
+		return parseKeaLeases(strings.NewReader(s))
+	case strings.Contains(s, "lease ") && strings.Contains(s, "{"):
+		return parseISCLeases(strings.NewReader(s))
+	}
+	return parseDnsmasqLeases(strings.NewReader(s))
+}
+
+// leaseName returns the fully qualified name of a DHCP hostname, keeping
+// its first label, "" if it is not a valid label.
+func leaseName(hostname string) string {
+	label := strings.ToLower(strings.SplitN(strings.Trim(hostname, `"`), ".", 2)[0])
+	if label == "" || len(label) > 63 {
+		return ""
+	}
+	for _, c := range label {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return ""
+		}
+	}
+	return label + "." + leaseDomain
+}
+
+// parseDnsmasqLeases parses a dnsmasq lease file, whose lines are
+// "expiry mac|iaid ip hostname client-id" with expiry 0 for never.
+func parseDnsmasqLeases(r io.Reader) ([]*lease, error) {
+	var parsed []*lease
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[0] == "duid" {
+			continue
+		}
+		expiry, err := strconv.ParseInt(fields[0], 10, 64)
+		ip := net.ParseIP(fields[2])
+		name := leaseName(fields[3])
+		if err != nil || ip == nil || name == "" {
+			continue
+		}
+		l := &lease{name: name, ip: ip}
+		if expiry != 0 {
+			l.expires = time.Unix(expiry, 0)
+		}
+		parsed = append(parsed, l)
+	}
+	return parsed, scanner.Err()
+}
+
+// parseISCLeases parses an ISC dhcpd.leases file of
+// "lease ip { ends ...; binding state ...; client-hostname ...; }" blocks,
+// a later block for an address replacing the earlier ones.
+func parseISCLeases(r io.Reader) ([]*lease, error) {
+	var parsed []*lease
+	var l *lease
+	active := false
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(strings.TrimSuffix(strings.TrimSpace(scanner.Text()), ";"))
+		switch {
+		case len(fields) == 3 && fields[0] == "lease" && fields[2] == "{":
+			l, active = &lease{ip: net.ParseIP(fields[1])}, true
+		case l == nil || len(fields) == 0:
+		case fields[0] == "}":
+			if l.ip != nil && l.name != "" && active {
+				parsed = append(parsed, l)
+			}
+			l = nil
+		case fields[0] == "ends" && len(fields) == 4:
+			if t, err := time.Parse("2006/01/02 15:04:05", fields[2]+" "+fields[3]); err == nil {
+				l.expires = t
+			}
+		case fields[0] == "ends" && len(fields) == 3 && fields[1] == "epoch":
+			if epoch, err := strconv.ParseInt(fields[2], 10, 64); err == nil {
+				l.expires = time.Unix(epoch, 0)
+			}
+		case fields[0] == "binding" && len(fields) == 3 && fields[1] == "state":
+			active = fields[2] == "active"
+		case fields[0] == "client-hostname" && len(fields) == 2:
+			l.name = leaseName(fields[1])
+		}
+	}
+	return parsed, scanner.Err()
+}
+
+// parseKeaLeases parses a Kea memfile lease CSV, v4 or v6, of leases in
+// the default state.
+func parseKeaLeases(r io.Reader) ([]*lease, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, err
+	}
+	column := make(map[string]int)
+	for i, name := range header {
+		column[name] = i
+	}
+	for _, name := range []string{"address", "expire", "hostname", "state"} {
+		if _, ok := column[name]; !ok {
+			return nil, fmt.Errorf("no %v column", name)
+		}
+	}
+	var parsed []*lease
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return parsed, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) != len(header) || record[column["state"]] != "0" {
+			continue
+		}
+		expire, err := strconv.ParseInt(record[column["expire"]], 10, 64)
+		ip := net.ParseIP(record[column["address"]])
+		name := leaseName(record[column["hostname"]])
+		if err != nil || ip == nil || name == "" {
+			continue
+		}
+		parsed = append(parsed, &lease{name: name, ip: ip, expires: time.Unix(expire, 0)})
+	}
+}
+
+// leaseMsg returns the answer to req from the DHCP leases: for A and AAAA
+// queries for names under -dhcp-domain, NXDOMAIN if there is no lease, and
+// for PTR queries for the addresses of the leases. It returns nil for other
+// queries.
+func (v *view) leaseMsg(req *dns.Msg) *dns.Msg {
+	if leaseDomain == "" {
+		return nil
+	}
+	q := req.Question[0]
+	name := normalizeName(q.Name)
+	now := time.Now()
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: leaseTTL}
+	leaseMu.RLock()
+	defer leaseMu.RUnlock()
+	if q.Qtype == dns.TypePTR {
+		l := leases.byAddr[name]
+		if l == nil || !l.valid(now) {
+			return nil
+		}
+		m := v.replyMsg(req, dns.RcodeSuccess)
+		m.Authoritative = true
+		m.Answer = append(m.Answer, &dns.PTR{Hdr: hdr, Ptr: l.name})
+		return m
+	}
+	if name != leaseDomain && !strings.HasSuffix(name, "."+leaseDomain) {
+		return nil
+	}
+	m := v.replyMsg(req, dns.RcodeSuccess)
+	m.Authoritative = true
+	found := false
+	for _, l := range leases.byName[name] {
+		if !l.valid(now) {
+			continue
+		}
+		found = true
+		switch ip4 := l.ip.To4(); {
+		case q.Qtype == dns.TypeA && ip4 != nil:
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ip4})
+		case q.Qtype == dns.TypeAAAA && ip4 == nil:
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: l.ip})
+		}
+	}
+	if !found && name != leaseDomain {
+		m.Rcode = dns.RcodeNameError
+	}
+	return m
+}
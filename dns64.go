@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	dns64Flag = flag.String("dns64", "",
+		"DNS64: synthesize AAAA records from A records for names without, with a NAT64 prefix "+
+			"(e.g. 64:ff9b::/96) or auto to discover it from the default server with RFC 7050")
+	dns64Refresh = flag.Duration("dns64-refresh", time.Hour,
+		"Interval between discoveries of the NAT64 prefix with -dns64 auto")
+)
+
+// ipv4onlyName is the special name of RFC 7050 whose addresses reveal the
+// NAT64 prefix, RFC 8880.
+const ipv4onlyName = "ipv4only.arpa."
+
+// ipv4onlyAddrs are the well-known addresses of ipv4only.arpa.
+var ipv4onlyAddrs = []net.IP{net.IPv4(192, 0, 0, 170).To4(), net.IPv4(192, 0, 0, 171).To4()}
+
+var (
+	dns64Mu  sync.RWMutex
+	dns64Net *net.IPNet // nil if off or not discovered yet
+	dns64On  bool       // whether -dns64 is set
+)
+
+// parseDNS64 parses -dns64 and, with auto, discovers the NAT64 prefix now
+// and every -dns64-refresh in background.
+func parseDNS64() error {
+	if *dns64Flag == "" {
+		return nil
+	}
+	dns64On = true
+	if *dns64Flag != "auto" {
+		_, n, err := net.ParseCIDR(*dns64Flag)
+		if err != nil || n.IP.To4() != nil || !validNAT64Length(n) {
+			return fmt.Errorf("invalid -dns64 %q, must be an IPv6 prefix of length 32, 40, 48, 56, 64 or 96, or auto", *dns64Flag)
+		}
+		dns64Net = n
+		return nil
+	}
+	d := views[""].defaultRoute
+	if d == nil {
+		return fmt.Errorf("-dns64 auto needs a -default server to discover the NAT64 prefix")
+	}
+	go func() {
+		for ; ; time.Sleep(*dns64Refresh) {
+			n, err := discoverNAT64(d)
+			if err != nil {
+				logf("dns64: discovery: %v", err)
+				continue
+			}
+			dns64Mu.Lock()
+			changed := dns64Net == nil || dns64Net.String() != n.String()
+			dns64Net = n
+			dns64Mu.Unlock()
+			if changed {
+				logf("dns64: NAT64 prefix %v", n)
+			}
+		}
+	}()
+	return nil
+}
+
+func validNAT64Length(n *net.IPNet) bool {
+	ones, bits := n.Mask.Size()
+	switch ones {
+	case 32, 40, 48, 56, 64, 96:
+		return bits == 128
+	}
+	return false
+}
+
+// nat64Prefix returns the NAT64 prefix, nil if off or not discovered yet.
+func nat64Prefix() *net.IPNet {
+	dns64Mu.RLock()
+	defer dns64Mu.RUnlock()
+	return dns64Net
+}
+
+// discoverNAT64 queries the AAAA addresses of ipv4only.arpa to the backends
+// of r and returns the prefix in which one embeds a well-known address.
+func discoverNAT64(r *routeEntry) (*net.IPNet, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(ipv4onlyName, dns.TypeAAAA)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, _, xerr := r.exchange(ctx, transportUDP, req)
+	if xerr != nil {
+		return nil, xerr
+	}
+	for _, rr := range resp.Answer {
+		aaaa, ok := rr.(*dns.AAAA)
+		if !ok {
+			continue
+		}
+		for _, ones := range []int{96, 64, 56, 48, 40, 32} {
+			ip4 := extractIPv4(aaaa.AAAA, ones)
+			for _, wk := range ipv4onlyAddrs {
+				if ip4.Equal(wk) {
+					mask := net.CIDRMask(ones, 128)
+					return &net.IPNet{IP: aaaa.AAAA.Mask(mask), Mask: mask}, nil
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("no NAT64 prefix in the AAAA records of %v", ipv4onlyName)
+}
+
+// embedIPv4 returns the IPv4-embedded IPv6 address of ip4 in prefix,
+// skipping the reserved bits 64 to 71 (RFC 6052 section 2.2).
+func embedIPv4(prefix *net.IPNet, ip4 net.IP) net.IP {
+	ones, _ := prefix.Mask.Size()
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16())
+	pos := ones / 8
+	for _, b := range ip4.To4() {
+		if pos == 8 {
+			pos++
+		}
+		ip[pos] = b
+		pos++
+	}
+	return ip
+}
+
+// extractIPv4 returns the IPv4 address embedded in ip with a prefix of
+// length ones.
+func extractIPv4(ip net.IP, ones int) net.IP {
+	ip = ip.To16()
+	ip4 := make(net.IP, 0, net.IPv4len)
+	for pos := ones / 8; len(ip4) < net.IPv4len; pos++ {
+		if pos == 8 {
+			continue
+		}
+		ip4 = append(ip4, ip[pos])
+	}
+	return ip4
+}
+
+// ipv4OnlyMsg returns the answer to the A and AAAA queries for
+// ipv4only.arpa with DNS64, with its well-known addresses and their synthesized AAAA records,
+// so that clients doing 464XLAT discover the NAT64 prefix. It returns nil
+// for other queries.
+func (v *view) ipv4OnlyMsg(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	if !dns64On || normalizeName(q.Name) != ipv4onlyName || q.Qclass != dns.ClassINET {
+		return nil
+	}
+	prefix := nat64Prefix()
+	if prefix == nil {
+		return nil
+	}
+	m := v.replyMsg(req, dns.RcodeSuccess)
+	m.Authoritative = true
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: synthTTL}
+	for _, ip4 := range ipv4onlyAddrs {
+		switch q.Qtype {
+		case dns.TypeA:
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ip4})
+		case dns.TypeAAAA:
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: embedIPv4(prefix, ip4)})
+		}
+	}
+	return m
+}
+
+// synthesizeDNS64 returns the response to an AAAA query req with AAAA
+// records synthesized from the A records of the name, queried with r, if
+// resp has no AAAA record; resp otherwise. Queries with the CD bit are not
+// synthesized, as the client validates (RFC 6147 section 5.5).
+func synthesizeDNS64(ctx context.Context, r *routeEntry, transport string, req, resp *dns.Msg) *dns.Msg {
+	prefix := nat64Prefix()
+	q := req.Question[0]
+	if prefix == nil || q.Qtype != dns.TypeAAAA || q.Qclass != dns.ClassINET || req.CheckingDisabled ||
+		resp.Rcode != dns.RcodeSuccess {
+		return resp
+	}
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == dns.TypeAAAA {
+			return resp
+		}
+	}
+	a := req.Copy()
+	a.Id = dns.Id()
+	a.Question[0].Qtype = dns.TypeA
+	aResp, _, err := r.exchange(ctx, transport, a)
+	if err != nil || aResp.Rcode != dns.RcodeSuccess {
+		return resp
+	}
+	m := resp.Copy()
+	m.Answer, m.Ns = nil, nil
+	synthesized := false
+	for _, rr := range aResp.Answer {
+		switch rr := rr.(type) {
+		case *dns.CNAME:
+			m.Answer = append(m.Answer, rr)
+		case *dns.A:
+			hdr := rr.Hdr
+			hdr.Rrtype = dns.TypeAAAA
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: embedIPv4(prefix, rr.A)})
+			synthesized = true
+		}
+	}
+	if !synthesized {
+		return resp
+	}
+	countMetric("dns64.synthesized")
+	return m
+}
@@ -21,6 +21,8 @@ queries for domains where a route has not been given.
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -49,66 +51,313 @@ func (i *flagStringList) Set(value string) error {
 var (
 	address = flag.String("address", ":53", "Address to listen to (TCP and UDP)")
 
-	defaultServer = flag.String("default", "",
-		"Default DNS server where to send queries if no route matched (host:port)")
+	defaultServers flagStringList
 
 	routeLists flagStringList
-	routes     map[string][]string
+
+	fallbackToDefault = flag.Bool("fallback-to-default", false,
+		"Try the default server when all backends of a route fail")
+
+	maxUDPResponse = flag.Int("max-udp-response", 0,
+		"Maximum size of UDP responses to clients and EDNS buffer size advertised to backends, e.g. 1232 (default: client buffer size)")
+
+	maxAnswers = flag.Int("max-answers", 0,
+		"Maximum number of records of the queried type in UDP responses to clients, e.g. 8 (default: all)")
 
 	allowTransfer = flag.String("allow-transfer", "",
-		"List of IPs allowed to transfer (AXFR/IXFR)")
-	transferIPs []string
+		"List of IPs or CIDRs allowed to transfer (AXFR/IXFR)")
 )
 
 func init() {
 	rand.Seed(time.Now().Unix())
-	flag.Var(&routeLists, "route", "List of routes where to send queries (domain=host:port,[host:port,...])")
+	flag.Var(&defaultServers, "default", "Default DNS server where to send queries if no route matched (host:port), "+
+		"or only for names under a domain (domain=host:port), the most specific one wins")
+	flag.Var(&routeLists, "route", "List of routes where to send queries (domain=host:port,[host:port,...]), or exception to the default (!domain)")
 }
 
 func main() {
 	flag.Parse()
 
-	transferIPs = strings.Split(*allowTransfer, ",")
-	routes = make(map[string][]string)
+	if !validTunnelDetect(*tunnelDetect) {
+		log.Fatal("invalid -tunnel-detect, must be log or block")
+	}
+	if err := parseMultiQuestion(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseServfail(); err != nil {
+		log.Fatal(err)
+	}
+	if *selfTest {
+		if !runSelfTest() {
+			os.Exit(1)
+		}
+		return
+	}
+	if *recordFile != "" {
+		var err error
+		if recording, err = openRecorder(*recordFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *replayFile != "" {
+		var err error
+		if replaying, err = loadReplay(*replayFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := watchTSIGKeys(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parsePools(); err != nil {
+		log.Fatal(err)
+	}
+	views = map[string]*view{"": {
+		addresses: []string{*address},
+		routes:    make(map[string]*routeEntry),
+	}}
+	if *allowTransfer != "" {
+		var err error
+		if views[""].transferNets, err = parseClientNets(*allowTransfer); err != nil {
+			log.Fatalf("invalid -allow-transfer: %v", err)
+		}
+	}
+	for _, server := range defaultServers {
+		if err := views[""].setDefault(server); err != nil {
+			log.Fatalf("invalid -default: %v", err)
+		}
+	}
 	for _, routeList := range routeLists {
-		s := strings.SplitN(routeList, "=", 2)
-		if len(s) != 2 || len(s[0]) == 0 || len(s[1]) == 0 {
-			log.Fatal("invalid -route, must be domain=host:port,[host:port,...]")
-		}
-		var backends []string
-		for _, backend := range strings.Split(s[1], ",") {
-			if !validHostPort(backend) {
-				log.Fatalf("invalid host:port for %v", backend)
-			}
-			backends = append(backends, backend)
+		if err := views[""].addRoute(routeList); err != nil {
+			log.Fatalf("invalid -route: %v", err)
+		}
+	}
+	if err := parseViews(); err != nil {
+		log.Fatal(err)
+	}
+	if err := importConfigs(); err != nil {
+		log.Fatal(err)
+	}
+	if *recursive {
+		if _, err := roots(); err != nil {
+			log.Fatal(err)
 		}
-		if !strings.HasSuffix(s[0], ".") {
-			s[0] += "."
+		for _, v := range views {
+			if v.defaultRoute == nil {
+				v.defaultRoute = recursiveRoute()
+			}
 		}
-		routes[strings.ToLower(s[0])] = backends
 	}
-
-	udpServer := &dns.Server{Addr: *address, Net: "udp"}
-	tcpServer := &dns.Server{Addr: *address, Net: "tcp"}
-	dns.HandleFunc(".", route)
-	go func() {
-		if err := udpServer.ListenAndServe(); err != nil {
+	if err := parseRouteOptions(); err != nil {
+		log.Fatal(err)
+	}
+	checkForwarding()
+	if err := parseCache(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseTrustedUpstreams(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseDNS64(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseBalancing(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseRetryBudget(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseStubs(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseSourcePorts(); err != nil {
+		log.Fatal(err)
+	}
+	if err := startEntropyAudit(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseECS(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseTTLRewrites(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parsePacing(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseRateLimits(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseMaintenance(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseRoutesTXT(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseMirrors(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseSinks(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadRules(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseTLSPolicy(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseFeeds(); err != nil {
+		log.Fatal(err)
+	}
+	refreshFeeds()
+	if err := parseNOD(); err != nil {
+		log.Fatal(err)
+	}
+	if err := watchLeases(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadClientNames(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseGroups(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseCaptive(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseBlockPage(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseProbes(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseAutoTransport(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseOverload(); err != nil {
+		log.Fatal(err)
+	}
+	if err := parseAllowlist(); err != nil {
+		log.Fatal(err)
+	}
+	parsePrivateAnswers()
+	for _, v := range views {
+		v.sortRoutes()
+	}
+	switch flag.Arg(0) {
+	case "query":
+		if err := explainQuery(os.Stdout, flag.Args()[1:]); err != nil {
 			log.Fatal(err)
 		}
-	}()
-	go func() {
-		if err := tcpServer.ListenAndServe(); err != nil {
+		return
+	case "control-keygen":
+		if err := controlKeygen(os.Stdout); err != nil {
 			log.Fatal(err)
 		}
-	}()
+		return
+	case "control-sign":
+		if err := controlSign(os.Stdout, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	for _, v := range views {
+		v.registerUpstreams()
+		handler := v.handler()
+		n := udpListeners()
+		for _, addr := range v.addresses {
+			for i := 0; i < n; i++ {
+				newListener(addr, "udp", handler, n > 1)
+			}
+			newListener(addr, "tcp", handler, false)
+		}
+	}
+	if err := newEncryptedListeners(views[""].handler()); err != nil {
+		log.Fatal(err)
+	}
+	restoreUpstreamState()
+	startHA()
+	startProbes()
+	if err := startCompare(); err != nil {
+		log.Fatal(err)
+	}
+	startCapabilityProbes()
+	startAlerts()
+	watchConfig()
+	if err := pushMetrics(); err != nil {
+		log.Fatal(err)
+	}
+	if err := pullControl(); err != nil {
+		log.Fatal(err)
+	}
+	if err := startCluster(); err != nil {
+		log.Fatal(err)
+	}
+	if err := startConsole(); err != nil {
+		log.Fatal(err)
+	}
+	if err := startAdmin(); err != nil {
+		log.Fatal(err)
+	}
+	if err := startPrometheus(); err != nil {
+		log.Fatal(err)
+	}
+	for _, l := range listeners {
+		go l.serve()
+	}
 
 	// Wait for SIGINT or SIGTERM
 	sigs := make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	<-sigs
 
-	udpServer.Shutdown()
-	tcpServer.Shutdown()
+	drain()
+}
+
+// listenAndServe starts server, with TCP Fast Open on TCP listeners and
+// batched UDP I/O if enabled.
+func listenAndServe(server *dns.Server) error {
+	if server.Net == "udp" && *udpBatch > 0 {
+		var lc net.ListenConfig
+		if server.ReusePort {
+			lc.Control = reusePortControl
+		}
+		conn, err := lc.ListenPacket(context.Background(), "udp", server.Addr)
+		if err != nil {
+			return err
+		}
+		server.PacketConn = newBatchConn(conn.(*net.UDPConn), *udpBatch)
+		return server.ActivateAndServe()
+	}
+	if server.Net != "tcp" || !*tcpFastOpen {
+		return server.ListenAndServe()
+	}
+	lc := net.ListenConfig{Control: tfoListenControl}
+	l, err := lc.Listen(context.Background(), "tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+	server.Listener = l
+	return server.ActivateAndServe()
+}
+
+// defaultRoute returns the route to a default server, nil if empty.
+func defaultRoute(server string) *routeEntry {
+	if server == "" {
+		return nil
+	}
+	return &routeEntry{backends: []string{server}, retries: newRetryBudget(*retryBudgetRatio)}
+}
+
+// routeDomain normalizes the domain of a route flag.
+func routeDomain(s string) string {
+	if !strings.HasSuffix(s, ".") {
+		s += "."
+	}
+	return normalizeName(s)
 }
 
 func validHostPort(s string) bool {
@@ -119,30 +368,314 @@ func validHostPort(s string) bool {
 	return true
 }
 
-func route(w dns.ResponseWriter, req *dns.Msg) {
-	if len(req.Question) == 0 || !allowed(w, req) {
-		dns.HandleFailed(w, req)
+func route(v *view, w dns.ResponseWriter, req *dns.Msg) {
+	if v.multiQuestionAnswered(w, req) {
 		return
 	}
+	if len(req.Question) == 0 {
+		v.fail(w, req)
+		return
+	}
+	d := v.decide(&evaluation{w: w, req: req, addr: w.RemoteAddr()})
+	switch d.kind {
+	case decideFail:
+		if d.err != nil {
+			logQueryError(w, req, &exchangeError{err: d.err})
+		}
+		v.fail(w, req)
+	case decideRefuse:
+		v.refuse(w, req)
+	case decideBlock:
+		v.block(w, req, d.rcode, d.by)
+	case decideDrop:
+	case decideAnswer:
+		if w.RemoteAddr().Network() == "udp" {
+			d.msg.Truncate(udpSize(req))
+		}
+		w.WriteMsg(d.msg)
+	case decideHealth:
+		answerHealth(w, req)
+	case decideRoutesTXT:
+		v.answerRoutesTXT(w, req)
+	case decideMaintenance:
+		v.answerMaintenance(w, req)
+	case decideSafeSearch:
+		v.safeSearch(w, req, d.target)
+	case decideNotAuthoritative:
+		v.refuseNotAuthoritative(w, req)
+	case decideProxy:
+		v.proxy(d.route, w, req)
+	}
+}
+
+// evaluation is a query evaluated by decide, received from w or explained
+// if w is nil: the checks then have no side effect such as logs, metrics or
+// counting the query, and the steps not deciding anything are kept.
+type evaluation struct {
+	w     dns.ResponseWriter // nil when explained
+	req   *dns.Msg
+	addr  net.Addr // of the client
+	steps []string // when explained
+}
+
+// live returns whether the query was received, not explained.
+func (e *evaluation) live() bool {
+	return e.w != nil
+}
+
+// step keeps a step not deciding anything when the query is explained.
+func (e *evaluation) step(format string, a ...interface{}) {
+	if !e.live() {
+		e.steps = append(e.steps, fmt.Sprintf(format, a...))
+	}
+}
 
-	lcName := strings.ToLower(req.Question[0].Name)
-	for name, addrs := range routes {
-		if strings.HasSuffix(lcName, name) {
-			addr := addrs[0]
-			if n := len(addrs); n > 1 {
-				addr = addrs[rand.Intn(n)]
+// Kinds of decisions.
+const (
+	decideFail             = iota // SERVFAIL, logging err if any
+	decideRefuse                  // REFUSED
+	decideBlock                   // blocked by a policy, with rcode
+	decideDrop                    // not answered
+	decideAnswer                  // answered locally with msg
+	decideHealth                  // CHAOS health query
+	decideRoutesTXT               // -routes-txt query
+	decideMaintenance             // maintenance mode
+	decideSafeSearch              // CNAME to target
+	decideNotAuthoritative        // -authoritative-only
+	decideProxy                   // forwarded to route
+)
+
+// decision is how a query is handled, the last step of its evaluation.
+type decision struct {
+	kind   int
+	text   string // why, as explained
+	rcode  int    // of decideBlock
+	by     string // policy of decideBlock
+	err    error
+	msg    *dns.Msg
+	target string
+	route  *routeEntry
+}
+
+// decide evaluates a query in v and returns how it is handled. It is the
+// only evaluation of queries, so that explaining one matches answering it.
+func (v *view) decide(e *evaluation) decision {
+	req := e.req
+	q := req.Question[0]
+	client := addrIP(e.addr)
+	if !v.allowed(e.addr, req) {
+		return decision{kind: decideFail, text: "transfer not allowed: SERVFAIL"}
+	}
+	if isHealthQuery(req) {
+		return decision{kind: decideHealth, text: "CHAOS health query"}
+	}
+	if _, ok := routesTXTQuery(req); ok {
+		return decision{kind: decideRoutesTXT, text: "routes TXT query"}
+	}
+	if isStandby() {
+		return decision{kind: decideRefuse, text: "standby: REFUSED"}
+	}
+	if inMaintenance(client, q) {
+		return decision{kind: decideMaintenance, text: "maintenance: " + dns.RcodeToString[maintenanceCode]}
+	}
+	if *tunnelDetect != "" {
+		if reason := tunnelReason(addrHost(e.addr), q, !e.live()); reason != "" {
+			if e.live() {
+				logf("tunnel: %s from %s for %s %s (%s)", *tunnelDetect, addrHost(e.addr), displayName(q.Name), dns.TypeToString[q.Qtype], reason)
 			}
-			proxy(addr, w, req)
-			return
+			if *tunnelDetect == "block" {
+				return decision{kind: decideBlock, rcode: dns.RcodeRefused, by: "tunnel", text: fmt.Sprintf("tunnel (%v): REFUSED", reason)}
+			}
+			e.step("tunnel (%v): log", reason)
 		}
 	}
 
-	if *defaultServer == "" {
-		dns.HandleFailed(w, req)
-		return
+	if notAllowlisted(q.Name) {
+		return decision{kind: decideBlock, rcode: dns.RcodeNameError, by: "allowlist", text: "not in allowlist: NXDOMAIN"}
+	}
+	if m := v.captiveMsg(client, req); m != nil {
+		return decision{kind: decideAnswer, msg: m, text: "captive portal"}
+	}
+	rule := matchRuleFor(client, q, func(r *rule) {
+		if e.live() {
+			logf("rule: %s %s from %s matched %q", displayName(q.Name), dns.TypeToString[q.Qtype], e.clientLabel(), r.text)
+		}
+		e.step("rule %q: log", r.text)
+	})
+	if rule != nil {
+		text := fmt.Sprintf("rule %q (priority %d): %v", rule.text, rule.priority, rule.action)
+		switch rule.action {
+		case actionDeny:
+			return decision{kind: decideBlock, rcode: dns.RcodeRefused, by: "rule", text: text}
+		case actionRcode:
+			return decision{kind: decideBlock, rcode: rule.rcode, by: "rule", text: text}
+		case actionRoute:
+			e.step("%v", text)
+			return decision{kind: decideProxy, route: rule.route, text: fmt.Sprintf("backends %v", rule.route.backends)}
+		}
+		e.step("%v", text)
+	}
+	if rule == nil {
+		if d, ok := v.decideBlocklists(e); ok {
+			return d
+		}
+	}
+	if len(groups) > 0 {
+		if g := clientGroup(client, clientIDOf(client, req)); g != nil {
+			e.step("group %v", g.name)
+			name := normalizeName(q.Name)
+			if !g.inSchedule(time.Now()) {
+				return decision{kind: decideBlock, rcode: dns.RcodeRefused, by: "group", text: "group schedule: REFUSED"}
+			}
+			if g.isBlocked(name) {
+				return decision{kind: decideBlock, rcode: dns.RcodeNameError, by: "group", text: "group blocklist: NXDOMAIN"}
+			}
+			if target := g.safeSearchTarget(name); target != "" {
+				return decision{kind: decideSafeSearch, target: target, text: "group safe search: CNAME " + target}
+			}
+		}
+	}
+	if s := v.matchSynth(q.Name); s != nil {
+		text := fmt.Sprintf("local %v: %v", s.domain, s.ips)
+		if len(s.ips) == 0 {
+			text = fmt.Sprintf("local %v: NXDOMAIN", s.domain)
+		}
+		return decision{kind: decideAnswer, msg: v.synthMsg(s, req), text: text}
+	}
+	if m := v.leaseMsg(req); m != nil {
+		return decision{kind: decideAnswer, msg: m, text: "DHCP leases: " + dns.RcodeToString[m.Rcode]}
+	}
+	if m := v.ipv4OnlyMsg(req); m != nil {
+		return decision{kind: decideAnswer, msg: m, text: "ipv4only.arpa with DNS64"}
+	}
+	if replaying != nil && !isTransfer(req) {
+		resp := replay(req)
+		if resp == nil {
+			return decision{kind: decideFail, err: errNotRecorded, text: "replay: not recorded: SERVFAIL"}
+		}
+		return decision{kind: decideAnswer, msg: resp, text: "replay: recorded " + dns.RcodeToString[resp.Rcode]}
+	}
+
+	if *authoritativeOnly {
+		return decision{kind: decideNotAuthoritative, text: "authoritative-only: REFUSED"}
 	}
+	r := v.match(q.Name)
+	if r == v.defaultFor(normalizeName(q.Name)) && suppressed(q) {
+		return decision{kind: decideBlock, rcode: dns.RcodeNameError, by: "suppress", text: "suppressed local name: NXDOMAIN"}
+	}
+	if r == nil {
+		return decision{kind: decideFail, err: errNoRoute, text: "no route and no default: SERVFAIL"}
+	}
+	d := decision{kind: decideProxy, route: r}
+	if !e.live() {
+		d.text = v.explainRoute(e, r, q)
+	}
+	return d
+}
+
+// decideBlocklists evaluates the threat feeds, newly observed domains and
+// control blocks, skipped when a rule allowed the query, and returns the
+// decision if one blocks it.
+func (v *view) decideBlocklists(e *evaluation) (decision, bool) {
+	q := e.req.Question[0]
+	if len(feeds) > 0 {
+		if category, action := feedAction(q.Name); category != "" {
+			if e.live() {
+				logf("feed: %s %s from %s in %s: %s", displayName(q.Name), dns.TypeToString[q.Qtype], e.clientLabel(), category, action)
+			}
+			text := fmt.Sprintf("feed %v: %v", category, action)
+			switch action {
+			case feedNXDomain:
+				return decision{kind: decideBlock, rcode: dns.RcodeNameError, by: "feed", text: text}, true
+			case feedNoData:
+				return decision{kind: decideBlock, rcode: dns.RcodeSuccess, by: "feed", text: text}, true
+			case feedDrop:
+				return decision{kind: decideDrop, text: text}, true
+			}
+			e.step("%v", text)
+		}
+	}
+	if domain, age := newlyObserved(q.Name, !e.live()); domain != "" {
+		if e.live() {
+			countMetric("nod.flagged")
+			logf("nod: %s %s from %s: %s first seen %v ago: %s", displayName(q.Name), dns.TypeToString[q.Qtype], e.clientLabel(),
+				domain, age.Round(time.Second), *nodAction)
+		}
+		text := fmt.Sprintf("newly observed domain %v: %v", domain, *nodAction)
+		if *nodAction == feedBlock {
+			return decision{kind: decideBlock, rcode: dns.RcodeNameError, by: "nod", text: text}, true
+		}
+		e.step("%v", text)
+	}
+	if controlBlocked(q.Name) {
+		return decision{kind: decideBlock, rcode: dns.RcodeNameError, by: "control", text: "control block: NXDOMAIN"}, true
+	}
+	return decision{}, false
+}
+
+// clientLabel returns how to log the client of a received query.
+func (e *evaluation) clientLabel() string {
+	return clientLabel(e.w, e.req)
+}
+
+// match returns the route for a query name, the default route if none
+// matched, or nil if there is no default.
+func (v *view) match(name string) *routeEntry {
+	lcName := normalizeName(name)
+	if r := controlRoute(v.name, lcName); r != nil {
+		return r
+	}
+	for _, except := range v.exceptions {
+		if except.matches(lcName) {
+			return v.defaultFor(lcName)
+		}
+	}
+	for _, r := range v.order {
+		if r.matches(lcName) {
+			return r
+		}
+	}
+	return v.defaultFor(lcName)
+}
+
+// reply answers req with a locally synthesized response code.
+func (v *view) reply(w dns.ResponseWriter, req *dns.Msg, rcode int) {
+	w.WriteMsg(v.replyMsg(req, rcode))
+}
+
+// replyMsg returns a locally synthesized response to req with rcode.
+// RA is only set when the query could have been forwarded somewhere.
+func (v *view) replyMsg(req *dns.Msg, rcode int) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetRcode(req, rcode)
+	if len(req.Question) > 0 {
+		m.RecursionAvailable = v.match(req.Question[0].Name) != nil
+	} else {
+		m.RecursionAvailable = v.defaultRoute != nil || len(v.scopedDefaults) > 0
+	}
+	return m
+}
 
-	proxy(*defaultServer, w, req)
+// block answers req with rcode as blocked by a policy, or with the
+// -block-page IPs, logged to the -log-sink with what blocked it.
+func (v *view) block(w dns.ResponseWriter, req *dns.Msg, rcode int, by string) {
+	m := v.replyMsg(req, rcode)
+	if b := blockPageConfig; b != nil && blockPageBy[by] {
+		m = b.answer(v, req)
+		b.remember(req.Question[0].Name, by)
+	}
+	w.WriteMsg(m)
+	v.sinkQuery(w, req, m, nil, "", false, by)
+}
+
+// fail answers req with SERVFAIL.
+func (v *view) fail(w dns.ResponseWriter, req *dns.Msg) {
+	v.reply(w, req, dns.RcodeServerFailure)
+}
+
+// refuse answers req with REFUSED.
+func (v *view) refuse(w dns.ResponseWriter, req *dns.Msg) {
+	v.reply(w, req, dns.RcodeRefused)
 }
 
 func isTransfer(req *dns.Msg) bool {
@@ -155,46 +688,402 @@ func isTransfer(req *dns.Msg) bool {
 	return false
 }
 
-func allowed(w dns.ResponseWriter, req *dns.Msg) bool {
+func (v *view) allowed(addr net.Addr, req *dns.Msg) bool {
 	if !isTransfer(req) {
 		return true
 	}
-	remote, _, _ := net.SplitHostPort(w.RemoteAddr().String())
-	for _, ip := range transferIPs {
-		if ip == remote {
-			return true
-		}
-	}
-	return false
+	return containsAddr(v.transferNets, addr)
 }
 
-func proxy(addr string, w dns.ResponseWriter, req *dns.Msg) {
+// proxy forwards req to the backends of r and relays the response back to w.
+func (v *view) proxy(r *routeEntry, w dns.ResponseWriter, req *dns.Msg) {
 	transport := "udp"
 	if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
 		transport = "tcp"
 	}
+	if r.tag != "" {
+		countMetric(metricName("route", r.tag, "queries"))
+	}
+	if v.answerBlackout(r, w, req) {
+		return
+	}
 	if isTransfer(req) {
-		if transport != "tcp" {
-			dns.HandleFailed(w, req)
+		// DNS over HTTPS looks like TCP but has room for a single message,
+		// so only the first of the zone would reach the client.
+		if _, ok := w.(*dohWriter); ok {
+			v.refuse(w, req)
 			return
 		}
-		t := new(dns.Transfer)
-		c, err := t.In(req, addr)
-		if err != nil {
-			dns.HandleFailed(w, req)
+		if transport != "tcp" || r.recursive {
+			v.fail(w, req)
+			return
+		}
+		addr := r.backends[0]
+		if n := len(r.backends); n > 1 {
+			addr = r.backends[rand.Intn(n)]
+		}
+		if err := transfer(addr, r.tsig, w, req); err != nil {
+			v.proxyFailed(r, w, req, &exchangeError{upstream: addr, attempts: 1, err: err})
+		}
+		return
+	}
+	if v.answerCache(r, w, req) {
+		return
+	}
+	if r.fault != nil {
+		drop, servfail := r.fault.inject()
+		if drop {
 			return
 		}
-		if err = t.Out(w, req, c); err != nil {
-			dns.HandleFailed(w, req)
+		if servfail {
+			v.fail(w, req)
 			return
 		}
+	}
+	out := r.withSubnet(w, stripClientID(req))
+	if transport == "udp" {
+		out = clampUDPSize(out)
+	}
+	if len(mirrors) > 0 {
+		mirrorQuery(r, transport, out)
+	}
+	ctx, cancel := queryContext(transport)
+	defer cancel()
+	if *fastPath && r.tsig == nil && !r.recursive && r.stub == nil && recording == nil &&
+		r.answerFilter == nil && !*blockPrivateAnswers && r.escalate == nil && *autoTransports == "" && r.blackout == nil && len(sinks) == 0 &&
+		r.alerts == nil && tapping.Load() == 0 && cache == nil && !dns64On &&
+		!mirrorCompare && r.ecsPrefix() == nil && len(ttlRewriteRules) == 0 && (*maxAnswers <= 0 || transport != "udp") {
+		v.proxyFast(ctx, r, w, req, transport, out)
 		return
 	}
-	c := &dns.Client{Net: transport}
-	resp, _, err := c.Exchange(req, addr)
+	resp, upstream, err := r.exchange(ctx, transport, out)
+	if d := v.defaultFor(normalizeName(req.Question[0].Name)); err != nil && r.fallback && d != nil && r != d {
+		attempts := err.attempts
+		resp, upstream, err = d.exchange(ctx, transport, out)
+		if err != nil {
+			err.attempts += attempts
+		}
+	}
 	if err != nil {
-		dns.HandleFailed(w, req)
+		v.proxyFailed(r, w, req, err)
+		return
+	}
+	stripSubnet(req, out, resp)
+	rewriteTTLs(resp)
+	filterAD(req, resp, upstream)
+	if mirrorCompare {
+		mirrorResponse(r, transport, out, resp)
+	}
+	if recording != nil {
+		if err := recording.record(resp); err != nil {
+			logf("record: %v", err)
+		}
+	}
+	if dns64On {
+		resp = synthesizeDNS64(ctx, r, transport, out, resp)
+	}
+	if v.filterAnswers(r, w, req, resp) {
+		return
+	}
+	if rebindBlocked(w, req, resp) {
+		v.block(w, req, dns.RcodeRefused, "rebind")
 		return
 	}
+	if r.blackout != nil {
+		if ttl, ok := responseTTL(resp); ok {
+			r.blackout.store.put(questionKey(req.Question[0]), resp, ttl)
+		}
+	}
+	cacheResponse(r, w, req, resp)
+	if transport == "udp" {
+		pruneAnswers(resp)
+		resp.Truncate(udpSize(req))
+	}
+	if r.delay > 0 {
+		time.Sleep(r.delay)
+	}
 	w.WriteMsg(resp)
+	r.countRcode(resp.Rcode)
+	v.sinkQuery(w, req, resp, r, upstream, false, "")
+}
+
+// udpSize returns the maximum size of a UDP response to req: the client
+// EDNS buffer size, or 512 without EDNS, capped by -max-udp-response.
+func udpSize(req *dns.Msg) int {
+	size := dns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	if *maxUDPResponse > 0 && size > *maxUDPResponse {
+		size = *maxUDPResponse
+	}
+	return size
+}
+
+// clampUDPSize returns req with its EDNS buffer size capped by
+// -max-udp-response, so that backends avoid fragmented responses too.
+func clampUDPSize(req *dns.Msg) *dns.Msg {
+	opt := req.IsEdns0()
+	if *maxUDPResponse <= 0 || opt == nil || int(opt.UDPSize()) <= *maxUDPResponse {
+		return req
+	}
+	m := req.Copy()
+	m.IsEdns0().SetUDPSize(uint16(*maxUDPResponse))
+	return m
+}
+
+// pruneAnswers keeps the first -max-answers records of the queried type
+// in resp, and all other records such as the CNAMEs leading to them.
+// It is not a truncation: the response is complete with less records, even
+// if the backend truncated it after more than these records.
+func pruneAnswers(resp *dns.Msg) {
+	if *maxAnswers <= 0 || len(resp.Answer) <= *maxAnswers || len(resp.Question) == 0 {
+		return
+	}
+	qtype := resp.Question[0].Qtype
+	answers := resp.Answer[:0]
+	n := 0
+	for _, rr := range resp.Answer {
+		if rr.Header().Rrtype == qtype {
+			if n == *maxAnswers {
+				resp.Truncated = false
+				continue
+			}
+			n++
+		}
+		answers = append(answers, rr)
+	}
+	resp.Answer = answers
+}
+
+var errNoRoute = errors.New("no route and no default server")
+var errNotRecorded = errors.New("no recorded response to replay")
+
+// exchangeError is the failure of a query sent to the backends of a route.
+type exchangeError struct {
+	upstream  string // last backend tried
+	transport string
+	attempts  int
+	err       error
+	route     *routeEntry // for logging, optional
+}
+
+// proxyFailed logs the failure of a query forwarded with r and answers
+// SERVFAIL.
+func (v *view) proxyFailed(r *routeEntry, w dns.ResponseWriter, req *dns.Msg, err *exchangeError) {
+	err.route = r
+	if r.tag != "" {
+		countMetric(metricName("route", r.tag, "failures"))
+	}
+	logQueryError(w, req, err)
+	m := v.replyMsg(req, dns.RcodeServerFailure)
+	w.WriteMsg(m)
+	r.countRcode(m.Rcode)
+	v.sinkQuery(w, req, m, r, err.upstream, false, "")
+}
+
+func (e *exchangeError) Error() string {
+	return fmt.Sprintf("%v after %d attempts, last to %v: %v", e.transport, e.attempts, e.upstream, e.err)
+}
+
+// exchange sends req to the backends of r in random order until one answers
+// or ctx is done, and returns the response with the backend which answered.
+// With -servfail retry, a SERVFAIL is not an answer but is returned if no
+// backend answers otherwise.
+func (r *routeEntry) exchange(ctx context.Context, transport string, req *dns.Msg) (*dns.Msg, string, *exchangeError) {
+	transport = r.upstreamTransport(transport)
+	e := &exchangeError{transport: transport}
+	if r.recursive || r.stub != nil {
+		upstream := "recursive"
+		if r.stub != nil {
+			upstream = "stub"
+		}
+		resp, err := resolve(ctx, r.stub, req)
+		if err != nil {
+			e.upstream, e.attempts, e.err = upstream, 1, err
+			return nil, "", e
+		}
+		return resp, upstream, nil
+	}
+	var servfail *dns.Msg
+	var servfailFrom string
+	budget := r.retries
+	budget.query()
+	for _, i := range r.backendOrder() {
+		if err := ctx.Err(); err != nil {
+			e.err = err
+			break
+		}
+		if e.attempts > 0 && !budget.retry() {
+			break
+		}
+		e.upstream = r.backends[i]
+		e.attempts++
+		resp, err := r.exchangeBackend(ctx, transport, r.backends[i], req)
+		if err == nil && retryServfail(r.backends[i], resp.Rcode) {
+			if len(r.backends) == 1 && ctx.Err() == nil && budget.retry() {
+				e.attempts++
+				if again, err := r.exchangeBackend(ctx, transport, r.backends[i], req); err == nil {
+					resp = again
+				}
+			}
+			if resp.Rcode == dns.RcodeServerFailure {
+				servfail, servfailFrom = resp, r.backends[i]
+				e.err = errServfail
+				continue
+			}
+		}
+		if err == nil {
+			r.countPool(false)
+			return resp, r.backends[i], nil
+		}
+		e.err = err
+	}
+	r.countPool(servfail == nil)
+	if servfail != nil {
+		return servfail, servfailFrom, nil
+	}
+	return nil, "", e
+}
+
+// exchangeBackend sends req to the backend at addr of r, over its
+// escalation or automatic transports if any, else over transport, or over
+// the transport of a tls:// or https:// backend.
+func (r *routeEntry) exchangeBackend(ctx context.Context, transport, addr string, req *dns.Msg) (*dns.Msg, error) {
+	if isEncryptedBackend(addr) {
+		return exchangeEncrypted(ctx, addr, r.tsig, req)
+	}
+	if r.escalate != nil {
+		return r.escalateExchange(ctx, r.escalate, addr, req)
+	}
+	if transports := autoTransport(addr); transports != nil && r.transport == "" {
+		return r.escalateExchange(ctx, transports, addr, req)
+	}
+	return exchange(ctx, addr, r.tsig, transport, req)
+}
+
+// exchange sends req to addr and returns the response, giving up when ctx
+// is done. If key is not nil, the query is signed and the response verified.
+func exchange(ctx context.Context, addr string, key *tsigKey, transport string, req *dns.Msg) (*dns.Msg, error) {
+	if isEncryptedBackend(addr) {
+		return exchangeEncrypted(ctx, addr, key, req)
+	}
+	if err := pace(ctx, addr); err != nil {
+		return nil, err
+	}
+	c, dial := upstreamClient(addr, transport)
+	if key != nil {
+		c.TsigProvider = tsigProvider{}
+		req = key.sign(req)
+	}
+	var resp *dns.Msg
+	var rtt time.Duration
+	var err error
+	if reuseSockets(addr, transport) {
+		var conn *dns.Conn
+		if conn, err = getSocket(ctx, c, dial); err == nil {
+			auditQuery(conn, req.Id)
+			if resp, rtt, err = c.ExchangeWithConnContext(ctx, req, conn); err == nil {
+				putSocket(addr, conn)
+			} else {
+				conn.Close()
+			}
+		}
+	} else if transport == transportUDP && auditing() {
+		var conn *dns.Conn
+		if conn, err = c.DialContext(ctx, dial); err == nil {
+			auditQuery(conn, req.Id)
+			resp, rtt, err = c.ExchangeWithConnContext(ctx, req, conn)
+			conn.Close()
+		}
+	} else {
+		resp, rtt, err = c.ExchangeContext(ctx, req, dial)
+	}
+	observeExchange(addr, rtt, err)
+	if err != nil {
+		return nil, err
+	}
+	stripTSIG(resp)
+	return resp, nil
+}
+
+// observeExchange records the result of a query to addr in its health
+// and the metrics.
+func observeExchange(addr string, rtt time.Duration, err error) {
+	getUpstream(addr).observe(rtt, err)
+	if err != nil {
+		countMetric(metricName("upstream", addr, "errors"))
+		return
+	}
+	timeMetric(metricName("upstream", addr, "rtt"), rtt)
+}
+
+const (
+	// transferReadTimeout bounds the wait for each message of a zone
+	// transfer from a backend, which may pause while reading a large zone.
+	transferReadTimeout = 30 * time.Second
+	// transferProgressInterval is the interval between progress logs of a
+	// zone transfer.
+	transferProgressInterval = 10 * time.Second
+)
+
+// transfer relays a zone transfer from addr back to w, one message at a
+// time as received so that memory is bounded whatever the size of the zone.
+// Transfers are logged on completion, and every transferProgressInterval.
+func transfer(addr string, key *tsigKey, w dns.ResponseWriter, req *dns.Msg) error {
+	client, dial := upstreamClient(addr, "tcp")
+	conn, err := client.Dial(dial)
+	if err != nil {
+		return err
+	}
+	t := &dns.Transfer{Conn: conn, ReadTimeout: transferReadTimeout}
+	out := req
+	if key != nil {
+		t.TsigProvider = tsigProvider{}
+		out = key.sign(req)
+	}
+	c, err := t.In(out, addr)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer func() {
+		// Unblock and end the reader if the client went away.
+		conn.Close()
+		go func() {
+			for range c {
+			}
+		}()
+	}()
+	q := req.Question[0]
+	start := time.Now()
+	progress := start
+	var messages, records int
+	for env := range c {
+		if env.Error != nil {
+			return fmt.Errorf("transfer of %v after %d records: %v", q.Name, records, env.Error)
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Authoritative = true
+		m.Compress = true // as received, else a full message may not fit
+		m.Answer = env.RR
+		if tsig := req.IsTsig(); tsig != nil && w.TsigStatus() == nil {
+			m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsig.Fudge, time.Now().Unix())
+		}
+		if err := w.WriteMsg(m); err != nil {
+			return fmt.Errorf("transfer of %v to %v after %d records: %v", q.Name, remoteIP(w), records, err)
+		}
+		w.TsigTimersOnly(true)
+		messages++
+		records += len(env.RR)
+		if time.Since(progress) >= transferProgressInterval {
+			progress = time.Now()
+			logf("transfer: %v %v from %v to %v: %d records in %d messages so far, %v",
+				dns.TypeToString[q.Qtype], q.Name, addr, remoteIP(w), records, messages, time.Since(start).Round(time.Second))
+		}
+	}
+	logf("transfer: %v %v from %v to %v: %d records in %d messages, %v",
+		dns.TypeToString[q.Qtype], q.Name, addr, remoteIP(w), records, messages, time.Since(start).Round(time.Millisecond))
+	return nil
 }
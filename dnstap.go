@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dnstapContentType is the frame streams content type of dnstap.
+const dnstapContentType = "protobuf:dnstap.Dnstap"
+
+// Frame streams control frame types and field.
+const (
+	fstrmAccept      = 1
+	fstrmStart       = 2
+	fstrmStop        = 3
+	fstrmReady       = 4
+	fstrmFinish      = 5
+	fstrmContentType = 1
+)
+
+// dnstapRetry is the minimum time between connections to a dnstap socket.
+const dnstapRetry = time.Second
+
+// dnstapWriter writes dnstap frames to a file, or to a unix socket it
+// reconnects to when the connection fails, dropping frames meanwhile.
+type dnstapWriter struct {
+	sync.Mutex
+	path   string // of the unix socket, "" for a file
+	w      io.Writer
+	dialed time.Time
+}
+
+// newDnstapWriter opens a dnstap output: a file, - for stdout, or
+// unix:/path for a socket such as the one of the dnstap command.
+func newDnstapWriter(output string) (*dnstapWriter, error) {
+	if strings.HasPrefix(output, unixPrefix) {
+		d := &dnstapWriter{path: strings.TrimPrefix(output, unixPrefix)}
+		if err := d.connect(); err != nil {
+			logf("dnstap: %v", err)
+		}
+		onShutdown(d.stop)
+		return d, nil
+	}
+	var f *os.File
+	if output == "-" {
+		f = os.Stdout
+	} else {
+		var err error
+		if f, err = os.OpenFile(output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := f.Write(fstrmControl(fstrmStart, true)); err != nil {
+		return nil, err
+	}
+	onShutdown(func() { f.Write(fstrmControl(fstrmStop, false)) })
+	return &dnstapWriter{w: f}, nil
+}
+
+// connect connects to the dnstap socket with the bidirectional handshake.
+func (d *dnstapWriter) connect() error {
+	d.dialed = time.Now()
+	conn, err := net.DialTimeout("unix", d.path, dnstapRetry)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(dnstapRetry))
+	if _, err := conn.Write(fstrmControl(fstrmReady, true)); err != nil {
+		conn.Close()
+		return err
+	}
+	if t, err := readFstrmControl(conn); err != nil || t != fstrmAccept {
+		conn.Close()
+		if err == nil {
+			err = fmt.Errorf("control frame %d, want ACCEPT", t)
+		}
+		return err
+	}
+	if _, err := conn.Write(fstrmControl(fstrmStart, true)); err != nil {
+		conn.Close()
+		return err
+	}
+	conn.SetDeadline(time.Time{})
+	d.w = conn
+	return nil
+}
+
+// stop ends the stream of the dnstap socket, on shutdown.
+func (d *dnstapWriter) stop() {
+	d.Lock()
+	defer d.Unlock()
+	conn, ok := d.w.(net.Conn)
+	if !ok {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(dnstapRetry))
+	conn.Write(fstrmControl(fstrmStop, false))
+	readFstrmControl(conn) // FINISH
+	conn.Close()
+	d.w = nil
+}
+
+var errDnstapDisconnected = errors.New("dnstap socket disconnected")
+
+// Write writes complete frames, so that a new connection starts with one.
+func (d *dnstapWriter) Write(b []byte) (int, error) {
+	d.Lock()
+	defer d.Unlock()
+	if d.w == nil {
+		if time.Since(d.dialed) < dnstapRetry {
+			return len(b), nil
+		}
+		if err := d.connect(); err != nil {
+			return len(b), nil
+		}
+	}
+	if _, err := d.w.Write(b); err != nil {
+		if d.path == "" {
+			return 0, err
+		}
+		d.w.(net.Conn).Close()
+		d.w = nil
+		return len(b), errDnstapDisconnected
+	}
+	return len(b), nil
+}
+
+// fstrmControl returns a control frame, with the dnstap content type.
+func fstrmControl(t uint32, contentType bool) []byte {
+	var payload []byte
+	payload = binary.BigEndian.AppendUint32(payload, t)
+	if contentType {
+		payload = binary.BigEndian.AppendUint32(payload, fstrmContentType)
+		payload = binary.BigEndian.AppendUint32(payload, uint32(len(dnstapContentType)))
+		payload = append(payload, dnstapContentType...)
+	}
+	b := binary.BigEndian.AppendUint32(nil, 0) // escape
+	b = binary.BigEndian.AppendUint32(b, uint32(len(payload)))
+	return append(b, payload...)
+}
+
+// readFstrmControl reads a control frame and returns its type.
+func readFstrmControl(r io.Reader) (uint32, error) {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	if binary.BigEndian.Uint32(header[:4]) != 0 {
+		return 0, errors.New("data frame, want a control frame")
+	}
+	n := binary.BigEndian.Uint32(header[4:])
+	if n < 4 || n > 512 {
+		return 0, fmt.Errorf("invalid control frame length %d", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(payload), nil
+}
+
+// Dnstap protobuf field numbers and values, from dnstap.proto.
+const (
+	dnstapFieldType    = 15
+	dnstapFieldMessage = 14
+	dnstapTypeMessage  = 1
+
+	messageFieldType             = 1
+	messageFieldSocketFamily     = 2
+	messageFieldSocketProtocol   = 3
+	messageFieldQueryAddress     = 4
+	messageFieldResponseAddress  = 5
+	messageFieldQueryPort        = 6
+	messageFieldResponsePort     = 7
+	messageFieldQueryMessage     = 10
+	messageFieldResponseTimeSec  = 12
+	messageFieldResponseTimeNsec = 13
+	messageFieldResponseMessage  = 14
+
+	messageTypeClientResponse = 6
+	socketFamilyINET          = 1
+	socketFamilyINET6         = 2
+	socketProtocolUDP         = 1
+	socketProtocolTCP         = 2
+)
+
+// writeDnstap writes a query as the data frame of a CLIENT_RESPONSE
+// dnstap message.
+func writeDnstap(w io.Writer, e *sinkEvent) error {
+	query, err := e.req.Pack()
+	if err != nil {
+		return err
+	}
+	response, err := e.resp.Pack()
+	if err != nil {
+		return err
+	}
+	var m []byte
+	m = protoVarint(m, messageFieldType, messageTypeClientResponse)
+	client, server := addrIP(e.client), addrIP(e.server)
+	if ip4 := client.To4(); ip4 != nil {
+		m = protoVarint(m, messageFieldSocketFamily, socketFamilyINET)
+		client, server = ip4, server.To4()
+	} else {
+		m = protoVarint(m, messageFieldSocketFamily, socketFamilyINET6)
+	}
+	protocol := uint64(socketProtocolUDP)
+	if e.client.Network() == "tcp" {
+		protocol = socketProtocolTCP
+	}
+	m = protoVarint(m, messageFieldSocketProtocol, protocol)
+	m = protoBytes(m, messageFieldQueryAddress, client)
+	if server != nil {
+		m = protoBytes(m, messageFieldResponseAddress, server)
+	}
+	m = protoVarint(m, messageFieldQueryPort, uint64(addrPort(e.client)))
+	m = protoVarint(m, messageFieldResponsePort, uint64(addrPort(e.server)))
+	m = protoBytes(m, messageFieldQueryMessage, query)
+	m = protoVarint(m, messageFieldResponseTimeSec, uint64(e.time.Unix()))
+	m = protoFixed32(m, messageFieldResponseTimeNsec, uint32(e.time.Nanosecond()))
+	m = protoBytes(m, messageFieldResponseMessage, response)
+
+	var d []byte
+	d = protoVarint(d, dnstapFieldType, dnstapTypeMessage)
+	d = protoBytes(d, dnstapFieldMessage, m)
+	frame := binary.BigEndian.AppendUint32(nil, uint32(len(d)))
+	_, err = w.Write(append(frame, d...))
+	return err
+}
+
+// addrPort returns the port of an address, 0 if none.
+func addrPort(addr net.Addr) int {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.Port
+	case *net.TCPAddr:
+		return addr.Port
+	}
+	return 0
+}
+
+// Protobuf wire encoding, of the few types dnstap uses.
+func protoVarint(b []byte, field int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|0)
+	return binary.AppendUvarint(b, v)
+}
+
+func protoBytes(b []byte, field int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func protoFixed32(b []byte, field int, v uint32) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|5)
+	return binary.LittleEndian.AppendUint32(b, v)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"sync"
+	"time"
+)
+
+var drainTimeout = flag.Duration("drain-timeout", 5*time.Second,
+	"On SIGINT or SIGTERM, time to finish the queries in flight before exiting")
+
+// shutdownHooks flush buffered state, e.g. logs, once the queries drained.
+var shutdownHooks []func()
+
+// onShutdown registers a function called on shutdown after draining.
+func onShutdown(f func()) {
+	shutdownHooks = append(shutdownHooks, f)
+}
+
+// drain stops the listeners from accepting new queries, waits up to
+// -drain-timeout for the queries in flight, then runs the shutdown hooks
+// and flushes the operational log.
+func drain() {
+	ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l *listener) {
+			defer wg.Done()
+			l.shutdown(ctx)
+		}(l)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		logf("shutdown: queries still in flight after %v", *drainTimeout)
+	}
+	for _, f := range shutdownHooks {
+		f()
+	}
+	opLog.flush() // suppressed messages
+}
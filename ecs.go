@@ -0,0 +1,203 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	ecsFlag = flag.String("ecs", "",
+		"Send the backends the client subnet of the queries (EDNS client subnet) with these prefix lengths, "+
+			"IPv6 default 56, e.g. 24/56 (v4[/v6])")
+	routeECS flagStringList
+)
+
+func init() {
+	flag.Var(&routeECS, "route-ecs", "Client subnet prefix lengths sent to the backends of a route instead of -ecs, "+
+		"or off not to send any ([view/]domain=v4[/v6]|off)")
+}
+
+// ecsDefaultV6 is the IPv6 prefix length when only the IPv4 one is given,
+// the usual allocation to a site.
+const ecsDefaultV6 = 56
+
+// ecsPrefix are the prefix lengths of the client subnets sent to backends.
+type ecsPrefix struct {
+	v4, v6 int
+	off    bool // for a route not sending any despite -ecs
+}
+
+// defaultECS is the -ecs prefix, nil without.
+var defaultECS *ecsPrefix
+
+// parseECS parses -ecs and -route-ecs.
+func parseECS() error {
+	if *ecsFlag != "" {
+		p, err := parseECSPrefix(*ecsFlag)
+		if err != nil || p.off {
+			return fmt.Errorf("invalid -ecs %q, must be v4[/v6]", *ecsFlag)
+		}
+		defaultECS = p
+	}
+	return setRouteOption("route-ecs", routeECS, func(r *routeEntry, s string) (err error) {
+		r.ecs, err = parseECSPrefix(s)
+		return err
+	})
+}
+
+// parseECSPrefix parses v4[/v6] prefix lengths, or off.
+func parseECSPrefix(s string) (*ecsPrefix, error) {
+	if s == "off" {
+		return &ecsPrefix{off: true}, nil
+	}
+	v4, v6, hasV6 := strings.Cut(s, "/")
+	p := &ecsPrefix{v6: ecsDefaultV6}
+	var err error
+	if p.v4, err = strconv.Atoi(v4); err != nil || p.v4 < 0 || p.v4 > 32 {
+		return nil, fmt.Errorf("invalid IPv4 prefix length %v, must be 0 to 32", v4)
+	}
+	if hasV6 {
+		if p.v6, err = strconv.Atoi(v6); err != nil || p.v6 < 0 || p.v6 > 128 {
+			return nil, fmt.Errorf("invalid IPv6 prefix length %v, must be 0 to 128", v6)
+		}
+	}
+	return p, nil
+}
+
+// ecsPrefix returns the client subnet prefix lengths of r, nil if it
+// sends none.
+func (r *routeEntry) ecsPrefix() *ecsPrefix {
+	if r.ecs != nil {
+		if r.ecs.off {
+			return nil
+		}
+		return r.ecs
+	}
+	return defaultECS
+}
+
+// clientSubnet returns the EDNS client subnet option of m, if any.
+func clientSubnet(m *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if s, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return s
+		}
+	}
+	return nil
+}
+
+// subnetFor returns the client subnet r sends its backends for req of w,
+// nil for none: the one of the client if it sent one, shortened to the
+// prefix of r, or else the client address truncated to it.
+func (r *routeEntry) subnetFor(w dns.ResponseWriter, req *dns.Msg) *dns.EDNS0_SUBNET {
+	p := r.ecsPrefix()
+	if p == nil {
+		return nil
+	}
+	if s := clientSubnet(req); s != nil {
+		bits := p.v4
+		if s.Family == 2 {
+			bits = p.v6
+		}
+		if s.Family != 1 && s.Family != 2 || int(s.SourceNetmask) <= bits {
+			return s
+		}
+		return newSubnet(s.Address, bits)
+	}
+	ip := remoteIP(w)
+	if ip == nil {
+		return nil
+	}
+	if ip.To4() != nil {
+		return newSubnet(ip, p.v4)
+	}
+	return newSubnet(ip, p.v6)
+}
+
+// newSubnet returns the client subnet option of ip truncated to bits.
+func newSubnet(ip net.IP, bits int) *dns.EDNS0_SUBNET {
+	s := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, SourceNetmask: uint8(bits)}
+	if ip4 := ip.To4(); ip4 != nil {
+		s.Family = 1
+		s.Address = ip4.Mask(net.CIDRMask(bits, 32))
+	} else {
+		s.Family = 2
+		s.Address = ip.Mask(net.CIDRMask(bits, 128))
+	}
+	return s
+}
+
+// subnetKey returns the client subnet r sends for req of w as a cache key,
+// so that responses tailored to a subnet are not given to others.
+func (r *routeEntry) subnetKey(w dns.ResponseWriter, req *dns.Msg) string {
+	s := r.subnetFor(w, req)
+	if s == nil {
+		return ""
+	}
+	key := s.String()
+	if clientSubnet(req) != nil {
+		key += " client" // the response keeps the option
+	}
+	return key
+}
+
+// withSubnet returns req with the client subnet r sends its backends, if
+// any, in place of the one of the client. Queries without EDNS get it.
+func (r *routeEntry) withSubnet(w dns.ResponseWriter, req *dns.Msg) *dns.Msg {
+	s := r.subnetFor(w, req)
+	if s == nil {
+		return req
+	}
+	m := req.Copy()
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(dns.MinMsgSize, false)
+		opt = m.IsEdns0()
+	}
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0SUBNET {
+			options = append(options, o)
+		}
+	}
+	opt.Option = append(options, s)
+	return m
+}
+
+// stripSubnet removes from resp the client subnet sent for a client which
+// did not send one, and the EDNS record added for it if need be.
+func stripSubnet(req, out, resp *dns.Msg) {
+	if clientSubnet(req) != nil || clientSubnet(out) == nil {
+		return
+	}
+	if req.IsEdns0() == nil {
+		extra := resp.Extra[:0]
+		for _, rr := range resp.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		resp.Extra = extra
+		return
+	}
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return
+	}
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0SUBNET {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	tlsAddress = flag.String("tls-address", "",
+		"Address to listen to for DNS over TLS (RFC 7858) of the default view, e.g. :853")
+	httpsAddress = flag.String("https-address", "",
+		"Address to listen to for DNS over HTTPS (RFC 8484) at /dns-query of the default view, e.g. :443")
+	tlsCert = flag.String("tls-cert", "",
+		"PEM certificate chain file of the -tls-address and -https-address listeners")
+	tlsKey = flag.String("tls-key", "",
+		"PEM private key file of -tls-cert")
+)
+
+// netHTTPS is the net of DNS over HTTPS listeners.
+const netHTTPS = "https"
+
+// dohPath is the path of DNS over HTTPS queries, as for upstreams.
+const dohPath = "/dns-query"
+
+// dohMediaType is the content type of DNS over HTTPS queries and responses.
+const dohMediaType = "application/dns-message"
+
+// newEncryptedListeners adds the -tls-address and -https-address listeners
+// serving handler.
+func newEncryptedListeners(handler dns.Handler) error {
+	if *tlsAddress == "" && *httpsAddress == "" {
+		return nil
+	}
+	if *tlsCert == "" || *tlsKey == "" {
+		return fmt.Errorf("-tls-address and -https-address need -tls-cert and -tls-key")
+	}
+	cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+	if err != nil {
+		return fmt.Errorf("-tls-cert: %v", err)
+	}
+	for _, e := range []struct {
+		addr, net string
+		alpn      []string
+	}{
+		{*tlsAddress, "tcp-tls", []string{"dot"}},
+		{*httpsAddress, netHTTPS, []string{"h2", "http/1.1"}},
+	} {
+		if e.addr == "" {
+			continue
+		}
+		config, err := serverTLSConfig(cert)
+		if err != nil {
+			return err
+		}
+		config.NextProtos = e.alpn
+		newListener(e.addr, e.net, handler, false).tlsConfig = config
+	}
+	return nil
+}
+
+// newDoHServer returns an HTTP server answering the DNS over HTTPS queries
+// at /dns-query with handler.
+func newDoHServer(handler dns.Handler) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc(dohPath, func(w http.ResponseWriter, r *http.Request) {
+		serveDoHQuery(w, r, handler)
+	})
+	return &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+}
+
+// serveDoH serves server on the address of l until it fails.
+func serveDoH(l *listener, server *http.Server) error {
+	ln, err := net.Listen("tcp", l.addr)
+	if err != nil {
+		return err
+	}
+	l.started()
+	return server.Serve(tls.NewListener(ln, l.tlsConfig))
+}
+
+// serveDoHQuery answers a DNS over HTTPS query, either a GET with the
+// query in base64url in the dns parameter or a POST of the query.
+func serveDoHQuery(w http.ResponseWriter, r *http.Request, handler dns.Handler) {
+	var b []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		b, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohMediaType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		b, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize+1))
+		if err == nil && len(b) > dns.MaxMsgSize {
+			http.Error(w, "query too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil || len(b) < 12 {
+		http.Error(w, "invalid DNS query", http.StatusBadRequest)
+		return
+	}
+	dw := &dohWriter{local: localAddr(r), remote: remoteAddr(r)}
+	req := new(dns.Msg)
+	dh := dns.Header{
+		Id:      binary.BigEndian.Uint16(b[0:]),
+		Bits:    binary.BigEndian.Uint16(b[2:]),
+		Qdcount: binary.BigEndian.Uint16(b[4:]),
+		Ancount: binary.BigEndian.Uint16(b[6:]),
+		Nscount: binary.BigEndian.Uint16(b[8:]),
+		Arcount: binary.BigEndian.Uint16(b[10:]),
+	}
+	switch action := acceptMsg(dh); action {
+	case dns.MsgIgnore:
+		http.Error(w, "invalid DNS query", http.StatusBadRequest)
+		return
+	case dns.MsgReject, dns.MsgRejectNotImplemented:
+		m := new(dns.Msg)
+		m.Id = dh.Id
+		m.Opcode = int(dh.Bits>>11) & 0xF
+		m.Response = true
+		m.Rcode = dns.RcodeFormatError
+		if action == dns.MsgRejectNotImplemented {
+			m.Rcode = dns.RcodeNotImplemented
+		}
+		dw.WriteMsg(m)
+	default:
+		if err := req.Unpack(b); err != nil {
+			http.Error(w, "invalid DNS query", http.StatusBadRequest)
+			return
+		}
+		if t := req.IsTsig(); t != nil && serverTSIG() != nil {
+			dw.tsigStatus = dns.TsigVerifyWithProvider(b, serverTSIG(), "", false)
+			dw.tsigRequestMAC = t.MAC
+		}
+		handler.ServeDNS(dw, req)
+	}
+	if dw.resp == nil {
+		http.Error(w, "no response", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", dohMediaType)
+	if m := new(dns.Msg); m.Unpack(dw.resp) == nil {
+		if ttl, ok := responseTTL(m); ok {
+			w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(ttl.Seconds())))
+		}
+	}
+	w.Write(dw.resp)
+}
+
+func localAddr(r *http.Request) net.Addr {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		return addr
+	}
+	return &net.TCPAddr{}
+}
+
+func remoteAddr(r *http.Request) net.Addr {
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		return addr
+	}
+	return &net.TCPAddr{}
+}
+
+var errDoHWritten = errors.New("response already written over https")
+
+// dohWriter is the dns.ResponseWriter of a DNS over HTTPS query, keeping
+// its response to send in the HTTP response. Its addresses are TCP ones,
+// so that the query is forwarded as one received over TCP.
+type dohWriter struct {
+	local, remote  net.Addr
+	tsigStatus     error
+	tsigRequestMAC string
+	resp           []byte
+}
+
+func (w *dohWriter) LocalAddr() net.Addr  { return w.local }
+func (w *dohWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *dohWriter) WriteMsg(m *dns.Msg) error {
+	if t := m.IsTsig(); t != nil && serverTSIG() != nil {
+		b, _, err := dns.TsigGenerateWithProvider(m, serverTSIG(), w.tsigRequestMAC, false)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	}
+	b, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func (w *dohWriter) Write(b []byte) (int, error) {
+	if w.resp != nil {
+		return 0, errDoHWritten
+	}
+	w.resp = append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func (w *dohWriter) Close() error        { return nil }
+func (w *dohWriter) TsigStatus() error   { return w.tsigStatus }
+func (w *dohWriter) TsigTimersOnly(bool) {}
+func (w *dohWriter) Hijack()             {}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Prefixes of the backends always queried over DNS over TLS, default port
+// 853, or DNS over HTTPS, default path /dns-query, whatever the transport
+// of the client, e.g. tls://dns.example or https://dns.example/dns-query.
+// A route may list them before plain backends as fallbacks.
+const (
+	tlsPrefix   = "tls://"
+	httpsPrefix = "https://"
+)
+
+// encryptedBackend returns the server of a tls:// backend and the URL of
+// an https:// backend, with their defaults, and whether addr is a valid
+// one of them.
+func encryptedBackend(addr string) (server string, u *url.URL, ok bool) {
+	switch {
+	case strings.HasPrefix(addr, tlsPrefix):
+		server = strings.TrimPrefix(addr, tlsPrefix)
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "853")
+		}
+		host, port, err := net.SplitHostPort(server)
+		return server, nil, err == nil && validHost(host) && validPort(port)
+	case strings.HasPrefix(addr, httpsPrefix):
+		u, err := url.Parse(addr)
+		if err != nil || !validHost(u.Hostname()) || u.Port() != "" && !validPort(u.Port()) || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+			return "", nil, false
+		}
+		if u.Path == "" {
+			u.Path = dohPath
+		}
+		return "", u, true
+	}
+	return "", nil, false
+}
+
+func isEncryptedBackend(addr string) bool {
+	return strings.HasPrefix(addr, tlsPrefix) || strings.HasPrefix(addr, httpsPrefix)
+}
+
+// mixesTransports returns whether backends has both encrypted and plain
+// backends.
+func mixesTransports(backends []string) bool {
+	var encrypted, plain bool
+	for _, addr := range backends {
+		if isEncryptedBackend(addr) {
+			encrypted = true
+		} else {
+			plain = true
+		}
+	}
+	return encrypted && plain
+}
+
+// validHost returns whether host is a name or an IP, without the characters
+// of a list of backends or a URL.
+func validHost(host string) bool {
+	if host == "" {
+		return false
+	}
+	for _, c := range host {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == ':') {
+			return false
+		}
+	}
+	return true
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n < 65536
+}
+
+// exchangeEncrypted sends req to a tls:// or https:// backend, signed with
+// key if not nil, which DNS over HTTPS does not support.
+func exchangeEncrypted(ctx context.Context, addr string, key *tsigKey, req *dns.Msg) (*dns.Msg, error) {
+	if err := pace(ctx, addr); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	resp, err := queryEncrypted(ctx, addr, key, req)
+	observeExchange(addr, time.Since(start), err)
+	return resp, err
+}
+
+// queryEncrypted is exchangeEncrypted without pacing and health, for the
+// probes.
+func queryEncrypted(ctx context.Context, addr string, key *tsigKey, req *dns.Msg) (*dns.Msg, error) {
+	server, u, _ := encryptedBackend(addr)
+	if u == nil {
+		resp, _, err := queryTLS(ctx, server, key, req)
+		return resp, err
+	}
+	if key != nil {
+		return nil, errHTTPSTSIG
+	}
+	return queryHTTPS(ctx, u, req)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var entropyAuditWindow = flag.Duration("entropy-audit", 0,
+	"Sample the IDs and source ports of the UDP queries to backends over windows of this duration and log the entropy achieved, "+
+		"to verify spoofing resistance, 0 for off")
+
+// entropySequential is the distance under which an ID or port close to the
+// previous one counts as sequential, as allocated by a counter.
+const entropySequential = 16
+
+// entropyLow is the share of the most entropy possible for a sample below
+// which the achieved entropy is reported low.
+const entropyLow = 0.9
+
+// entropySample is the IDs and source ports sampled over a window.
+type entropySample struct {
+	ids, ports                     map[uint16]int
+	queries, withPort              int
+	lastID, lastPort               uint16
+	sequentialIDs, sequentialPorts int
+}
+
+func newEntropySample() *entropySample {
+	return &entropySample{ids: make(map[uint16]int), ports: make(map[uint16]int)}
+}
+
+var (
+	entropyMu     sync.Mutex
+	entropyAudit  *entropySample // nil without -entropy-audit
+	entropyGauges = make(map[string]float64)
+)
+
+// startEntropyAudit reports the entropy of each -entropy-audit window, in
+// background.
+func startEntropyAudit() error {
+	if *entropyAuditWindow == 0 {
+		return nil
+	}
+	if *entropyAuditWindow < 0 {
+		return fmt.Errorf("invalid -entropy-audit %v, must be positive", *entropyAuditWindow)
+	}
+	entropyAudit = newEntropySample()
+	go func() {
+		for range time.Tick(*entropyAuditWindow) {
+			entropyMu.Lock()
+			s := entropyAudit
+			entropyAudit = newEntropySample()
+			entropyMu.Unlock()
+			s.report()
+		}
+	}()
+	return nil
+}
+
+// auditing returns whether the queries to backends are sampled.
+func auditing() bool {
+	return *entropyAuditWindow > 0
+}
+
+// auditQuery samples the ID of a query to a backend and, over UDP, the
+// source port of conn.
+func auditQuery(conn *dns.Conn, id uint16) {
+	if !auditing() {
+		return
+	}
+	entropyMu.Lock()
+	defer entropyMu.Unlock()
+	s := entropyAudit
+	if s == nil {
+		return
+	}
+	if s.queries > 0 && distance(id, s.lastID) <= entropySequential {
+		s.sequentialIDs++
+	}
+	s.ids[id]++
+	s.lastID = id
+	s.queries++
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return
+	}
+	port := uint16(addr.Port)
+	if s.withPort > 0 && distance(port, s.lastPort) <= entropySequential {
+		s.sequentialPorts++
+	}
+	s.ports[port]++
+	s.lastPort = port
+	s.withPort++
+}
+
+func distance(a, b uint16) uint16 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// shannon returns the Shannon entropy in bits of the values counted, of n
+// in total.
+func shannon(counts map[uint16]int, n int) float64 {
+	var e float64
+	for _, c := range counts {
+		p := float64(c) / float64(n)
+		e -= p * math.Log2(p)
+	}
+	return e
+}
+
+// report logs the entropy of the IDs and source ports of the window, which
+// is low if far from the most possible: 16 bits, or fewer for a small
+// sample, log2 of its size. Queries with IDs or ports close to the previous
+// one are sequential, predictable whatever the entropy. The last window is
+// kept as the entropy.id_bits and entropy.port_bits gauges.
+func (s *entropySample) report() {
+	if s.queries == 0 {
+		logf("entropy audit: no UDP queries to backends in %v", *entropyAuditWindow)
+		return
+	}
+	describe := func(counts map[uint16]int, n, sequential int) (float64, string) {
+		bits := shannon(counts, n)
+		most := math.Min(16, math.Log2(float64(n)))
+		low := ""
+		if n > 1 && bits < entropyLow*most {
+			low = ", low"
+		}
+		return bits, fmt.Sprintf("%.1f bits of at most %.1f (%d distinct, %.1f%% sequential%s)",
+			bits, most, len(counts), 100*float64(sequential)/float64(n), low)
+	}
+	idBits, ids := describe(s.ids, s.queries, s.sequentialIDs)
+	ports := "none"
+	var portBits float64
+	if s.withPort > 0 {
+		portBits, ports = describe(s.ports, s.withPort, s.sequentialPorts)
+	}
+	logf("entropy audit: %d UDP queries to backends in %v, IDs %s, source ports %s", s.queries, *entropyAuditWindow, ids, ports)
+	entropyMu.Lock()
+	entropyGauges = map[string]float64{"entropy.id_bits": idBits, "entropy.port_bits": portBits}
+	entropyMu.Unlock()
+}
+
+// auditGauges returns the entropy of the last -entropy-audit window.
+func auditGauges() map[string]float64 {
+	entropyMu.Lock()
+	defer entropyMu.Unlock()
+	return entropyGauges
+}
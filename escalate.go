@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	routeEscalations flagStringList
+	routeTransports  flagStringList
+)
+
+func init() {
+	flag.Var(&routeEscalations, "route-escalate", "Transports tried in order for each backend of a route when the previous "+
+		"fails or UDP is truncated, tls on port 853 and https at /dns-query of the backend host ([view/]domain=udp,tcp,tls,https)")
+	flag.Var(&routeTransports, "route-transport", "Transport of the queries to the backends of a route whatever the one of the client, "+
+		"e.g. tcp for TCP-only backends ([view/]domain=udp|tcp)")
+}
+
+// Upstream transports, from the least to the most likely to get through
+// restrictive networks.
+const (
+	transportUDP   = "udp"
+	transportTCP   = "tcp"
+	transportTLS   = "tls"   // DNS over TLS, RFC 7858
+	transportHTTPS = "https" // DNS over HTTPS, RFC 8484
+)
+
+var (
+	errTruncated = errors.New("truncated response")
+	errHTTPSTSIG = errors.New("TSIG not supported over https")
+)
+
+// parseEscalation parses a comma separated list of transports.
+func parseEscalation(s string) ([]string, error) {
+	var transports []string
+	seen := make(map[string]bool)
+	for _, t := range strings.Split(s, ",") {
+		switch t {
+		case transportUDP, transportTCP, transportTLS, transportHTTPS:
+		default:
+			return nil, fmt.Errorf("unknown transport %v, must be udp, tcp, tls or https", t)
+		}
+		if seen[t] {
+			return nil, fmt.Errorf("duplicate transport %v", t)
+		}
+		seen[t] = true
+		transports = append(transports, t)
+	}
+	return transports, nil
+}
+
+// parseRouteTransport parses the transport of -route-transport for r, which
+// cannot also escalate.
+func parseRouteTransport(r *routeEntry, s string) (string, error) {
+	if s != transportUDP && s != transportTCP {
+		return "", fmt.Errorf("unknown transport %v, must be udp or tcp", s)
+	}
+	if r.escalate != nil {
+		return "", fmt.Errorf("route also has -route-escalate")
+	}
+	return s, nil
+}
+
+// upstreamTransport returns the transport of the queries of r to its
+// backends for a client query over transport.
+func (r *routeEntry) upstreamTransport(transport string) string {
+	if r.transport != "" {
+		return r.transport
+	}
+	return transport
+}
+
+// escalateExchange sends req to addr over transports in order until one
+// answers, the next one when a transport fails or UDP is truncated.
+func (r *routeEntry) escalateExchange(ctx context.Context, transports []string, addr string, req *dns.Msg) (*dns.Msg, error) {
+	var err error
+	for i, t := range transports {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		var resp *dns.Msg
+		switch t {
+		case transportTLS:
+			resp, err = exchangeTLS(ctx, addr, r.tsig, req)
+		case transportHTTPS:
+			if r.tsig != nil {
+				resp, err = nil, errHTTPSTSIG
+				break
+			}
+			resp, err = exchangeHTTPS(ctx, addr, req)
+		default:
+			resp, err = exchange(ctx, addr, r.tsig, t, req)
+		}
+		if err == nil && resp.Truncated && i < len(transports)-1 {
+			err = errTruncated
+		}
+		if err == nil {
+			return resp, nil
+		}
+		err = fmt.Errorf("%v: %v", t, err)
+	}
+	return nil, err
+}
+
+// withPort returns addr with its port replaced.
+func withPort(addr, port string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// exchangeTLS sends req to the host of addr over DNS over TLS.
+func exchangeTLS(ctx context.Context, addr string, key *tsigKey, req *dns.Msg) (*dns.Msg, error) {
+	if err := pace(ctx, addr); err != nil {
+		return nil, err
+	}
+	resp, rtt, err := queryTLS(ctx, withPort(addr, "853"), key, req)
+	observeExchange(addr, rtt, err)
+	return resp, err
+}
+
+// queryTLS sends req to server, host:port, over DNS over TLS.
+func queryTLS(ctx context.Context, server string, key *tsigKey, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	host, port, _ := net.SplitHostPort(server)
+	c := &dns.Client{Net: "tcp-tls", TLSConfig: clientTLSConfig(host, port)}
+	if key != nil {
+		c.TsigProvider = tsigProvider{}
+		req = key.sign(req)
+	}
+	resp, rtt, err := c.ExchangeContext(ctx, req, server)
+	if err != nil {
+		return nil, rtt, err
+	}
+	stripTSIG(resp)
+	return resp, rtt, nil
+}
+
+var (
+	dohClientsMu sync.Mutex
+	dohClients   = make(map[string]*http.Client) // by host:port, to reuse connections
+)
+
+func dohClient(server string) *http.Client {
+	dohClientsMu.Lock()
+	defer dohClientsMu.Unlock()
+	c, ok := dohClients[server]
+	if !ok {
+		host, port, _ := net.SplitHostPort(server)
+		c = &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   clientTLSConfig(host, port),
+			ForceAttemptHTTP2: true,
+			IdleConnTimeout:   time.Minute,
+		}}
+		dohClients[server] = c
+	}
+	return c
+}
+
+// exchangeHTTPS sends req to the host of addr over DNS over HTTPS at
+// /dns-query.
+func exchangeHTTPS(ctx context.Context, addr string, req *dns.Msg) (*dns.Msg, error) {
+	if err := pace(ctx, addr); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	resp, err := queryHTTPS(ctx, dohURL(addr), req)
+	observeExchange(addr, time.Since(start), err)
+	return resp, err
+}
+
+// dohURL returns the DNS over HTTPS URL of the host of addr.
+func dohURL(addr string) *url.URL {
+	return &url.URL{Scheme: "https", Host: withPort(addr, "443"), Path: dohPath}
+}
+
+// queryHTTPS sends req to u over DNS over HTTPS, with a POST of its wire
+// format, passed as is but for the ID, and returns the response as is,
+// whatever its records, EDNS options and flags.
+func queryHTTPS(ctx context.Context, u *url.URL, req *dns.Msg) (*dns.Msg, error) {
+	httpReq, err := dohRequest(ctx, u, req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := doh(dohClient(withPort(u.Host, "443")), httpReq)
+	if err != nil {
+		return nil, err
+	}
+	resp.Id = req.Id
+	return resp, nil
+}
+
+// dohRequest returns the POST of req to u, with an ID of 0 as recommended
+// by RFC 8484 for HTTP caches.
+func dohRequest(ctx context.Context, u *url.URL, req *dns.Msg) (*http.Request, error) {
+	b, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+	b[0], b[1] = 0, 0
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", dohMediaType)
+	httpReq.Header.Set("Accept", dohMediaType)
+	return httpReq, nil
+}
+
+func doh(c *http.Client, req *http.Request) (*dns.Msg, error) {
+	httpResp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %v", httpResp.Status)
+	}
+	if ct := httpResp.Header.Get("Content-Type"); ct != dohMediaType {
+		return nil, fmt.Errorf("content type %q, not %v", ct, dohMediaType)
+	}
+	b, err := io.ReadAll(io.LimitReader(httpResp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	resp := new(dns.Msg)
+	if err := resp.Unpack(b); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
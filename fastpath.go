@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var fastPath = flag.Bool("fast-path", false,
+	"Relay backend responses as received, without unpacking them, unless they must be truncated. "+
+		"Not used for routes with TSIG and while recording")
+
+// proxyFast is proxy relaying the wire response of the backends. Queries
+// are forwarded with the client ID which the response already has, only a
+// UDP response too large for the client is unpacked to be truncated.
+func (v *view) proxyFast(ctx context.Context, r *routeEntry, w dns.ResponseWriter, req *dns.Msg, transport string, out *dns.Msg) {
+	b, upstream, err := r.exchangeRaw(ctx, transport, out)
+	if d := v.defaultFor(normalizeName(req.Question[0].Name)); err != nil && r.fallback && d != nil && r != d {
+		attempts := err.attempts
+		b, upstream, err = d.exchangeRaw(ctx, transport, out)
+		if err != nil {
+			err.attempts += attempts
+		}
+	}
+	if err != nil {
+		v.proxyFailed(r, w, req, err)
+		return
+	}
+	filterADWire(req, b, upstream)
+	if r.delay > 0 {
+		time.Sleep(r.delay)
+	}
+	if transport == "udp" && len(b) > udpSize(req) {
+		resp := new(dns.Msg)
+		if err := resp.Unpack(b); err != nil {
+			logQueryError(w, req, &exchangeError{transport: transport, attempts: 1, err: err})
+			v.fail(w, req)
+			return
+		}
+		resp.Truncate(udpSize(req))
+		w.WriteMsg(resp)
+		return
+	}
+	w.Write(b)
+}
+
+// exchangeRaw is exchange returning the wire response.
+func (r *routeEntry) exchangeRaw(ctx context.Context, transport string, req *dns.Msg) ([]byte, string, *exchangeError) {
+	transport = r.upstreamTransport(transport)
+	e := &exchangeError{transport: transport}
+	b, err := req.Pack()
+	if err != nil {
+		e.err = err
+		return nil, "", e
+	}
+	var servfail []byte
+	var servfailFrom string
+	budget := r.retries
+	budget.query()
+	for _, i := range r.backendOrder() {
+		if err := ctx.Err(); err != nil {
+			e.err = err
+			break
+		}
+		if e.attempts > 0 && !budget.retry() {
+			break
+		}
+		e.upstream = r.backends[i]
+		e.attempts++
+		resp, err := exchangeRaw(ctx, r.backends[i], transport, b)
+		if err == nil && retryServfail(r.backends[i], int(resp[3]&0xf)) {
+			if len(r.backends) == 1 && ctx.Err() == nil && budget.retry() {
+				e.attempts++
+				if again, err := exchangeRaw(ctx, r.backends[i], transport, b); err == nil {
+					resp = again
+				}
+			}
+			if int(resp[3]&0xf) == dns.RcodeServerFailure {
+				servfail, servfailFrom = resp, r.backends[i]
+				e.err = errServfail
+				continue
+			}
+		}
+		if err == nil {
+			r.countPool(false)
+			return resp, r.backends[i], nil
+		}
+		e.err = err
+	}
+	r.countPool(servfail == nil)
+	if servfail != nil {
+		return servfail, servfailFrom, nil
+	}
+	return nil, "", e
+}
+
+// exchangeRaw sends the wire query req to addr and returns the wire
+// response, only checking its header.
+func exchangeRaw(ctx context.Context, addr, transport string, req []byte) ([]byte, error) {
+	if isEncryptedBackend(addr) {
+		m := new(dns.Msg)
+		if err := m.Unpack(req); err != nil {
+			return nil, err
+		}
+		resp, err := exchangeEncrypted(ctx, addr, nil, m)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Pack()
+	}
+	if err := pace(ctx, addr); err != nil {
+		return nil, err
+	}
+	c, dial := upstreamClient(addr, transport)
+	start := time.Now()
+	var resp []byte
+	var err error
+	if reuseSockets(addr, transport) {
+		var conn *dns.Conn
+		if conn, err = getSocket(ctx, c, dial); err == nil {
+			auditQuery(conn, binary.BigEndian.Uint16(req))
+			if resp, err = exchangeWire(ctx, c, conn, req); err == nil {
+				putSocket(addr, conn)
+			} else {
+				conn.Close()
+			}
+		}
+	} else {
+		var conn *dns.Conn
+		if conn, err = c.DialContext(ctx, dial); err == nil {
+			if transport == transportUDP {
+				auditQuery(conn, binary.BigEndian.Uint16(req))
+			}
+			resp, err = exchangeWire(ctx, c, conn, req)
+			conn.Close()
+		}
+	}
+	observeExchange(addr, time.Since(start), err)
+	return resp, err
+}
+
+// exchangeWire sends the wire query req on conn and returns the wire
+// response.
+func exchangeWire(ctx context.Context, c *dns.Client, conn *dns.Conn, req []byte) ([]byte, error) {
+	deadline := time.Now().Add(2 * time.Second)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		resp := buf[:n]
+		if n < 12 {
+			return nil, fmt.Errorf("short response of %d bytes", n)
+		}
+		// Same ID and QR set, else a stray UDP response: keep reading,
+		// as dns.Client does.
+		if resp[0] == req[0] && resp[1] == req[1] && resp[2]&0x80 != 0 {
+			return resp, nil
+		}
+		if c.Net != "udp" {
+			return nil, dns.ErrId
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var routeFaults flagStringList
+
+func init() {
+	flag.Var(&routeFaults, "test-fault", "TESTING ONLY: inject faults in a route "+
+		"([view/]domain=[latency=duration][,drop=probability][,servfail=probability])")
+}
+
+// faultInjection makes a route misbehave to test client resolver retries.
+type faultInjection struct {
+	latency  time.Duration
+	drop     float64 // probability to not answer
+	servfail float64 // probability to answer SERVFAIL
+}
+
+// parseFault parses latency=duration,drop=probability,servfail=probability.
+func parseFault(s string) (*faultInjection, error) {
+	f := &faultInjection{}
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid fault %q, must be key=value", kv)
+		}
+		var err error
+		switch parts[0] {
+		case "latency":
+			f.latency, err = time.ParseDuration(parts[1])
+		case "drop":
+			f.drop, err = parseProbability(parts[1])
+		case "servfail":
+			f.servfail, err = parseProbability(parts[1])
+		default:
+			return nil, fmt.Errorf("unknown fault %q", parts[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid fault %v: %v", parts[0], err)
+		}
+	}
+	return f, nil
+}
+
+func parseProbability(s string) (float64, error) {
+	p, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if p < 0 || p > 1 {
+		return 0, fmt.Errorf("probability %v not in [0, 1]", p)
+	}
+	return p, nil
+}
+
+// inject sleeps for the configured latency and returns whether the query
+// should be dropped or answered with SERVFAIL.
+func (f *faultInjection) inject() (drop, servfail bool) {
+	if f.latency > 0 {
+		time.Sleep(f.latency)
+	}
+	if rand.Float64() < f.drop {
+		return true, false
+	}
+	return false, rand.Float64() < f.servfail
+}
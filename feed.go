@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	feedLists    flagStringList
+	feedPolicies = flag.String("feed-policy", "",
+		"Action per threat feed category (category=block|log,...), categories without policy are blocked")
+	feedRefresh = flag.Duration("feed-refresh", time.Hour, "Interval between threat feed refreshes")
+)
+
+func init() {
+	flag.Var(&feedLists, "feed", "Threat feed of a category: RPZ zone or HTTPS CSV/JSON list of domains "+
+		"(category=axfr://host:port/zone or category=https://...)")
+}
+
+// Feed policy actions.
+const (
+	feedBlock = "block" // answer with the action of the entry
+	feedLog   = "log"   // log and forward
+)
+
+// Actions of feed entries, given by the CNAME target of RPZ records,
+// HTTP lists are all NXDOMAIN.
+const (
+	feedNXDomain = "nxdomain" // CNAME .
+	feedNoData   = "nodata"   // CNAME *.
+	feedPassthru = "passthru" // CNAME rpz-passthru., allowed
+	feedDrop     = "drop"     // CNAME rpz-drop., not answered
+)
+
+// rpzActions are the feed entry actions by RPZ CNAME target.
+var rpzActions = map[string]string{
+	".":             feedNXDomain,
+	"*.":            feedNoData,
+	"rpz-passthru.": feedPassthru,
+	"rpz-drop.":     feedDrop,
+}
+
+// rpzTriggers are the labels of RPZ triggers other than QNAME, which
+// come last in owner names relative to the zone.
+var rpzTriggers = map[string]bool{
+	"rpz-ip":        true,
+	"rpz-nsdname":   true,
+	"rpz-nsip":      true,
+	"rpz-client-ip": true,
+}
+
+// feedEntry is a feed domain: its category and action.
+type feedEntry struct {
+	category string
+	action   string
+}
+
+// feed is a threat intelligence source of domains tagged with a category.
+type feed struct {
+	category string
+	source   *url.URL
+}
+
+// feedEntries are the domains of all feeds with their category.
+type feedEntries struct {
+	exact map[string]feedEntry // name only
+	tree  map[string]feedEntry // name and subdomains
+	sub   map[string]feedEntry // subdomains only, RPZ wildcards
+}
+
+func newFeedEntries() *feedEntries {
+	return &feedEntries{
+		exact: make(map[string]feedEntry),
+		tree:  make(map[string]feedEntry),
+		sub:   make(map[string]feedEntry),
+	}
+}
+
+// mergeFeedEntries adds the entries of src to dst, a passthru entry of a
+// feed winning over the other feeds.
+func mergeFeedEntries(dst, src map[string]feedEntry) {
+	for name, e := range src {
+		if prev, ok := dst[name]; ok && prev.action == feedPassthru {
+			continue
+		}
+		dst[name] = e
+	}
+}
+
+var (
+	feeds       []*feed
+	feedPolicy  map[string]string // by category
+	feedMu      sync.RWMutex
+	feedDomains = newFeedEntries()
+	feedLoaded  = make(map[*feed]*feedEntries) // last successful load
+)
+
+// parseFeeds parses the -feed and -feed-policy flags.
+func parseFeeds() error {
+	for _, feedList := range feedLists {
+		s := strings.SplitN(feedList, "=", 2)
+		if len(s) != 2 || len(s[0]) == 0 || len(s[1]) == 0 {
+			return fmt.Errorf("invalid -feed, must be category=url")
+		}
+		u, err := url.Parse(s[1])
+		if err != nil {
+			return fmt.Errorf("invalid -feed url: %v", err)
+		}
+		switch u.Scheme {
+		case "axfr":
+			if u.Host == "" || strings.Trim(u.Path, "/") == "" {
+				return fmt.Errorf("invalid -feed %v, must be axfr://host:port/zone", s[1])
+			}
+		case "http", "https":
+		default:
+			return fmt.Errorf("invalid -feed %v, scheme must be axfr or https", s[1])
+		}
+		feeds = append(feeds, &feed{category: s[0], source: u})
+	}
+	feedPolicy = make(map[string]string)
+	if *feedPolicies == "" {
+		return nil
+	}
+	for _, policy := range strings.Split(*feedPolicies, ",") {
+		s := strings.SplitN(policy, "=", 2)
+		if len(s) != 2 || s[1] != feedBlock && s[1] != feedLog {
+			return fmt.Errorf("invalid -feed-policy %q, must be category=block|log", policy)
+		}
+		feedPolicy[s[0]] = s[1]
+	}
+	return nil
+}
+
+// refreshFeeds loads all feeds now then every -feed-refresh, in background.
+func refreshFeeds() {
+	if len(feeds) == 0 {
+		return
+	}
+	loadFeeds()
+	go func() {
+		for range time.Tick(*feedRefresh) {
+			loadFeeds()
+		}
+	}()
+}
+
+// loadFeeds loads every feed and swaps the domains, a feed failing to load
+// keeps its previous entries.
+func loadFeeds() {
+	merged := newFeedEntries()
+	for _, f := range feeds {
+		entries, err := f.load()
+		if err != nil {
+			logf("feed: %v %v: %v", f.category, f.source, err)
+			entries = feedLoaded[f]
+			if entries == nil {
+				continue
+			}
+		}
+		feedLoaded[f] = entries
+		mergeFeedEntries(merged.exact, entries.exact)
+		mergeFeedEntries(merged.tree, entries.tree)
+		mergeFeedEntries(merged.sub, entries.sub)
+	}
+	feedMu.Lock()
+	feedDomains = merged
+	feedMu.Unlock()
+}
+
+func (f *feed) load() (*feedEntries, error) {
+	if f.source.Scheme == "axfr" {
+		return f.loadRPZ()
+	}
+	return f.loadHTTP()
+}
+
+// loadRPZ transfers a response policy zone, using its QNAME triggers
+// with the NXDOMAIN, NODATA, PASSTHRU and DROP actions. Other triggers
+// and local data are not supported and skipped.
+func (f *feed) loadRPZ() (*feedEntries, error) {
+	zone := dns.Fqdn(strings.ToLower(strings.Trim(f.source.Path, "/")))
+	m := new(dns.Msg)
+	m.SetAxfr(zone)
+	ch, err := new(dns.Transfer).In(m, f.source.Host)
+	if err != nil {
+		return nil, err
+	}
+	entries := newFeedEntries()
+	for env := range ch {
+		if env.Error != nil {
+			return nil, env.Error
+		}
+		for _, rr := range env.RR {
+			name := strings.ToLower(rr.Header().Name)
+			if name == zone || !strings.HasSuffix(name, "."+zone) {
+				continue // apex SOA/NS
+			}
+			name = strings.TrimSuffix(name, zone)
+			labels := dns.SplitDomainName(name)
+			if rpzTriggers[labels[len(labels)-1]] {
+				continue
+			}
+			cname, ok := rr.(*dns.CNAME)
+			if !ok {
+				continue
+			}
+			action, ok := rpzActions[strings.ToLower(cname.Target)]
+			if !ok {
+				continue
+			}
+			e := feedEntry{category: f.category, action: action}
+			if strings.HasPrefix(name, "*.") {
+				entries.sub[name[2:]] = e
+				continue
+			}
+			entries.exact[name] = e
+		}
+	}
+	return entries, nil
+}
+
+// loadHTTP fetches a list of domains blocking the domains and their
+// subdomains: JSON array of names or of {"domain", "category"} objects, or
+// CSV of domain[,category] lines.
+func (f *feed) loadHTTP() (*feedEntries, error) {
+	client := tlsPolicy.httpClient(time.Minute)
+	defer client.CloseIdleConnections()
+	resp, err := client.Get(f.source.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %v", resp.Status)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	entries := newFeedEntries()
+	add := func(domain, category string) {
+		domain = strings.TrimSpace(domain)
+		if domain == "" {
+			return
+		}
+		if category = strings.TrimSpace(category); category == "" {
+			category = f.category
+		}
+		entries.tree[routeDomain(strings.TrimPrefix(domain, "."))] = feedEntry{category: category, action: feedNXDomain}
+	}
+	if trimmed := strings.TrimSpace(string(body)); strings.HasPrefix(trimmed, "[") {
+		var items []json.RawMessage
+		if err := json.Unmarshal(body, &items); err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			var name string
+			if err := json.Unmarshal(item, &name); err == nil {
+				add(name, "")
+				continue
+			}
+			var obj struct {
+				Domain   string `json:"domain"`
+				Category string `json:"category"`
+			}
+			if err := json.Unmarshal(item, &obj); err != nil {
+				return nil, err
+			}
+			add(obj.Domain, obj.Category)
+		}
+		return entries, nil
+	}
+	scanner := bufio.NewScanner(strings.NewReader(string(body)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		s := strings.SplitN(line, ",", 3)
+		category := ""
+		if len(s) > 1 {
+			category = s[1]
+		}
+		add(s[0], category)
+	}
+	return entries, scanner.Err()
+}
+
+// lookup returns the most specific feed entry of a name, ok false if not
+// in any feed.
+func (e *feedEntries) lookup(name string) (feedEntry, bool) {
+	if c, ok := e.exact[name]; ok {
+		return c, true
+	}
+	for i, suffix := 0, name; ; i++ {
+		if c, ok := e.tree[suffix]; ok {
+			return c, true
+		}
+		if c, ok := e.sub[suffix]; ok && i > 0 {
+			return c, true
+		}
+		dot := strings.IndexByte(suffix, '.')
+		if dot < 0 || dot == len(suffix)-1 {
+			return feedEntry{}, false
+		}
+		suffix = suffix[dot+1:]
+	}
+}
+
+// feedAction returns the feed category of a name and the action for it:
+// feedLog if the policy of the category only logs, otherwise the action
+// of the entry. It returns "" if the name is not in any feed.
+func feedAction(name string) (string, string) {
+	feedMu.RLock()
+	e, ok := feedDomains.lookup(normalizeName(name))
+	feedMu.RUnlock()
+	if !ok {
+		return "", ""
+	}
+	if feedPolicy[e.category] == feedLog && e.action != feedPassthru {
+		return e.category, feedLog
+	}
+	return e.category, e.action
+}
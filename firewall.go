@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	ruleLists flagStringList
+	rulesFile = flag.String("rules-file", "",
+		"File of firewall rules, one per line, evaluated after the -rule flags")
+)
+
+func init() {
+	flag.Var(&ruleLists, "rule", "Firewall rule evaluated in order before forwarding "+
+		"([name=pattern] [type=qtype,...] [client=cidr,...] [time=hh:mm-hh:mm] [priority=N] action=allow|deny|log|rcode:RCODE|route:host:port,...)")
+}
+
+// Rule actions.
+const (
+	actionAllow = "allow" // forward as usual
+	actionDeny  = "deny"  // answer REFUSED
+	actionLog   = "log"   // log and continue evaluating
+	actionRcode = "rcode" // answer with an rcode
+	actionRoute = "route" // forward to specific backends
+)
+
+// rule matches queries (all conditions must match, absent ones always do)
+// and decides what to do with them.
+type rule struct {
+	text    string // as configured, for logging
+	name    *regexp.Regexp
+	qtypes  map[uint16]bool
+	clients []*net.IPNet
+	times   *timeRange
+
+	priority int  // higher is evaluated first, same priority in order
+	disabled bool // from the console
+
+	action string
+	rcode  int
+	route  *routeEntry
+}
+
+var (
+	rulesMu sync.RWMutex // rules can be changed from the console
+	rules   []*rule
+)
+
+// parseRule parses a rule: space separated key=value conditions and action.
+func parseRule(s string) (*rule, error) {
+	r := &rule{text: s}
+	for _, field := range strings.Fields(s) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("invalid rule %q: %q must be key=value", s, field)
+		}
+		var err error
+		switch kv[0] {
+		case "name":
+			r.name, err = namePattern(kv[1])
+		case "type":
+			r.qtypes, err = parseQtypes(kv[1])
+		case "client":
+			r.clients, err = parseCIDRs(kv[1])
+		case "time":
+			var t timeRange
+			t, err = parseTimeRange(kv[1])
+			r.times = &t
+		case "priority":
+			r.priority, err = strconv.Atoi(kv[1])
+		case "action":
+			err = r.parseAction(kv[1])
+		default:
+			err = fmt.Errorf("unknown key %q", kv[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %v", s, err)
+		}
+	}
+	if r.action == "" {
+		return nil, fmt.Errorf("invalid rule %q: no action", s)
+	}
+	return r, nil
+}
+
+func (r *rule) parseAction(s string) error {
+	kv := strings.SplitN(s, ":", 2)
+	r.action = kv[0]
+	switch r.action {
+	case actionAllow, actionDeny, actionLog:
+		if len(kv) == 2 {
+			return fmt.Errorf("action %v takes no argument", r.action)
+		}
+	case actionRcode:
+		if len(kv) != 2 {
+			return fmt.Errorf("action rcode needs an rcode, e.g. rcode:NXDOMAIN")
+		}
+		rcode, ok := dns.StringToRcode[strings.ToUpper(kv[1])]
+		if !ok {
+			return fmt.Errorf("unknown rcode %v", kv[1])
+		}
+		r.rcode = rcode
+	case actionRoute:
+		if len(kv) != 2 {
+			return fmt.Errorf("action route needs backends, e.g. route:host:port")
+		}
+		_, route, err := parseRoute(".=" + kv[1])
+		if err != nil {
+			return err
+		}
+		r.route = route
+	default:
+		return fmt.Errorf("unknown action %v", r.action)
+	}
+	return nil
+}
+
+// namePattern compiles a name pattern where * matches any characters.
+// A pattern starting with a dot matches the name and its subdomains.
+func namePattern(s string) (*regexp.Regexp, error) {
+	s = routeDomain(s)
+	prefix := "^"
+	if strings.HasPrefix(s, ".") {
+		prefix = `^(.*\.)?`
+		s = s[1:]
+	}
+	quoted := strings.ReplaceAll(regexp.QuoteMeta(s), `\*`, ".*")
+	return regexp.Compile(prefix + quoted + "$")
+}
+
+func parseQtypes(s string) (map[uint16]bool, error) {
+	qtypes := make(map[uint16]bool)
+	for _, name := range strings.Split(s, ",") {
+		qtype, ok := dns.StringToType[strings.ToUpper(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown type %v", name)
+		}
+		qtypes[qtype] = true
+	}
+	return qtypes, nil
+}
+
+// parseCIDRs parses a comma separated list of CIDRs, a bare IP is a /32 or
+// /128. The zone of a link-local IP, e.g. fe80::1%eth0, is ignored.
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	clients, err := parseClientNets(s)
+	if err != nil {
+		return nil, err
+	}
+	nets := make([]*net.IPNet, len(clients))
+	for i, c := range clients {
+		nets[i] = c.IPNet
+	}
+	return nets, nil
+}
+
+// clientNet is a network of clients, with the zone of a link-local IP if
+// given, e.g. fe80::1%eth0, to only match it on that interface.
+type clientNet struct {
+	*net.IPNet
+	zone string
+}
+
+// parseClientNets parses a comma separated list of CIDRs, a bare IP is a
+// /32 or /128 and may have a zone.
+func parseClientNets(s string) ([]clientNet, error) {
+	var nets []clientNet
+	for _, cidr := range strings.Split(s, ",") {
+		if !strings.Contains(cidr, "/") {
+			host, zone := splitZone(cidr)
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %v", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, clientNet{IPNet: &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, zone: zone})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, clientNet{IPNet: ipnet})
+	}
+	return nets, nil
+}
+
+// containsAddr returns whether a client address is in one of nets, on the
+// interface of its zone if any.
+func containsAddr(nets []clientNet, addr net.Addr) bool {
+	ip := addrIP(addr)
+	for _, n := range nets {
+		if n.Contains(ip) && (n.zone == "" || n.zone == addrZone(addr)) {
+			return true
+		}
+	}
+	return false
+}
+
+// timeRange is a daily time window, which may wrap around midnight.
+type timeRange struct {
+	from, to time.Duration // since midnight, local time
+}
+
+func (t timeRange) contains(now time.Time) bool {
+	y, m, d := now.Date()
+	since := now.Sub(time.Date(y, m, d, 0, 0, 0, 0, now.Location()))
+	if t.from <= t.to {
+		return since >= t.from && since < t.to
+	}
+	return since >= t.from || since < t.to
+}
+
+// parseTimeRange parses hh:mm-hh:mm.
+func parseTimeRange(s string) (timeRange, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return timeRange{}, fmt.Errorf("invalid time range %v, must be hh:mm-hh:mm", s)
+	}
+	var bounds [2]time.Duration
+	for i, part := range parts {
+		t, err := time.Parse("15:04", part)
+		if err != nil {
+			return timeRange{}, fmt.Errorf("invalid time %v, must be hh:mm", part)
+		}
+		bounds[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return timeRange{bounds[0], bounds[1]}, nil
+}
+
+// loadRules parses the -rule flags then the -rules-file.
+func loadRules() error {
+	texts := append([]string(nil), ruleLists...)
+	if *rulesFile != "" {
+		f, err := os.Open(*rulesFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			texts = append(texts, line)
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	}
+	for _, text := range texts {
+		r, err := parseRule(text)
+		if err != nil {
+			return err
+		}
+		rules = append(rules, r)
+	}
+	sortRules()
+	return nil
+}
+
+// sortRules orders the rules by descending priority, then configuration order.
+func sortRules() {
+	sort.SliceStable(rules, func(i, j int) bool {
+		return rules[i].priority > rules[j].priority
+	})
+}
+
+// matches returns whether the rule conditions match a query from client at now.
+func (r *rule) matches(client net.IP, q dns.Question, now time.Time) bool {
+	if r.name != nil && !r.name.MatchString(normalizeName(q.Name)) {
+		return false
+	}
+	if r.qtypes != nil && !r.qtypes[q.Qtype] {
+		return false
+	}
+	if r.clients != nil && !containsIP(r.clients, client) {
+		return false
+	}
+	if r.times != nil && !r.times.contains(now) {
+		return false
+	}
+	return true
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the IP of the client which sent a query.
+func remoteIP(w dns.ResponseWriter) net.IP {
+	return addrIP(w.RemoteAddr())
+}
+
+// addrIP returns the IP of a client or server address.
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	host, _, _ := net.SplitHostPort(addr.String())
+	host, _ = splitZone(host)
+	return net.ParseIP(host)
+}
+
+// addrZone returns the IPv6 zone of a client address, the interface of a
+// link-local IP such as fe80::1%eth0, "" if none.
+func addrZone(addr net.Addr) string {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.Zone
+	case *net.TCPAddr:
+		return addr.Zone
+	}
+	host, _, _ := net.SplitHostPort(addr.String())
+	_, zone := splitZone(host)
+	return zone
+}
+
+// addrHost returns the IP of a client address for logs, with its zone if
+// any, so that the same link-local IP on two interfaces are told apart.
+func addrHost(addr net.Addr) string {
+	ip := addrIP(addr)
+	if zone := addrZone(addr); zone != "" {
+		return ip.String() + "%" + zone
+	}
+	return ip.String()
+}
+
+// splitZone splits an IP into its address and zone, fe80::1%eth0 into
+// fe80::1 and eth0.
+func splitZone(s string) (string, string) {
+	host, zone, _ := strings.Cut(s, "%")
+	return host, zone
+}
+
+// matchRule evaluates the rules in order and returns the first one with a
+// terminal action matching the query, nil if none. Matching log rules are
+// logged along the way.
+func matchRule(w dns.ResponseWriter, req *dns.Msg) *rule {
+	return matchRuleFor(remoteIP(w), req.Question[0], func(r *rule) {
+		q := req.Question[0]
+		logf("rule: %s %s from %s matched %q", displayName(q.Name), dns.TypeToString[q.Qtype], clientLabel(w, req), r.text)
+	})
+}
+
+// matchRuleFor is matchRule for a question from client, calling logRule
+// for the matching log rules.
+func matchRuleFor(client net.IP, q dns.Question, logRule func(*rule)) *rule {
+	now := time.Now()
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
+	for _, r := range rules {
+		if r.disabled || !r.matches(client, q, now) {
+			continue
+		}
+		if r.action == actionLog {
+			logRule(r)
+			continue
+		}
+		return r
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+package main
+
+import "sync/atomic"
+
+// configGeneration counts the changes of the configuration at runtime, by
+// control updates and from the console, so that dashboards can correlate
+// changes of behavior with them. Statistics survive these changes: they
+// are kept by backend address and metric name, never by route.
+var configGeneration atomic.Uint64
+
+// configChanged starts a new configuration generation.
+func configChanged(what string) {
+	logf("config: generation %d: %s", configGeneration.Add(1), what)
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	groupLists      flagStringList
+	groupMACs       flagStringList
+	groupBlocklists flagStringList
+	groupSchedules  flagStringList
+	groupSafeSearch flagStringList
+	groupIDs        flagStringList
+)
+
+func init() {
+	flag.Var(&groupLists, "group", "Policy group of clients (name=ip|cidr,...), the first matching group applies")
+	flag.Var(&groupIDs, "group-id", "Clients of a policy group by identity, from -client-id-option or -client-names (name=id,...)")
+	flag.Var(&groupMACs, "group-mac", "Clients of a policy group by MAC address, from the ARP table (name=mac,...)")
+	flag.Var(&groupBlocklists, "group-blocklist", "File of domains blocked with their subdomains for a group, one per line (name=path)")
+	flag.Var(&groupSchedules, "group-schedule", "Times when clients of a group may resolve, refused otherwise (name=hh:mm-hh:mm,...)")
+	flag.Var(&groupSafeSearch, "group-safesearch", "Enforce safe search of search engines for a group (name)")
+}
+
+// group is a policy applying to a set of clients.
+type group struct {
+	name       string
+	clients    []*net.IPNet
+	macs       map[string]bool
+	ids        map[string]bool // client identities
+	blocked    map[string]bool // domains and their subdomains
+	schedule   []timeRange     // empty is always
+	safeSearch bool
+}
+
+var groups []*group
+
+// safeSearchTargets maps search engine names to their safe search names.
+var safeSearchTargets = map[string]string{
+	"www.google.com.":             "forcesafesearch.google.com.",
+	"google.com.":                 "forcesafesearch.google.com.",
+	"www.bing.com.":               "strict.bing.com.",
+	"duckduckgo.com.":             "safe.duckduckgo.com.",
+	"www.duckduckgo.com.":         "safe.duckduckgo.com.",
+	"www.youtube.com.":            "restrict.youtube.com.",
+	"m.youtube.com.":              "restrict.youtube.com.",
+	"youtubei.googleapis.com.":    "restrict.youtube.com.",
+	"youtube.googleapis.com.":     "restrict.youtube.com.",
+	"www.youtube-nocookie.com.":   "restrict.youtube.com.",
+	"www.youtube-nocookie.co.uk.": "restrict.youtube.com.",
+}
+
+func findGroup(name string) (*group, error) {
+	for _, g := range groups {
+		if g.name == name {
+			return g, nil
+		}
+	}
+	return nil, fmt.Errorf("no -group %v", name)
+}
+
+// splitGroupFlag splits a name=value group flag.
+func splitGroupFlag(flagName, s string) (*group, string, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return nil, "", fmt.Errorf("invalid -%v %q, must be name=value", flagName, s)
+	}
+	g, err := findGroup(parts[0])
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid -%v: %v", flagName, err)
+	}
+	return g, parts[1], nil
+}
+
+// parseGroups parses the -group flags.
+func parseGroups() error {
+	for _, groupList := range groupLists {
+		s := strings.SplitN(groupList, "=", 2)
+		if len(s[0]) == 0 {
+			return fmt.Errorf("invalid -group, must be name[=ip|cidr,...]")
+		}
+		if _, err := findGroup(s[0]); err == nil {
+			return fmt.Errorf("invalid -group, duplicate group %v", s[0])
+		}
+		g := &group{name: s[0], macs: make(map[string]bool), ids: make(map[string]bool), blocked: make(map[string]bool)}
+		if len(s) == 2 {
+			clients, err := parseCIDRs(s[1])
+			if err != nil {
+				return fmt.Errorf("invalid -group %v: %v", s[0], err)
+			}
+			g.clients = clients
+		}
+		groups = append(groups, g)
+	}
+	for _, groupMAC := range groupMACs {
+		g, macs, err := splitGroupFlag("group-mac", groupMAC)
+		if err != nil {
+			return err
+		}
+		for _, mac := range strings.Split(macs, ",") {
+			hw, err := net.ParseMAC(mac)
+			if err != nil {
+				return fmt.Errorf("invalid -group-mac: %v", err)
+			}
+			g.macs[hw.String()] = true
+		}
+	}
+	for _, groupID := range groupIDs {
+		g, ids, err := splitGroupFlag("group-id", groupID)
+		if err != nil {
+			return err
+		}
+		for _, id := range strings.Split(ids, ",") {
+			g.ids[id] = true
+		}
+	}
+	for _, groupBlocklist := range groupBlocklists {
+		g, path, err := splitGroupFlag("group-blocklist", groupBlocklist)
+		if err != nil {
+			return err
+		}
+		if err := g.loadBlocklist(path); err != nil {
+			return fmt.Errorf("invalid -group-blocklist: %v", err)
+		}
+	}
+	for _, groupSchedule := range groupSchedules {
+		g, ranges, err := splitGroupFlag("group-schedule", groupSchedule)
+		if err != nil {
+			return err
+		}
+		for _, r := range strings.Split(ranges, ",") {
+			t, err := parseTimeRange(r)
+			if err != nil {
+				return fmt.Errorf("invalid -group-schedule: %v", err)
+			}
+			g.schedule = append(g.schedule, t)
+		}
+	}
+	for _, name := range groupSafeSearch {
+		g, err := findGroup(name)
+		if err != nil {
+			return fmt.Errorf("invalid -group-safesearch: %v", err)
+		}
+		g.safeSearch = true
+	}
+	return nil
+}
+
+func (g *group) loadBlocklist(path string) error {
+	return loadDomainList(path, g.blocked)
+}
+
+// loadDomainList adds the domains of a file, one per line, to domains.
+func loadDomainList(path string, domains map[string]bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		domains[routeDomain(strings.TrimPrefix(line, "."))] = true
+	}
+	return scanner.Err()
+}
+
+// isBlocked returns whether name or one of its parents is in the blocklist.
+func (g *group) isBlocked(name string) bool {
+	return domainListed(g.blocked, name)
+}
+
+// domainListed returns whether name or one of its parents is in domains.
+func domainListed(domains map[string]bool, name string) bool {
+	for suffix := name; suffix != ""; {
+		if domains[suffix] {
+			return true
+		}
+		dot := strings.IndexByte(suffix, '.')
+		if dot < 0 || dot == len(suffix)-1 {
+			return false
+		}
+		suffix = suffix[dot+1:]
+	}
+	return false
+}
+
+// arpCache maps client IPs to MAC addresses from the kernel ARP table.
+type arpCache struct {
+	sync.Mutex
+	loaded time.Time
+	macs   map[string]string // by IP
+}
+
+var arp = &arpCache{}
+
+// mac returns the MAC address of ip, "" if unknown.
+func (a *arpCache) mac(ip net.IP) string {
+	a.Lock()
+	defer a.Unlock()
+	if time.Since(a.loaded) > time.Minute {
+		a.loaded = time.Now()
+		a.macs = readARP("/proc/net/arp")
+	}
+	return a.macs[ip.String()]
+}
+
+// readARP parses a Linux /proc/net/arp table.
+func readARP(path string) map[string]string {
+	macs := make(map[string]string)
+	f, err := os.Open(path)
+	if err != nil {
+		return macs
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 {
+			continue
+		}
+		if hw, err := net.ParseMAC(fields[3]); err == nil {
+			macs[fields[0]] = hw.String()
+		}
+	}
+	return macs
+}
+
+// clientGroup returns the first group the client belongs to, by IP, MAC
+// address or identity if not empty, nil if none.
+func clientGroup(client net.IP, id string) *group {
+	for _, g := range groups {
+		if containsIP(g.clients, client) {
+			return g
+		}
+		if id != "" && g.ids[id] {
+			return g
+		}
+		if len(g.macs) > 0 && g.macs[arp.mac(client)] {
+			return g
+		}
+	}
+	return nil
+}
+
+// inSchedule returns whether the clients of the group may resolve at now,
+// always without a schedule.
+func (g *group) inSchedule(now time.Time) bool {
+	if len(g.schedule) == 0 {
+		return true
+	}
+	for _, t := range g.schedule {
+		if t.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// safeSearchTarget returns the safe search name of a normalized name for
+// the clients of the group, "" if none.
+func (g *group) safeSearchTarget(name string) string {
+	if !g.safeSearch {
+		return ""
+	}
+	return safeSearchTargets[name]
+}
+
+// safeSearch answers req with a CNAME to target followed by its resolution.
+func (v *view) safeSearch(w dns.ResponseWriter, req *dns.Msg, target string) {
+	r := v.match(target)
+	if r == nil {
+		v.fail(w, req)
+		return
+	}
+	out := req.Copy()
+	out.Question[0].Name = target
+	ctx, cancel := queryContext(w.RemoteAddr().Network())
+	defer cancel()
+	resp, _, err := r.exchange(ctx, w.RemoteAddr().Network(), out)
+	if err != nil {
+		logQueryError(w, out, err)
+		v.fail(w, req)
+		return
+	}
+	resp.Question = req.Question
+	if *clearAD {
+		resp.AuthenticatedData = false // the CNAME is not signed
+	}
+	resp.Answer = append([]dns.RR{&dns.CNAME{
+		Hdr:    dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300},
+		Target: target,
+	}}, resp.Answer...)
+	if w.RemoteAddr().Network() == "udp" {
+		resp.Truncate(udpSize(req))
+	}
+	w.WriteMsg(resp)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"os/exec"
+	"sync"
+)
+
+var (
+	standby = flag.Bool("standby", false,
+		"Start as an HA standby: listen but answer REFUSED until promoted with SIGUSR1 or the console")
+	haNotify = flag.String("ha-notify", "",
+		"Command run on HA transitions with the new state as argument: active or standby")
+)
+
+// HA states.
+const (
+	haActive  = "active"
+	haStandby = "standby"
+)
+
+var (
+	haMu    sync.RWMutex
+	haState = haActive
+)
+
+// startHA sets the initial HA state and promotes on SIGUSR1, demotes on
+// SIGUSR2, e.g. from keepalived notify scripts.
+func startHA() {
+	if *standby {
+		haState = haStandby
+	}
+	notifyHASignals()
+}
+
+// isStandby returns whether queries must be refused.
+func isStandby() bool {
+	haMu.RLock()
+	defer haMu.RUnlock()
+	return haState == haStandby
+}
+
+// setHAState transitions to state, running -ha-notify if it changed.
+func setHAState(state string) {
+	haMu.Lock()
+	changed := haState != state
+	haState = state
+	haMu.Unlock()
+	if !changed {
+		return
+	}
+	logf("ha: now %v", state)
+	if *haNotify == "" {
+		return
+	}
+	go func() {
+		if out, err := exec.Command(*haNotify, state).CombinedOutput(); err != nil {
+			logf("ha: -ha-notify %v: %v: %s", state, err, out)
+		}
+	}()
+}
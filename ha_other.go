@@ -0,0 +1,7 @@
+//go:build !unix
+
+package main
+
+// notifyHASignals does nothing without SIGUSR1 and SIGUSR2, the console
+// can still promote and demote.
+func notifyHASignals() {}
@@ -0,0 +1,24 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyHASignals promotes on SIGUSR1 and demotes on SIGUSR2.
+func notifyHASignals() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range sigs {
+			if sig == syscall.SIGUSR1 {
+				setHAState(haActive)
+			} else {
+				setHAState(haStandby)
+			}
+		}
+	}()
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var (
+	adminAllow = flag.String("admin-allow", "",
+		"List of clients allowed to use -admin-address, all by default (cidr,[cidr,...])")
+	adminAuth = flag.String("admin-auth", "",
+		"HTTP basic authentication required by -admin-address (user:password)")
+	adminClientCA = flag.String("admin-client-ca", "",
+		"Serve -admin-address over HTTPS with -tls-cert and -tls-key, requiring client certificates signed by these CAs (PEM file)")
+	metricsAllow = flag.String("metrics-allow", "",
+		"List of clients allowed to use -metrics-address, all by default (cidr,[cidr,...])")
+	metricsAuth = flag.String("metrics-auth", "",
+		"HTTP basic authentication required by -metrics-address (user:password)")
+	metricsClientCA = flag.String("metrics-client-ca", "",
+		"Serve -metrics-address over HTTPS with -tls-cert and -tls-key, requiring client certificates signed by these CAs (PEM file)")
+)
+
+// httpACL protects an HTTP endpoint of the proxy by client and by basic
+// authentication, optional.
+type httpACL struct {
+	name           string // of the endpoint, e.g. admin
+	nets           []*net.IPNet
+	user, password string
+	handler        http.Handler
+}
+
+// listenHTTP listens on addr for the HTTP endpoint name, over HTTPS
+// requiring client certificates with clientCA, and returns its handler
+// limited to the clients of allow and authenticated by auth.
+func listenHTTP(name, addr, allow, auth, clientCA string, handler http.Handler) (net.Listener, http.Handler, error) {
+	a := &httpACL{name: name, handler: handler}
+	if allow != "" {
+		nets, err := parseCIDRs(allow)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid -%v-allow: %v", name, err)
+		}
+		a.nets = nets
+	}
+	if auth != "" {
+		user, password, ok := strings.Cut(auth, ":")
+		if !ok || user == "" || password == "" {
+			return nil, nil, fmt.Errorf("invalid -%v-auth, must be user:password", name)
+		}
+		a.user, a.password = user, password
+	}
+	if allow == "" && auth == "" && clientCA == "" && !loopbackAddress(addr) {
+		log.Printf("WARNING: -%v-address %v is open to all clients, see -%v-allow, -%v-auth and -%v-client-ca",
+			name, addr, name, name, name)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("-%v-address: %v", name, err)
+	}
+	if clientCA == "" {
+		return l, a, nil
+	}
+	config, err := clientCertConfig(clientCA)
+	if err != nil {
+		l.Close()
+		return nil, nil, fmt.Errorf("-%v-client-ca: %v", name, err)
+	}
+	return tls.NewListener(l, config), a, nil
+}
+
+// clientCertConfig returns the TLS configuration of -tls-cert requiring
+// client certificates signed by the CAs of the PEM file path.
+func clientCertConfig(path string) (*tls.Config, error) {
+	if *tlsCert == "" || *tlsKey == "" {
+		return nil, fmt.Errorf("needs -tls-cert and -tls-key")
+	}
+	cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificate in %v", path)
+	}
+	config, err := serverTLSConfig(cert)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
+
+// loopbackAddress returns whether addr only listens on a loopback address.
+func loopbackAddress(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// ServeHTTP refuses the clients not allowed, and asks the others for the
+// basic authentication if any, counted in the http.NAME.denied metric.
+func (a *httpACL) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if a.nets != nil && !containsIP(a.nets, addrIP(remoteAddr(r))) {
+		countMetric(metricName("http", a.name, "denied"))
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if a.user != "" {
+		user, password, ok := r.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(a.user)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(a.password)) != 1 {
+			countMetric(metricName("http", a.name, "denied"))
+			w.Header().Set("WWW-Authenticate", `Basic realm="dns-reverse-proxy `+a.name+`"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	a.handler.ServeHTTP(w, r)
+}
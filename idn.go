@@ -0,0 +1,124 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+var (
+	idnRoutes = flag.Bool("idn-routes", false,
+		"Convert internationalized names (U-labels) to punycode (A-labels) for route matching")
+	idnLogs = flag.Bool("idn-logs", false,
+		"Render internationalized names as Unicode in logs")
+)
+
+// normalizeName returns the form of a query or route name used for matching:
+// lower case with canonical escapes and, with -idn-routes, internationalized
+// labels as A-labels.
+func normalizeName(name string) string {
+	name = strings.ToLower(canonicalName(name))
+	if !*idnRoutes || !strings.Contains(name, `\`) {
+		return name
+	}
+	ascii, err := idna.Lookup.ToASCII(unescapeName(name))
+	if err != nil {
+		return name
+	}
+	return canonicalName(ascii)
+}
+
+// displayName returns the form of a name used in logs, with canonical
+// escapes.
+func displayName(name string) string {
+	name = canonicalName(name)
+	if !*idnLogs || !strings.Contains(name, "xn--") {
+		return name
+	}
+	unicode, err := idna.Display.ToUnicode(name)
+	if err != nil {
+		return name
+	}
+	return unicode
+}
+
+// canonicalName returns a name in presentation format with a single form
+// for each byte, whichever way the client or flag escaped it: printable
+// ASCII as is, and dots and backslashes within labels, spaces, control and
+// non-ASCII bytes as \DDD, so that every dot is a label boundary.
+func canonicalName(name string) string {
+	if isCanonical(name) {
+		return name
+	}
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c == '.' {
+			b.WriteByte(c)
+			continue
+		}
+		if c == '\\' && i+1 < len(name) {
+			c = name[i+1]
+			n := 1
+			if i+3 < len(name) && isDigit(name[i+1]) && isDigit(name[i+2]) && isDigit(name[i+3]) {
+				if v, err := strconv.Atoi(name[i+1 : i+4]); err == nil && v < 256 {
+					c, n = byte(v), 3
+				}
+			}
+			i += n
+		}
+		if c <= ' ' || c >= 0x7f || c == '.' || c == '\\' {
+			fmt.Fprintf(&b, "\\%03d", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// isCanonical returns whether a name has only printable ASCII and no
+// escapes, the common case.
+func isCanonical(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] <= ' ' || s[i] >= 0x7f || s[i] == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// unescapeName decodes the \DDD and \X escapes of a name in presentation
+// format, which is how the dns package represents non-ASCII bytes.
+// Escaped dots are kept escaped so label boundaries are preserved.
+func unescapeName(name string) string {
+	if !strings.Contains(name, `\`) {
+		return name
+	}
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '\\' || i+1 == len(name) {
+			b.WriteByte(name[i])
+			continue
+		}
+		c := name[i+1]
+		n := 1
+		if i+3 < len(name) && isDigit(name[i+1]) && isDigit(name[i+2]) && isDigit(name[i+3]) {
+			if v, err := strconv.Atoi(name[i+1 : i+4]); err == nil && v < 256 {
+				c, n = byte(v), 3
+			}
+		}
+		if c == '.' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+		i += n
+	}
+	return b.String()
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var (
+	dnsmasqImports flagStringList
+	bindImports    flagStringList
+	unboundImports flagStringList
+)
+
+func init() {
+	flag.Var(&dnsmasqImports, "import-dnsmasq", "dnsmasq config file whose server=, address= and local= lines are imported as routes and local records")
+	flag.Var(&bindImports, "import-bind", "BIND named.conf whose forwarders and forward zones are imported as routes")
+	flag.Var(&unboundImports, "import-unbound", "Unbound config file whose forward-zone: clauses are imported as routes")
+}
+
+// importConfigs imports the configuration files of other DNS software
+// into the default view, BIND views into the views of the same name.
+func importConfigs() error {
+	v := views[""]
+	for _, path := range dnsmasqImports {
+		if err := v.importDnsmasq(path); err != nil {
+			return fmt.Errorf("-import-dnsmasq: %v", err)
+		}
+	}
+	for _, path := range bindImports {
+		if err := importBind(path); err != nil {
+			return fmt.Errorf("-import-bind: %v", err)
+		}
+	}
+	for _, path := range unboundImports {
+		if err := v.importUnbound(path); err != nil {
+			return fmt.Errorf("-import-unbound: %v", err)
+		}
+	}
+	return nil
+}
+
+// importDnsmasq imports a dnsmasq config file:
+//
+//	server=/domain/[domain/...]ip[#port]  route, or exception with #
+//	server=/domain/                       local only, NXDOMAIN
+//	server=ip[#port]                      default server, unless -default
+//	local=/domain/                        local only, NXDOMAIN
+//	address=/domain/[ip]                  local records, NXDOMAIN without ip,
+//	                                      0.0.0.0 and :: with #
+//
+// Other lines are ignored.
+func (v *view) importDnsmasq(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch key {
+		case "server", "local", "address":
+		default:
+			continue
+		}
+		if err := v.importDnsmasqLine(key, value); err != nil {
+			return fmt.Errorf("%v:%d: %v", path, n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (v *view) importDnsmasqLine(key, value string) error {
+	var domains []string
+	target := value
+	if strings.HasPrefix(value, "/") {
+		parts := strings.Split(value[1:], "/")
+		domains, target = parts[:len(parts)-1], parts[len(parts)-1]
+		if len(domains) == 0 {
+			return fmt.Errorf("invalid %v=%v", key, value)
+		}
+	}
+	switch key {
+	case "local":
+		target = ""
+		fallthrough
+	case "server":
+		if target == "" {
+			for _, domain := range domains {
+				v.addSynth(domain, nil)
+			}
+			return nil
+		}
+		if target == "#" {
+			for _, domain := range domains {
+				v.addZoneException(domain)
+			}
+			return nil
+		}
+		backend, err := dnsmasqServer(target)
+		if err != nil {
+			return err
+		}
+		if len(domains) == 0 {
+			v.addImportedDefault(backend)
+			return nil
+		}
+		for _, domain := range domains {
+			v.addZoneRoute(domain, backend)
+		}
+	case "address":
+		var ips []net.IP
+		switch target {
+		case "":
+		case "#":
+			ips = []net.IP{net.IPv4zero, net.IPv6zero}
+		default:
+			ip := net.ParseIP(target)
+			if ip == nil {
+				return fmt.Errorf("invalid IP %v", target)
+			}
+			ips = []net.IP{ip}
+		}
+		for _, domain := range domains {
+			v.addSynth(domain, ips)
+		}
+	}
+	return nil
+}
+
+// addZoneRoute adds an imported route for a domain and its subdomains,
+// backends of the same domain are load balanced.
+func (v *view) addZoneRoute(domain, backend string) {
+	domain = routeDomain(domain)
+	if r, ok := v.routes[domain]; ok {
+		r.backends = append(r.backends, backend)
+		return
+	}
+	v.routes[domain] = &routeEntry{
+		domainMatch: domainMatch{domain: domain, zone: true},
+		backends:    []string{backend},
+		fallback:    *fallbackToDefault,
+		retries:     newRetryBudget(*retryBudgetRatio),
+	}
+}
+
+// addZoneException adds an imported exception for a domain and its subdomains.
+func (v *view) addZoneException(domain string) {
+	v.exceptions = append(v.exceptions, domainMatch{domain: routeDomain(domain), zone: true})
+}
+
+// addImportedDefault adds a default server unless one was configured with
+// -default, imported backends are load balanced.
+func (v *view) addImportedDefault(backend string) {
+	if v.defaultRoute == nil {
+		v.defaultRoute = defaultRoute(backend)
+		v.defaultImported = true
+		return
+	}
+	if v.defaultImported {
+		v.defaultRoute.backends = append(v.defaultRoute.backends, backend)
+	}
+}
+
+// dnsmasqServer converts a dnsmasq ip[#port][@source] server to host:port.
+func dnsmasqServer(s string) (string, error) {
+	if i := strings.IndexByte(s, '@'); i >= 0 {
+		s = s[:i]
+	}
+	host, port := s, "53"
+	if i := strings.IndexByte(s, '#'); i >= 0 {
+		host, port = s[:i], s[i+1:]
+	}
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("invalid server IP %v", host)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// bindStatement is a BIND config statement: words then an optional block.
+type bindStatement struct {
+	words []string
+	block []*bindStatement
+}
+
+// tokenizeBind splits a BIND config into words, quoted strings and the
+// { } ; punctuation, skipping comments.
+func tokenizeBind(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '#' || strings.HasPrefix(s[i:], "//"):
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(s[i:], "/*"):
+			end := strings.Index(s[i+2:], "*/")
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated comment")
+			}
+			i += end + 4
+		case c == '{' || c == '}' || c == ';':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			end := strings.IndexByte(s[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			tokens = append(tokens, s[i+1:i+1+end])
+			i += end + 2
+		default:
+			j := i
+			for j < len(s) && !unicode.IsSpace(rune(s[j])) && !strings.ContainsRune("{};\"", rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+// parseBind parses statements until the end of a block, returning the
+// remaining tokens.
+func parseBind(tokens []string) ([]*bindStatement, []string, error) {
+	var statements []*bindStatement
+	stmt := &bindStatement{}
+	for len(tokens) > 0 {
+		t := tokens[0]
+		tokens = tokens[1:]
+		switch t {
+		case "{":
+			if len(stmt.words) == 0 {
+				return nil, nil, fmt.Errorf("unexpected {")
+			}
+			block, rest, err := parseBind(tokens)
+			if err != nil {
+				return nil, nil, err
+			}
+			if len(rest) == 0 || rest[0] != "}" {
+				return nil, nil, fmt.Errorf("missing }")
+			}
+			stmt.block, tokens = block, rest[1:]
+		case "}":
+			if len(stmt.words) > 0 || stmt.block != nil {
+				return nil, nil, fmt.Errorf("missing ; before }")
+			}
+			return statements, append([]string{t}, tokens...), nil
+		case ";":
+			if len(stmt.words) > 0 || stmt.block != nil {
+				statements = append(statements, stmt)
+			}
+			stmt = &bindStatement{}
+		default:
+			stmt.words = append(stmt.words, t)
+		}
+	}
+	if len(stmt.words) > 0 || stmt.block != nil {
+		return nil, nil, fmt.Errorf("missing ; at end")
+	}
+	return statements, nil, nil
+}
+
+// importBind imports a BIND named.conf: options forwarders as the default
+// server and zones of type forward as routes. Zones and options within a
+// view statement go to the view of the same name, if any.
+func importBind(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	tokens, err := tokenizeBind(string(b))
+	if err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	statements, rest, err := parseBind(tokens)
+	if err == nil && len(rest) > 0 {
+		err = fmt.Errorf("unexpected }")
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	if err := views[""].importBindStatements(statements); err != nil {
+		return fmt.Errorf("%v: %v", path, err)
+	}
+	for _, stmt := range statements {
+		if len(stmt.words) < 2 || stmt.words[0] != "view" {
+			continue
+		}
+		v, ok := views[stmt.words[1]]
+		if !ok {
+			logf("import: %v: no -view %v, ignoring its zones", path, stmt.words[1])
+			continue
+		}
+		if err := v.importBindStatements(stmt.block); err != nil {
+			return fmt.Errorf("%v: view %v: %v", path, stmt.words[1], err)
+		}
+	}
+	return nil
+}
+
+func (v *view) importBindStatements(statements []*bindStatement) error {
+	for _, stmt := range statements {
+		switch stmt.words[0] {
+		case "options":
+			for _, option := range stmt.block {
+				if option.words[0] != "forwarders" {
+					continue
+				}
+				backends, err := bindForwarders(option)
+				if err != nil {
+					return err
+				}
+				for _, backend := range backends {
+					v.addImportedDefault(backend)
+				}
+			}
+		case "zone":
+			if len(stmt.words) < 2 {
+				return fmt.Errorf("zone without name")
+			}
+			if err := v.importBindZone(stmt.words[1], stmt.block); err != nil {
+				return fmt.Errorf("zone %v: %v", stmt.words[1], err)
+			}
+		}
+	}
+	return nil
+}
+
+// importBindZone imports a zone of type forward. Its forwarders are routed
+// to, and an empty forwarders list, which disables forwarding of the zone
+// in BIND, becomes an exception going to the default server.
+func (v *view) importBindZone(domain string, options []*bindStatement) error {
+	forward := false
+	var forwarders *bindStatement
+	for _, option := range options {
+		switch option.words[0] {
+		case "type":
+			forward = len(option.words) == 2 && option.words[1] == "forward"
+		case "forwarders":
+			forwarders = option
+		}
+	}
+	if !forward || forwarders == nil {
+		return nil
+	}
+	backends, err := bindForwarders(forwarders)
+	if err != nil {
+		return err
+	}
+	if len(backends) == 0 {
+		v.addZoneException(domain)
+		return nil
+	}
+	for _, backend := range backends {
+		v.addZoneRoute(domain, backend)
+	}
+	return nil
+}
+
+// bindForwarders parses forwarders [port N] { ip [port N]; ... } into
+// host:port backends.
+func bindForwarders(stmt *bindStatement) ([]string, error) {
+	port, err := bindPort(stmt.words[1:], "53")
+	if err != nil {
+		return nil, err
+	}
+	var backends []string
+	for _, forwarder := range stmt.block {
+		ip := net.ParseIP(forwarder.words[0])
+		if ip == nil {
+			return nil, fmt.Errorf("invalid forwarder %v", forwarder.words[0])
+		}
+		p, err := bindPort(forwarder.words[1:], port)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, net.JoinHostPort(ip.String(), p))
+	}
+	return backends, nil
+}
+
+// bindPort returns the port of "port N" words, def if absent.
+func bindPort(words []string, def string) (string, error) {
+	for i := 0; i+1 < len(words); i++ {
+		if words[i] != "port" {
+			continue
+		}
+		if _, err := strconv.ParseUint(words[i+1], 10, 16); err != nil {
+			return "", fmt.Errorf("invalid port %v", words[i+1])
+		}
+		return words[i+1], nil
+	}
+	return def, nil
+}
+
+// importUnbound imports the forward-zone: clauses of an Unbound config,
+// with their forward-addr: ip[@port][#tls-name] and forward-host: name
+// servers. The root zone is the default server.
+func (v *view) importUnbound(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var zone string
+	var backends []string
+	inZone := false
+	flush := func() {
+		if inZone && zone != "" {
+			for _, backend := range backends {
+				if zone == "." {
+					v.addImportedDefault(backend)
+					continue
+				}
+				v.addZoneRoute(zone, backend)
+			}
+		}
+		zone, backends, inZone = "", nil, false
+	}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(unboundComment.ReplaceAllString(scanner.Text(), ""))
+		if line == "" {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := strings.TrimSpace(kv[0]), strings.Trim(strings.TrimSpace(kv[1]), `"`)
+		if value == "" {
+			// A clause, e.g. server: or stub-zone:
+			flush()
+			inZone = key == "forward-zone"
+			continue
+		}
+		if !inZone {
+			continue
+		}
+		switch key {
+		case "name":
+			zone = value
+		case "forward-addr":
+			backend, err := unboundAddr(value)
+			if err != nil {
+				return fmt.Errorf("%v:%d: %v", path, n, err)
+			}
+			backends = append(backends, backend)
+		case "forward-host":
+			backends = append(backends, net.JoinHostPort(strings.TrimSuffix(value, "."), "53"))
+		}
+	}
+	flush()
+	return scanner.Err()
+}
+
+// unboundComment matches a comment, a # without space before it is part of
+// a forward-addr TLS name.
+var unboundComment = regexp.MustCompile(`(^|\s)#.*`)
+
+// unboundAddr converts an Unbound ip[@port][#tls-name] address to host:port.
+func unboundAddr(s string) (string, error) {
+	if i := strings.IndexByte(s, '#'); i >= 0 {
+		s = s[:i]
+	}
+	host, port := strings.TrimSpace(s), "53"
+	if i := strings.IndexByte(host, '@'); i >= 0 {
+		host, port = host[:i], host[i+1:]
+	}
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("invalid forward-addr %v", s)
+	}
+	return net.JoinHostPort(host, port), nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	listenRetries = flag.Int("listen-retries", 10,
+		"Consecutive failures of a listener after which the proxy exits")
+	listenBackoff = flag.Duration("listen-backoff", 30*time.Second,
+		"Maximum delay before listening again after a listener failure, doubling from 100ms")
+)
+
+// listenerHealthName is the CHAOS TXT name answered with -health-chaos with
+// the state of the listeners.
+const listenerHealthName = "health.listeners.proxy."
+
+// listener supervises a server: if it fails, e.g. on a transient EMFILE,
+// it listens again with exponential backoff instead of exiting.
+type listener struct {
+	addr, net string // net is udp, tcp, tcp-tls or https
+	handler   dns.Handler
+	reusePort bool
+	tlsConfig *tls.Config // of tcp-tls and https
+
+	sync.Mutex
+	stop     func(context.Context) error // of the current attempt
+	up       bool
+	failures int // consecutive
+	err      error
+	stopped  bool
+}
+
+var listeners []*listener
+
+func newListener(addr, net string, handler dns.Handler, reusePort bool) *listener {
+	l := &listener{addr: addr, net: net, handler: handler, reusePort: reusePort}
+	listeners = append(listeners, l)
+	return l
+}
+
+// start returns a function serving a new server until it fails, nil if the
+// listener is stopped. A server cannot be started again once it has failed.
+func (l *listener) start() func() error {
+	l.Lock()
+	defer l.Unlock()
+	if l.stopped {
+		return nil
+	}
+	if l.net == netHTTPS {
+		server := newDoHServer(l.handler)
+		l.stop = server.Shutdown
+		return func() error { return serveDoH(l, server) }
+	}
+	server := &dns.Server{Addr: l.addr, Net: l.net, Handler: l.handler, TLSConfig: l.tlsConfig,
+		ReusePort: l.reusePort, TsigProvider: serverTSIG(), MsgAcceptFunc: acceptMsg}
+	server.NotifyStartedFunc = l.started
+	l.stop = server.ShutdownContext
+	return func() error { return listenAndServe(server) }
+}
+
+// started marks the listener up, once its server listens.
+func (l *listener) started() {
+	l.Lock()
+	l.up = true
+	l.Unlock()
+}
+
+// serve runs the listener until it is stopped, exiting the proxy after
+// -listen-retries consecutive failures.
+func (l *listener) serve() {
+	backoff := 100 * time.Millisecond
+	for {
+		serve := l.start()
+		if serve == nil {
+			return
+		}
+		started := time.Now()
+		err := serve()
+		if err == nil {
+			err = errors.New("stopped serving")
+		}
+		l.Lock()
+		if l.stopped {
+			l.Unlock()
+			return
+		}
+		if time.Since(started) > *listenBackoff {
+			l.failures = 0 // served long enough, a new failure
+			backoff = 100 * time.Millisecond
+		}
+		l.up, l.err = false, err
+		l.failures++
+		failures := l.failures
+		l.Unlock()
+		if failures >= *listenRetries {
+			log.Fatalf("listener %s/%s: giving up after %d failures: %v", l.net, l.addr, failures, err)
+		}
+		logf("listener %s/%s: %v, listening again in %v", l.net, l.addr, err, backoff)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > *listenBackoff {
+			backoff = *listenBackoff
+		}
+	}
+}
+
+// shutdown stops the listener, waiting for the queries in flight until
+// ctx is done.
+func (l *listener) shutdown(ctx context.Context) {
+	l.Lock()
+	l.stopped = true
+	stop := l.stop
+	l.Unlock()
+	if stop != nil {
+		stop(ctx)
+	}
+}
+
+func (l *listener) String() string {
+	l.Lock()
+	defer l.Unlock()
+	state := "up"
+	if !l.up {
+		state = "down"
+	}
+	s := fmt.Sprintf("%s/%s %s failures=%d", l.net, l.addr, state, l.failures)
+	if l.err != nil {
+		s += fmt.Sprintf(" last_error=%q", l.err.Error())
+	}
+	return s
+}
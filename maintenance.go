@@ -0,0 +1,120 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	maintenanceFlag = flag.Bool("maintenance", false,
+		"Start in maintenance mode: answer -maintenance-rcode to all queries until turned off from the console or -admin-address")
+	maintenanceRcode = flag.String("maintenance-rcode", "REFUSED", "Response code of the queries in maintenance mode")
+	maintenanceTTL   = flag.Duration("maintenance-ttl", 30*time.Second,
+		"TTL of the SOA of the responses in maintenance mode, for which resolvers cache them")
+	maintenanceAllow = flag.String("maintenance-allow", "",
+		"List of domains still forwarded in maintenance mode, e.g. for monitoring (domain,[domain,...])")
+	maintenanceExempt = flag.String("maintenance-exempt", "",
+		"List of clients still forwarded in maintenance mode (cidr,[cidr,...])")
+)
+
+var (
+	maintenance       atomic.Bool
+	maintenanceCode   int
+	maintenanceNames  []domainMatch
+	maintenanceIPNets []*net.IPNet
+)
+
+func init() {
+	adminMux.HandleFunc("/maintenance", adminMaintenance)
+}
+
+// parseMaintenance parses the maintenance flags.
+func parseMaintenance() error {
+	rcode, ok := dns.StringToRcode[strings.ToUpper(*maintenanceRcode)]
+	if !ok {
+		return fmt.Errorf("invalid -maintenance-rcode %v", *maintenanceRcode)
+	}
+	maintenanceCode = rcode
+	if *maintenanceAllow != "" {
+		for _, domain := range strings.Split(*maintenanceAllow, ",") {
+			maintenanceNames = append(maintenanceNames, domainMatch{domain: routeDomain(domain), zone: true})
+		}
+	}
+	if *maintenanceExempt != "" {
+		nets, err := parseCIDRs(*maintenanceExempt)
+		if err != nil {
+			return fmt.Errorf("invalid -maintenance-exempt: %v", err)
+		}
+		maintenanceIPNets = nets
+	}
+	maintenance.Store(*maintenanceFlag)
+	return nil
+}
+
+// setMaintenance turns maintenance mode on or off.
+func setMaintenance(on bool) {
+	if maintenance.Swap(on) == on {
+		return
+	}
+	state := "off"
+	if on {
+		state = "on"
+	}
+	logf("maintenance: now %v", state)
+}
+
+// inMaintenance returns whether a query is answered by maintenance mode:
+// maintenance is on, and neither the name nor the client is allowed.
+func inMaintenance(client net.IP, q dns.Question) bool {
+	if !maintenance.Load() || containsIP(maintenanceIPNets, client) {
+		return false
+	}
+	name := normalizeName(q.Name)
+	for _, d := range maintenanceNames {
+		if d.matches(name) {
+			return false
+		}
+	}
+	return true
+}
+
+// answerMaintenance answers req with -maintenance-rcode and a SOA of
+// -maintenance-ttl, so that resolvers retry soon after maintenance.
+func (v *view) answerMaintenance(w dns.ResponseWriter, req *dns.Msg) {
+	m := v.replyMsg(req, maintenanceCode)
+	ttl := uint32(maintenanceTTL.Seconds())
+	name := req.Question[0].Name
+	m.Ns = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns: "maintenance.invalid.", Mbox: "hostmaster.maintenance.invalid.", Serial: 1,
+		Refresh: ttl, Retry: ttl, Expire: ttl, Minttl: ttl}}
+	countMetric("maintenance.answered")
+	w.WriteMsg(m)
+}
+
+// adminMaintenance shows the maintenance mode, and turns it on or off with
+// a POST of on=1 or on=0.
+func adminMaintenance(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		switch r.FormValue("on") {
+		case "1", "true":
+			setMaintenance(true)
+		case "0", "false":
+			setMaintenance(false)
+		default:
+			http.Error(w, "on must be 1 or 0", http.StatusBadRequest)
+			return
+		}
+	}
+	state := "off"
+	if maintenance.Load() {
+		state = "on"
+	}
+	fmt.Fprintln(w, state)
+}
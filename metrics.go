@@ -0,0 +1,273 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	statsdAddress = flag.String("statsd-address", "",
+		"StatsD server to push the metrics to over UDP (host:port)")
+	graphiteAddress = flag.String("graphite-address", "",
+		"Graphite server to push the metrics to with the plaintext protocol over TCP (host:port)")
+	metricsPrefix   = flag.String("metrics-prefix", "dns-reverse-proxy", "Prefix of the pushed metric names")
+	metricsInterval = flag.Duration("metrics-interval", 10*time.Second, "Interval between metrics pushes")
+)
+
+// statsdMaxSamples bounds the timer samples sent to StatsD per push.
+const statsdMaxSamples = 1000
+
+// latencyBuckets are the upper bounds of the histogram buckets of timers.
+var latencyBuckets = []time.Duration{
+	time.Millisecond, 2500 * time.Microsecond, 5 * time.Millisecond, 10 * time.Millisecond,
+	25 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond,
+	500 * time.Millisecond, time.Second, 2500 * time.Millisecond, 5 * time.Second,
+}
+
+// timer is the observed durations of an operation.
+type timer struct {
+	count   uint64
+	sum     time.Duration
+	buckets []uint64        // durations up to each of latencyBuckets
+	samples []time.Duration // since the last push
+}
+
+// metrics are the counters and timers of the proxy, by metric name.
+type metrics struct {
+	sync.Mutex
+	counters map[string]uint64
+	timers   map[string]*timer
+	pushed   map[string]uint64 // counters at the last push, for StatsD deltas
+}
+
+var stats = &metrics{
+	counters: make(map[string]uint64),
+	timers:   make(map[string]*timer),
+	pushed:   make(map[string]uint64),
+}
+
+// metricParts are the parts of metric names as given to metricName, by
+// their replaced form, for the values of Prometheus labels.
+var metricParts sync.Map
+
+// metricName joins parts into a metric name, replacing the dots and colons
+// of addresses and domains in them.
+func metricName(parts ...string) string {
+	r := strings.NewReplacer(".", "_", ":", "_", "=", "_", "/", "_")
+	for i, part := range parts {
+		part = strings.TrimSuffix(part, ".")
+		parts[i] = r.Replace(part)
+		if parts[i] != part {
+			if _, ok := metricParts.Load(parts[i]); !ok {
+				metricParts.Store(parts[i], part)
+			}
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// metricPart returns a part of a metric name as given to metricName.
+func metricPart(part string) string {
+	if raw, ok := metricParts.Load(part); ok {
+		return raw.(string)
+	}
+	return part
+}
+
+func countMetric(name string) {
+	stats.Lock()
+	defer stats.Unlock()
+	stats.counters[name]++
+}
+
+func timeMetric(name string, d time.Duration) {
+	stats.Lock()
+	defer stats.Unlock()
+	t, ok := stats.timers[name]
+	if !ok {
+		t = &timer{buckets: make([]uint64, len(latencyBuckets))}
+		stats.timers[name] = t
+	}
+	t.count++
+	t.sum += d
+	for i, le := range latencyBuckets {
+		if d <= le {
+			t.buckets[i]++
+		}
+	}
+	if len(t.samples) < statsdMaxSamples {
+		t.samples = append(t.samples, d)
+	}
+}
+
+// upstreamGauges returns the current health of each backend by metric name.
+func upstreamGauges() map[string]float64 {
+	upstreamsMu.Lock()
+	defer upstreamsMu.Unlock()
+	gauges := make(map[string]float64)
+	for addr, u := range upstreams {
+		srtt, success, failures := u.stats()
+		gauges[metricName("upstream", addr, "srtt_ms")] = srtt.Seconds() * 1000
+		gauges[metricName("upstream", addr, "success_rate")] = success
+		gauges[metricName("upstream", addr, "failures")] = float64(failures)
+		if caps := u.capabilities(); caps != nil {
+			for _, c := range caps.list() {
+				supported := 0.0
+				if c.ok {
+					supported = 1
+				}
+				gauges[metricName("upstream", addr, "supports_"+c.name)] = supported
+			}
+		}
+	}
+	return gauges
+}
+
+// gauges returns the current values of the gauges by metric name.
+func gauges() map[string]float64 {
+	gauges := upstreamGauges()
+	for name, value := range poolGauges() {
+		gauges[name] = value
+	}
+	for name, value := range tlsResumptionGauges() {
+		gauges[name] = value
+	}
+	for name, value := range nodGauges() {
+		gauges[name] = value
+	}
+	for name, value := range truncationGauges() {
+		gauges[name] = value
+	}
+	for name, value := range auditGauges() {
+		gauges[name] = value
+	}
+	for name, value := range compareGauges() {
+		gauges[name] = value
+	}
+	gauges[metricName("config", "generation")] = float64(configGeneration.Load())
+	if cache != nil {
+		gauges["cache.entries"] = float64(cache.len())
+	}
+	return gauges
+}
+
+// metricsWriter counts the responses written by rcode, and those
+// truncated over UDP.
+type metricsWriter struct {
+	dns.ResponseWriter
+}
+
+func (w metricsWriter) WriteMsg(m *dns.Msg) error {
+	countMetric(metricName("responses", dns.RcodeToString[m.Rcode]))
+	countResponse(w.ResponseWriter, m)
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// Write counts a wire response, as relayed by -fast-path, unpacked only
+// if truncated for the question of its retry.
+func (w metricsWriter) Write(b []byte) (int, error) {
+	if len(b) >= 4 {
+		countMetric(metricName("responses", dns.RcodeToString[int(b[3]&0xf)]))
+		m := new(dns.Msg)
+		if b[2]&0x02 != 0 {
+			m.Unpack(b)
+			m.Truncated = true
+		}
+		countResponse(w.ResponseWriter, m)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// pushMetrics pushes the metrics every -metrics-interval, in background.
+func pushMetrics() error {
+	if *statsdAddress == "" && *graphiteAddress == "" {
+		return nil
+	}
+	for _, addr := range []string{*statsdAddress, *graphiteAddress} {
+		if addr != "" && !validHostPort(addr) {
+			return fmt.Errorf("invalid metrics address %v, must be host:port", addr)
+		}
+	}
+	go func() {
+		for range time.Tick(*metricsInterval) {
+			statsd, graphite := stats.snapshot()
+			if *statsdAddress != "" {
+				if err := sendMetrics("udp", *statsdAddress, statsd); err != nil {
+					logf("metrics: statsd: %v", err)
+				}
+			}
+			if *graphiteAddress != "" {
+				if err := sendMetrics("tcp", *graphiteAddress, graphite); err != nil {
+					logf("metrics: graphite: %v", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// snapshot returns the StatsD and Graphite lines of the metrics and resets
+// the timer samples. StatsD gets counter deltas and timer samples, Graphite
+// the counter totals and the timer counts and mean.
+func (m *metrics) snapshot() (statsd, graphite []string) {
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now().Unix()
+	prefix := *metricsPrefix + "."
+	for name, value := range m.counters {
+		if delta := value - m.pushed[name]; delta > 0 {
+			statsd = append(statsd, fmt.Sprintf("%s%s:%d|c", prefix, name, delta))
+		}
+		m.pushed[name] = value
+		graphite = append(graphite, fmt.Sprintf("%s%s %d %d", prefix, name, value, now))
+	}
+	for name, t := range m.timers {
+		for _, d := range t.samples {
+			statsd = append(statsd, fmt.Sprintf("%s%s:%.3f|ms", prefix, name, d.Seconds()*1000))
+		}
+		t.samples = nil
+		mean := t.sum / time.Duration(t.count)
+		graphite = append(graphite,
+			fmt.Sprintf("%s%s.count %d %d", prefix, name, t.count, now),
+			fmt.Sprintf("%s%s.mean_ms %.3f %d", prefix, name, mean.Seconds()*1000, now))
+	}
+	for name, value := range gauges() {
+		statsd = append(statsd, fmt.Sprintf("%s%s:%g|g", prefix, name, value))
+		graphite = append(graphite, fmt.Sprintf("%s%s %g %d", prefix, name, value, now))
+	}
+	sort.Strings(statsd)
+	sort.Strings(graphite)
+	return statsd, graphite
+}
+
+// sendMetrics sends lines to addr, in UDP packets of at most 1400 bytes.
+func sendMetrics(network, addr string, lines []string) error {
+	if len(lines) == 0 {
+		return nil
+	}
+	conn, err := net.DialTimeout(network, addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	var packet []byte
+	for _, line := range lines {
+		if network == "udp" && len(packet) > 0 && len(packet)+len(line) >= 1400 {
+			if _, err := conn.Write(packet); err != nil {
+				return err
+			}
+			packet = packet[:0]
+		}
+		packet = append(packet, line+"\n"...)
+	}
+	_, err = conn.Write(packet)
+	return err
+}
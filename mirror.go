@@ -0,0 +1,196 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var mirrorLists flagStringList
+
+func init() {
+	flag.Var(&mirrorLists, "mirror", "Copy forwarded queries to a shadow backend whose responses are discarded, "+
+		"all or only those of routes, all or a sample of them, optionally logging the responses differing from the "+
+		"primary ones (host:port [route=[view/]domain,...] [sample=0.0-1.0] [compare])")
+}
+
+// mirrorInFlight is the maximum number of mirrored queries waiting for the
+// shadow backend, queries are not mirrored beyond so that a slow or dead
+// shadow backend cannot pile up goroutines.
+const mirrorInFlight = 256
+
+// mirror copies queries to a shadow backend.
+type mirror struct {
+	addr   string
+	routes map[*routeEntry]bool // nil for all
+	sample float64              // fraction of the queries mirrored
+	// compare sends the query after the primary response and logs the
+	// differences between them.
+	compare bool
+}
+
+var (
+	mirrors     []*mirror
+	mirrorSlots = make(chan struct{}, mirrorInFlight)
+	// mirrorCompare is whether a mirror compares responses, which needs
+	// the primary responses decoded.
+	mirrorCompare bool
+)
+
+// parseMirrors parses the -mirror flags, after the routes.
+func parseMirrors() error {
+	for _, s := range mirrorLists {
+		m, err := parseMirror(s)
+		if err != nil {
+			return fmt.Errorf("invalid -mirror %q: %v", s, err)
+		}
+		mirrors = append(mirrors, m)
+		mirrorCompare = mirrorCompare || m.compare
+	}
+	return nil
+}
+
+// parseMirror parses host:port [route=[view/]domain,...] [sample=0.0-1.0] [compare].
+func parseMirror(s string) (*mirror, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || !validBackend(fields[0]) {
+		return nil, fmt.Errorf("must start with the host:port or unix:/path of the shadow backend")
+	}
+	m := &mirror{addr: fields[0], sample: 1}
+	for _, field := range fields[1:] {
+		if field == "compare" {
+			m.compare = true
+			continue
+		}
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("%q must be key=value", field)
+		}
+		switch kv[0] {
+		case "route":
+			m.routes = make(map[*routeEntry]bool)
+			for _, key := range strings.Split(kv[1], ",") {
+				r, err := findRoute(key)
+				if err != nil {
+					return nil, err
+				}
+				m.routes[r] = true
+			}
+		case "sample":
+			f, err := strconv.ParseFloat(kv[1], 64)
+			if err != nil || f < 0 || f > 1 {
+				return nil, fmt.Errorf("invalid sample %v, must be between 0 and 1", kv[1])
+			}
+			m.sample = f
+		default:
+			return nil, fmt.Errorf("unknown key %q", kv[0])
+		}
+	}
+	return m, nil
+}
+
+// selects returns whether a query forwarded with r is mirrored.
+func (m *mirror) selects(r *routeEntry) bool {
+	if m.routes != nil && !m.routes[r] || rand.Float64() >= m.sample {
+		return false
+	}
+	select {
+	case mirrorSlots <- struct{}{}:
+		return true
+	default:
+		countMetric(metricName("mirror", m.addr, "dropped"))
+		return false
+	}
+}
+
+// mirrorQuery copies req forwarded with r to the shadow backends of the
+// matching mirrors not comparing responses, in background.
+func mirrorQuery(r *routeEntry, transport string, req *dns.Msg) {
+	for _, m := range mirrors {
+		if !m.compare && m.selects(r) {
+			go m.send(transport, req.Copy(), nil)
+		}
+	}
+}
+
+// mirrorResponse copies req forwarded with r to the shadow backends of the
+// matching mirrors comparing responses with resp, in background.
+func mirrorResponse(r *routeEntry, transport string, req, resp *dns.Msg) {
+	for _, m := range mirrors {
+		if m.compare && m.selects(r) {
+			go m.send(transport, req.Copy(), &mirrored{route: r, resp: resp.Copy()})
+		}
+	}
+}
+
+// mirrored is a primary response to compare the shadow one with.
+type mirrored struct {
+	route *routeEntry
+	resp  *dns.Msg
+}
+
+// send sends req to the shadow backend and discards the response, after
+// comparing it with the primary one if not nil.
+func (m *mirror) send(transport string, req *dns.Msg, primary *mirrored) {
+	defer func() { <-mirrorSlots }()
+	ctx, cancel := queryContext(transport)
+	defer cancel()
+	countMetric(metricName("mirror", m.addr, "queries"))
+	resp, err := exchange(ctx, m.addr, nil, transport, req)
+	if err != nil {
+		countMetric(metricName("mirror", m.addr, "failures"))
+		return
+	}
+	if primary == nil {
+		return
+	}
+	if diff := diffResponses(primary.resp, resp); diff != "" {
+		countMetric(metricName("mirror", m.addr, "mismatches"))
+		q := req.Question[0]
+		logf("mirror: mismatch qname=%s qtype=%s%s shadow=%s %s",
+			displayName(q.Name), dns.TypeToString[q.Qtype], primary.route.logFields(), m.addr, diff)
+	}
+}
+
+// diffResponses compares the rcodes and answers of two responses, the
+// answers as sets ignoring the TTLs and the case of names. It returns how
+// they differ, "" if they do not.
+func diffResponses(primary, shadow *dns.Msg) string {
+	if primary.Rcode != shadow.Rcode {
+		return fmt.Sprintf("rcode=%s/%s", dns.RcodeToString[primary.Rcode], dns.RcodeToString[shadow.Rcode])
+	}
+	p, s := answerSet(primary), answerSet(shadow)
+	var missing, extra []string
+	for rr := range p {
+		if !s[rr] {
+			missing = append(missing, rr)
+		}
+	}
+	for rr := range s {
+		if !p[rr] {
+			extra = append(extra, rr)
+		}
+	}
+	if len(missing) == 0 && len(extra) == 0 {
+		return ""
+	}
+	sort.Strings(missing)
+	sort.Strings(extra)
+	return fmt.Sprintf("missing=%q extra=%q", missing, extra)
+}
+
+// answerSet returns the answers of resp as text without TTL, lowercase.
+func answerSet(resp *dns.Msg) map[string]bool {
+	set := make(map[string]bool)
+	for _, rr := range resp.Answer {
+		rr = dns.Copy(rr)
+		rr.Header().Ttl = 0
+		set[strings.ToLower(strings.Join(strings.Fields(rr.String()), " "))] = true
+	}
+	return set
+}
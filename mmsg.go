@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"net"
+	"sync"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+var udpBatch = flag.Int("udp-batch", 0,
+	"Read and write up to this many UDP datagrams per system call (recvmmsg/sendmmsg on Linux), 0 to disable")
+
+// batchIO reads and writes batches of datagrams, ipv4.PacketConn and
+// ipv6.PacketConn implement it.
+type batchIO interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// batchConn is a UDP listener reading and writing datagrams in batches.
+// Reads come from the last batch received until it is consumed, writes are
+// queued and sent together with those queued meanwhile, until it is closed.
+type batchConn struct {
+	*net.UDPConn
+	io batchIO
+
+	readMu sync.Mutex
+	reads  []ipv4.Message
+	next   int // in reads
+	n      int // datagrams read in reads
+
+	writes    chan ipv4.Message
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newBatchConn(conn *net.UDPConn, size int) *batchConn {
+	var io batchIO = ipv4.NewPacketConn(conn)
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		io = ipv6.NewPacketConn(conn)
+	}
+	c := &batchConn{
+		UDPConn: conn,
+		io:      io,
+		reads:   make([]ipv4.Message, size),
+		writes:  make(chan ipv4.Message, size),
+		closed:  make(chan struct{}),
+	}
+	for i := range c.reads {
+		c.reads[i].Buffers = [][]byte{make([]byte, 65535)}
+	}
+	go c.writeLoop(size)
+	return c
+}
+
+func (c *batchConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if c.next >= c.n {
+		n, err := c.io.ReadBatch(c.reads, 0)
+		if err != nil {
+			return 0, nil, err
+		}
+		c.next, c.n = 0, n
+	}
+	m := c.reads[c.next]
+	c.next++
+	return copy(p, m.Buffers[0][:m.N]), m.Addr, nil
+}
+
+// WriteTo queues a datagram, errors are logged as they are only known once
+// the batch is sent. It fails once the listener is closed.
+func (c *batchConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	select {
+	case c.writes <- ipv4.Message{Buffers: [][]byte{append([]byte(nil), p...)}, Addr: addr}:
+		return len(p), nil
+	case <-c.closed:
+		return 0, net.ErrClosed
+	}
+}
+
+// Close closes the listener and stops the writes, dropping those queued.
+func (c *batchConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return c.UDPConn.Close()
+}
+
+func (c *batchConn) writeLoop(size int) {
+	batch := make([]ipv4.Message, 0, size)
+	for {
+		var m ipv4.Message
+		select {
+		case m = <-c.writes:
+		case <-c.closed:
+			return
+		}
+		batch = append(batch[:0], m)
+	queued:
+		for len(batch) < size {
+			select {
+			case m := <-c.writes:
+				batch = append(batch, m)
+			default:
+				break queued
+			}
+		}
+		for pending := batch; len(pending) > 0; {
+			n, err := c.io.WriteBatch(pending, 0)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				// The first datagram not sent failed, the others are retried.
+				logf("udp batch: %v", err)
+				n++
+			}
+			pending = pending[n:]
+		}
+	}
+}
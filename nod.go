@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+var (
+	nodWindow = flag.Duration("nod", 0,
+		"Flag the domains first seen by the proxy within this duration (newly observed domains), e.g. 24h, 0 for off")
+	nodAction = flag.String("nod-action", feedLog, "Action for newly observed domains: log and forward, or block (NXDOMAIN)")
+	nodFile   = flag.String("nod-file", "",
+		"File to save the domains seen to, every minute and on shutdown, restored on startup so they are not new again")
+	nodSeed = flag.String("nod-seed", "",
+		"Domains never newly observed, e.g. a list of popular domains, refreshed every -feed-refresh, as -feed (axfr://host:port/zone or https://...)")
+	nodMax = flag.Int("nod-max", 1000000, "Maximum number of domains seen remembered, the others staying newly observed")
+)
+
+// nodSaveInterval is the interval between saves of the -nod-file.
+const nodSaveInterval = time.Minute
+
+// nodState is the -nod-file.
+type nodState struct {
+	Saved   time.Time        `json:"saved"`
+	Domains map[string]int64 `json:"domains"` // first seen, Unix time
+}
+
+var (
+	nodMu    sync.Mutex
+	nodSeen  = make(map[string]time.Time) // by registered domain
+	nodSeeds = make(map[string]bool)      // by registered domain
+	nodFull  bool                         // logged once
+)
+
+// parseNOD checks the -nod flags, restores the -nod-file and loads the
+// -nod-seed, then saves and reloads them in background.
+func parseNOD() error {
+	if *nodWindow == 0 {
+		return nil
+	}
+	if *nodWindow < 0 {
+		return fmt.Errorf("invalid -nod %v, must be positive", *nodWindow)
+	}
+	if *nodAction != feedLog && *nodAction != feedBlock {
+		return fmt.Errorf("invalid -nod-action %v, must be log or block", *nodAction)
+	}
+	if *nodMax < 1 {
+		return fmt.Errorf("invalid -nod-max %d, must be at least 1", *nodMax)
+	}
+	if *nodFile != "" {
+		if err := loadNOD(); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("-nod-file: %v", err)
+		}
+		save := func() {
+			if err := saveNOD(); err != nil {
+				logf("nod: %v: %v", *nodFile, err)
+			}
+		}
+		go func() {
+			for range time.Tick(nodSaveInterval) {
+				save()
+			}
+		}()
+		onShutdown(save)
+	}
+	if *nodSeed == "" {
+		return nil
+	}
+	u, err := url.Parse(*nodSeed)
+	if err != nil || u.Scheme != "axfr" && u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid -nod-seed %v, must be axfr://host:port/zone or https://...", *nodSeed)
+	}
+	seed := &feed{category: "nod-seed", source: u}
+	loadNODSeed(seed)
+	go func() {
+		for range time.Tick(*feedRefresh) {
+			loadNODSeed(seed)
+		}
+	}()
+	return nil
+}
+
+// loadNODSeed loads the -nod-seed domains, keeping the previous ones if it
+// fails to load.
+func loadNODSeed(seed *feed) {
+	entries, err := seed.load()
+	if err != nil {
+		logf("nod: seed %v: %v", seed.source, err)
+		return
+	}
+	seeds := make(map[string]bool)
+	for _, names := range []map[string]feedEntry{entries.exact, entries.tree, entries.sub} {
+		for name := range names {
+			if domain := nodDomain(name); domain != "" {
+				seeds[domain] = true
+			}
+		}
+	}
+	nodMu.Lock()
+	nodSeeds = seeds
+	nodMu.Unlock()
+	logf("nod: seeded %d domains from %v", len(seeds), seed.source)
+}
+
+func loadNOD() error {
+	b, err := os.ReadFile(*nodFile)
+	if err != nil {
+		return err
+	}
+	var state nodState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return err
+	}
+	nodMu.Lock()
+	for domain, seen := range state.Domains {
+		nodSeen[domain] = time.Unix(seen, 0)
+	}
+	nodMu.Unlock()
+	logf("nod: restored %d domains from %v", len(state.Domains), *nodFile)
+	return nil
+}
+
+// saveNOD writes the -nod-file, replacing it at once so that it is never
+// read half written.
+func saveNOD() error {
+	state := nodState{Saved: time.Now(), Domains: make(map[string]int64)}
+	nodMu.Lock()
+	for domain, seen := range nodSeen {
+		state.Domains[domain] = seen.Unix()
+	}
+	nodMu.Unlock()
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(*nodFile), filepath.Base(*nodFile)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), *nodFile)
+}
+
+// nodDomain returns the registered domain of a normalized name, the one
+// tracked, "" for reverse names and names without one such as public
+// suffixes and single labels.
+func nodDomain(name string) string {
+	name = strings.TrimSuffix(name, ".")
+	if name == "arpa" || strings.HasSuffix(name, ".arpa") {
+		return ""
+	}
+	domain, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil {
+		return ""
+	}
+	return domain
+}
+
+// observe records a query for a registered domain at now unless peek and
+// returns when it was first seen, now for a domain never seen before,
+// counted in the nod.observed metric.
+func observe(domain string, now time.Time, peek bool) time.Time {
+	nodMu.Lock()
+	defer nodMu.Unlock()
+	if nodSeeds[domain] {
+		return time.Time{}
+	}
+	if seen, ok := nodSeen[domain]; ok {
+		return seen
+	}
+	if peek {
+		return now
+	}
+	countMetric("nod.observed")
+	if len(nodSeen) >= *nodMax {
+		if !nodFull {
+			logf("nod: -nod-max %d domains reached, new domains are no longer remembered", *nodMax)
+			nodFull = true
+		}
+		return now
+	}
+	nodSeen[domain] = now
+	return now
+}
+
+// newlyObserved returns the registered domain of a name if it was first
+// seen by the proxy within -nod, with how long ago, recording it unless
+// peek, "" if not newly observed.
+func newlyObserved(name string, peek bool) (string, time.Duration) {
+	if *nodWindow == 0 {
+		return "", 0
+	}
+	domain := nodDomain(normalizeName(name))
+	if domain == "" {
+		return "", 0
+	}
+	now := time.Now()
+	age := now.Sub(observe(domain, now, peek))
+	if age >= *nodWindow {
+		return "", 0
+	}
+	return domain, age
+}
+
+// nodGauges returns the number of domains seen, as the nod.domains gauge.
+func nodGauges() map[string]float64 {
+	if *nodWindow == 0 {
+		return nil
+	}
+	nodMu.Lock()
+	defer nodMu.Unlock()
+	return map[string]float64{"nod.domains": float64(len(nodSeen))}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var logRate = flag.Int("log-rate", 10,
+	"Maximum operational log lines per second for each kind of message, 0 for unlimited")
+
+// logKind counts the lines of one kind of message (same format)
+// logged in the current window.
+type logKind struct {
+	lines      int
+	suppressed int
+	last       string
+}
+
+// logLimiter coalesces operational log lines so that an error path hit by
+// every query does not flood the log.
+type logLimiter struct {
+	sync.Mutex
+	start   time.Time
+	kinds   map[string]*logKind // by format
+	flusher *time.Timer
+}
+
+var opLog = &logLimiter{kinds: make(map[string]*logKind)}
+
+// logf logs an operational message, subject to -log-rate.
+func logf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	if *logRate <= 0 {
+		log.Print(msg)
+		return
+	}
+	opLog.Lock()
+	defer opLog.Unlock()
+	if now := time.Now(); opLog.flusher == nil && now.Sub(opLog.start) >= time.Second {
+		opLog.start = now
+		opLog.kinds = make(map[string]*logKind)
+	}
+	k, ok := opLog.kinds[format]
+	if !ok {
+		k = &logKind{}
+		opLog.kinds[format] = k
+	}
+	if k.lines < *logRate {
+		k.lines++
+		log.Print(msg)
+		return
+	}
+	k.suppressed++
+	k.last = msg
+	if opLog.flusher == nil {
+		opLog.flusher = time.AfterFunc(time.Until(opLog.start.Add(time.Second)), opLog.flush)
+	}
+}
+
+// flush reports suppressed messages and starts a new window.
+func (l *logLimiter) flush() {
+	l.Lock()
+	defer l.Unlock()
+	for _, k := range l.kinds {
+		if k.suppressed > 0 {
+			log.Printf("%s (message repeated %d times)", k.last, k.suppressed)
+		}
+	}
+	l.start = time.Now()
+	l.kinds = make(map[string]*logKind)
+	l.flusher = nil
+}
+
+// logQueryError logs a single record with the context of a failed query.
+func logQueryError(w dns.ResponseWriter, req *dns.Msg, e *exchangeError) {
+	transport := e.transport
+	if transport == "" {
+		transport = w.RemoteAddr().Network()
+	}
+	q := req.Question[0]
+	logf("query failed: qname=%s qtype=%s client=%s%s upstream=%s transport=%s attempts=%d error=%q",
+		displayName(q.Name), dns.TypeToString[q.Qtype], clientLabel(w, req), e.route.logFields(), e.upstream, transport, e.attempts, e.err)
+}
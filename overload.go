@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	maxInflight = flag.Int("max-inflight", 0,
+		"Maximum number of queries being handled, beyond which new UDP queries get -overload-action, 0 for no limit")
+	overloadAction = flag.String("overload-action", "servfail",
+		"What to do with UDP queries beyond -max-inflight: servfail or drop")
+)
+
+// inflight is the number of queries being handled.
+var inflight atomic.Int64
+
+func parseOverload() error {
+	if *overloadAction != "servfail" && *overloadAction != "drop" {
+		return fmt.Errorf("invalid -overload-action %v, must be servfail or drop", *overloadAction)
+	}
+	return nil
+}
+
+// admit counts a query as inflight and returns whether to handle it, else
+// it was answered per -overload-action. Admitted queries must be released
+// with release. TCP queries are always admitted, their clients wait longer.
+func (v *view) admit(w dns.ResponseWriter, req *dns.Msg) bool {
+	n := inflight.Add(1)
+	if *maxInflight <= 0 || n <= int64(*maxInflight) || w.RemoteAddr().Network() != "udp" {
+		return true
+	}
+	inflight.Add(-1)
+	countMetric(metricName("overload", *overloadAction))
+	logf("overload: %d queries in flight, %v for new UDP queries", n-1, *overloadAction)
+	if *overloadAction == "servfail" {
+		v.fail(w, req)
+	}
+	return false
+}
+
+func release() {
+	inflight.Add(-1)
+}
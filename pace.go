@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var upstreamRates flagStringList
+
+func init() {
+	flag.Var(&upstreamRates, "upstream-rate", "Maximum queries per second sent to a backend, the others waiting their turn "+
+		"within their deadline, with bursts of up to N queries sent at once, default 1 (host:port=rate[/N])")
+}
+
+// errPaced is the error of a query which could not be sent to a backend
+// within its deadline because of -upstream-rate.
+var errPaced = errors.New("paced: backend at its -upstream-rate")
+
+// pacer spaces the queries to a backend by a minimum interval, with the
+// generic cell rate algorithm: each query is due an interval after the
+// previous one, early by up to the burst.
+type pacer struct {
+	interval time.Duration
+	burst    time.Duration // how early a query may be sent
+
+	sync.Mutex
+	due time.Time // of the next query
+}
+
+// pacers are the -upstream-rate pacers by backend.
+var pacers = make(map[string]*pacer)
+
+// parsePacing parses the -upstream-rate flags.
+func parsePacing() error {
+	for _, s := range upstreamRates {
+		addr, rate, ok := strings.Cut(s, "=")
+		if !ok || !validBackend(addr) {
+			return fmt.Errorf("invalid -upstream-rate %q, must be host:port=rate[/N]", s)
+		}
+		limit, err := parseRate(rate)
+		if err != nil {
+			return fmt.Errorf("invalid -upstream-rate %q, %v", s, err)
+		}
+		if _, ok := pacers[addr]; ok {
+			return fmt.Errorf("invalid -upstream-rate, duplicate backend %v", addr)
+		}
+		pacers[addr] = &pacer{interval: limit.interval, burst: limit.burst}
+	}
+	return nil
+}
+
+// pace waits for the turn of a query to addr, returning errPaced at once
+// if it would come after the deadline of ctx. Waiting queries count in the
+// upstream.ADDR.paced metric, those given up in upstream.ADDR.pace_exceeded.
+func pace(ctx context.Context, addr string) error {
+	p, ok := pacers[addr]
+	if !ok {
+		return nil
+	}
+	p.Lock()
+	now := time.Now()
+	if p.due.Before(now) {
+		p.due = now
+	}
+	wait := p.due.Sub(now) - p.burst
+	if wait < 0 {
+		wait = 0
+	}
+	if deadline, ok := ctx.Deadline(); ok && now.Add(wait).After(deadline) {
+		p.Unlock()
+		countMetric(metricName("upstream", addr, "pace_exceeded"))
+		return errPaced
+	}
+	p.due = p.due.Add(p.interval)
+	p.Unlock()
+	if wait == 0 {
+		return nil
+	}
+	countMetric(metricName("upstream", addr, "paced"))
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	passiveDNSFile = flag.String("passivedns", "",
+		"File where to append the answers in passivedns format, as -log-sink \"format=passivedns output=path\"")
+	passiveDNSWindow = flag.Duration("passivedns-window", time.Minute,
+		"Window over which identical passivedns entries are aggregated into one line with their count")
+)
+
+// passiveKey identifies an answer seen by a client, the fields of a
+// passivedns line but the timestamp, TTL and count. The TTL is not part of
+// it as it decreases with each answer from a cache.
+type passiveKey struct {
+	client, server string
+	class          string
+	query, qtype   string
+	answer         string
+}
+
+// passiveEntry is the aggregation of identical answers in a window, with
+// the highest TTL seen.
+type passiveEntry struct {
+	first time.Time
+	ttl   uint32
+	count int
+}
+
+// passiveLog aggregates the answers of a passivedns log sink, written at
+// the end of each window, one line per distinct entry:
+//
+//	timestamp||client||server||class||query||type||answer||ttl||count
+//
+// with the timestamp of the first occurrence in the window. It is only used
+// by the goroutine of its sink.
+type passiveLog struct {
+	entries map[passiveKey]*passiveEntry
+}
+
+func newPassiveLog() *passiveLog {
+	return &passiveLog{entries: make(map[passiveKey]*passiveEntry)}
+}
+
+// add records the answers sent to a client, the server being the proxy
+// address it queried as a sensor in front of it would see. The answers of
+// blocked queries are not DNS data and not recorded.
+func (p *passiveLog) add(e *sinkEvent) {
+	if e.blocked != "" {
+		return
+	}
+	q := e.req.Question[0]
+	client := addrIP(e.client).String()
+	server, _, _ := net.SplitHostPort(e.server.String())
+	for _, rr := range e.resp.Answer {
+		h := rr.Header()
+		if h.Rrtype != q.Qtype && h.Rrtype != dns.TypeCNAME {
+			continue
+		}
+		key := passiveKey{
+			client: client,
+			server: server,
+			class:  dns.ClassToString[h.Class],
+			query:  strings.ToLower(h.Name),
+			qtype:  dns.TypeToString[h.Rrtype],
+			answer: rrData(rr),
+		}
+		entry, ok := p.entries[key]
+		if !ok {
+			entry = &passiveEntry{first: e.time}
+			p.entries[key] = entry
+		}
+		entry.ttl = max(entry.ttl, h.Ttl)
+		entry.count++
+	}
+}
+
+// rrData returns the data of a record, as in its text form after the header.
+func rrData(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
+
+// flush writes the entries of the window ending to w, oldest first.
+func (p *passiveLog) flush(w io.Writer) {
+	entries := p.entries
+	p.entries = make(map[passiveKey]*passiveEntry)
+	keys := make([]passiveKey, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return entries[keys[i]].first.Before(entries[keys[j]].first)
+	})
+	for _, key := range keys {
+		e := entries[key]
+		fmt.Fprintf(w, "%d.%06d||%s||%s||%s||%s||%s||%s||%d||%d\n",
+			e.first.Unix(), e.first.Nanosecond()/1000, key.client, key.server,
+			key.class, key.query, key.qtype, key.answer, e.ttl, e.count)
+	}
+}
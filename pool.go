@@ -0,0 +1,145 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var poolLists flagStringList
+
+func init() {
+	flag.Var(&poolLists, "pool", "Named pool of backends which routes and default servers refer to as pool:name, with its load balancing "+
+		"as -route-lb and the consecutive failures after which a backend is down, default 3 (name=host:port,... [lb=strategy] [down-after=N])")
+}
+
+// poolPrefix is the prefix of a reference to a pool in place of backends.
+const poolPrefix = "pool:"
+
+// pool is a named list of backends shared by routes.
+type pool struct {
+	name      string
+	backends  []string
+	balancing *balancing // nil for -lb
+	downAfter int        // consecutive failures, 0 for downFailures
+}
+
+// pools by name.
+var pools = make(map[string]*pool)
+
+// parsePools parses the -pool flags.
+func parsePools() error {
+	for _, s := range poolLists {
+		p, err := parsePool(s)
+		if err != nil {
+			return fmt.Errorf("invalid -pool %q: %v", s, err)
+		}
+		if _, ok := pools[p.name]; ok {
+			return fmt.Errorf("invalid -pool, duplicate pool %v", p.name)
+		}
+		pools[p.name] = p
+	}
+	return nil
+}
+
+// parsePool parses name=host:port,... [lb=strategy] [down-after=N].
+func parsePool(s string) (*pool, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("must be name=host:port,...")
+	}
+	parts := strings.SplitN(fields[0], "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("must start with name=host:port,...")
+	}
+	p := &pool{name: parts[0]}
+	for _, backend := range strings.Split(parts[1], ",") {
+		if !validBackend(backend) {
+			return nil, fmt.Errorf("invalid host:port or unix:/path for %v", backend)
+		}
+		p.backends = append(p.backends, backend)
+	}
+	for _, field := range fields[1:] {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("%q must be key=value", field)
+		}
+		switch kv[0] {
+		case "lb":
+			b, err := parseRouteBalancing(kv[1], len(p.backends))
+			if err != nil {
+				return nil, err
+			}
+			p.balancing = b
+		case "down-after":
+			n, err := strconv.Atoi(kv[1])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid down-after %v, must be at least 1", kv[1])
+			}
+			p.downAfter = n
+		default:
+			return nil, fmt.Errorf("unknown option %v", kv[0])
+		}
+	}
+	return p, nil
+}
+
+// poolRoute returns a route to the pool referred to by s, pool:name.
+func poolRoute(s string) (*routeEntry, error) {
+	name := strings.TrimPrefix(s, poolPrefix)
+	p, ok := pools[name]
+	if !ok {
+		return nil, fmt.Errorf("no -pool %v", name)
+	}
+	return &routeEntry{
+		backends:  append([]string(nil), p.backends...),
+		balancing: p.balancing,
+		pool:      p,
+		retries:   newRetryBudget(*retryBudgetRatio),
+	}, nil
+}
+
+// downFailures returns the consecutive failures after which a backend of r
+// is down.
+func (r *routeEntry) downFailures() int {
+	if r.pool != nil {
+		return r.pool.downThreshold()
+	}
+	return downFailures
+}
+
+// countPool counts a query forwarded to the pool of r, if any, and whether
+// all its backends failed, in the pool.NAME.queries and failed metrics.
+func (r *routeEntry) countPool(failed bool) {
+	if r.pool == nil {
+		return
+	}
+	countMetric(metricName("pool", r.pool.name, "queries"))
+	if failed {
+		countMetric(metricName("pool", r.pool.name, "failed"))
+	}
+}
+
+// poolGauges returns the number of backends up of each pool, as the
+// pool.NAME.backends_up gauges.
+func poolGauges() map[string]float64 {
+	gauges := make(map[string]float64)
+	for name, p := range pools {
+		up := 0
+		for _, addr := range p.backends {
+			if !getUpstream(addr).downAfter(p.downThreshold()) {
+				up++
+			}
+		}
+		gauges[metricName("pool", name, "backends_up")] = float64(up)
+	}
+	return gauges
+}
+
+func (p *pool) downThreshold() int {
+	if p.downAfter > 0 {
+		return p.downAfter
+	}
+	return downFailures
+}
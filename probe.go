@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	probeLists    flagStringList
+	probeInterval = flag.Duration("health-probe-interval", 0,
+		"Interval between active health probes of the backends, 0 to only observe forwarded queries")
+)
+
+func init() {
+	flag.Var(&probeLists, "health-probe", "Health probe of the backends, or of one with upstream= "+
+		"([upstream=host:port] [name=name] [type=qtype] [rcode=RCODE] [answer=text] [transport=udp|tcp], default . NS)")
+}
+
+// probeTimeout is the timeout of a probe of a tls:// or https:// backend,
+// that of the DNS client for the others.
+const probeTimeout = 2 * time.Second
+
+// probe is the query sent to check a backend and the response expected.
+type probe struct {
+	name      string
+	qtype     uint16
+	rcode     int
+	answer    string // contained in an answer record, if not empty
+	transport string
+}
+
+var (
+	defaultProbe = &probe{name: ".", qtype: dns.TypeNS, rcode: dns.RcodeSuccess, transport: "udp"}
+	probes       = make(map[string]*probe) // by upstream address
+)
+
+// parseProbes parses the -health-probe flags.
+func parseProbes() error {
+	for _, probeList := range probeLists {
+		p := *defaultProbe
+		upstream := ""
+		for _, field := range strings.Fields(probeList) {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 || kv[1] == "" {
+				return fmt.Errorf("invalid -health-probe %q: %q must be key=value", probeList, field)
+			}
+			switch kv[0] {
+			case "upstream":
+				if !validBackend(kv[1]) {
+					return fmt.Errorf("invalid -health-probe upstream %v, must be host:port or unix:/path", kv[1])
+				}
+				upstream = kv[1]
+			case "name":
+				p.name = dns.Fqdn(kv[1])
+			case "type":
+				qtype, ok := dns.StringToType[strings.ToUpper(kv[1])]
+				if !ok {
+					return fmt.Errorf("invalid -health-probe: unknown type %v", kv[1])
+				}
+				p.qtype = qtype
+			case "rcode":
+				rcode, ok := dns.StringToRcode[strings.ToUpper(kv[1])]
+				if !ok {
+					return fmt.Errorf("invalid -health-probe: unknown rcode %v", kv[1])
+				}
+				p.rcode = rcode
+			case "answer":
+				p.answer = kv[1]
+			case "transport":
+				if kv[1] != "udp" && kv[1] != "tcp" {
+					return fmt.Errorf("invalid -health-probe transport %v, must be udp or tcp", kv[1])
+				}
+				p.transport = kv[1]
+			default:
+				return fmt.Errorf("invalid -health-probe %q: unknown key %q", probeList, kv[0])
+			}
+		}
+		if upstream == "" {
+			defaultProbe = &p
+			continue
+		}
+		probes[upstream] = &p
+	}
+	return nil
+}
+
+// startProbes probes every known backend each -health-probe-interval,
+// in background.
+func startProbes() {
+	if *probeInterval == 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(*probeInterval) {
+			upstreamsMu.Lock()
+			var addrs []string
+			for addr := range upstreams {
+				addrs = append(addrs, addr)
+			}
+			upstreamsMu.Unlock()
+			for _, addr := range addrs {
+				go func(addr string) {
+					err := probeUpstream(addr)
+					if !getUpstream(addr).probed(err) {
+						return
+					}
+					if err != nil {
+						logf("health: %v down: %v", addr, err)
+					} else {
+						logf("health: %v up", addr)
+					}
+				}(addr)
+			}
+		}
+	}()
+}
+
+// probeUpstream sends the probe of a backend and checks its response.
+func probeUpstream(addr string) error {
+	p, ok := probes[addr]
+	if !ok {
+		p = defaultProbe
+	}
+	req := new(dns.Msg)
+	req.SetQuestion(p.name, p.qtype)
+	resp, err := queryUpstream(addr, p.transport, req)
+	if err != nil {
+		return err
+	}
+	if resp.Rcode != p.rcode {
+		return fmt.Errorf("probe %v %v: rcode %v, want %v", p.name, dns.TypeToString[p.qtype],
+			dns.RcodeToString[resp.Rcode], dns.RcodeToString[p.rcode])
+	}
+	if p.answer == "" {
+		return nil
+	}
+	for _, rr := range resp.Answer {
+		if strings.Contains(rr.String(), p.answer) {
+			return nil
+		}
+	}
+	return fmt.Errorf("probe %v %v: no answer with %q", p.name, dns.TypeToString[p.qtype], p.answer)
+}
+
+// queryUpstream sends a query of the proxy itself to a backend, over
+// transport unless it is a tls:// or https:// one, without pacing and
+// health.
+func queryUpstream(addr, transport string, req *dns.Msg) (*dns.Msg, error) {
+	if isEncryptedBackend(addr) {
+		ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+		defer cancel()
+		return queryEncrypted(ctx, addr, nil, req)
+	}
+	c, dial := upstreamClient(addr, transport)
+	resp, _, err := c.Exchange(req, dial)
+	return resp, err
+}
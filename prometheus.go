@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var metricsAddress = flag.String("metrics-address", "",
+	"Address of an HTTP endpoint serving the metrics to Prometheus at /metrics (host:port), also served on -admin-address")
+
+func init() {
+	adminMux.HandleFunc("/metrics", servePrometheus)
+}
+
+// promLabels are the label names of the second part of the metric names
+// starting with a family, e.g. upstream.ADDR.rtt is the upstream_rtt
+// family with the upstream="ADDR" label.
+var promLabels = map[string]string{
+	"alert":     "state",
+	"http":      "endpoint",
+	"mirror":    "mirror",
+	"overload":  "action",
+	"pool":      "pool",
+	"qtype":     "qtype",
+	"queries":   "transport",
+	"responses": "rcode",
+	"route":     "tag",
+	"sink":      "format",
+	"tls":       "server",
+	"tsig":      "key",
+	"upstream":  "upstream",
+}
+
+// startPrometheus serves the metrics on -metrics-address, if any, in
+// background.
+func startPrometheus() error {
+	if *metricsAddress == "" {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", servePrometheus)
+	l, handler, err := listenHTTP("metrics", *metricsAddress, *metricsAllow, *metricsAuth, *metricsClientCA, mux)
+	if err != nil {
+		return err
+	}
+	go func() {
+		logf("metrics: %v", http.Serve(l, handler))
+	}()
+	return nil
+}
+
+// promLabelValue escapes a label value of the Prometheus text format.
+var promLabelValue = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promMetric returns the Prometheus family and labels of a metric name,
+// under -metrics-prefix. Label values are as given to metricName, e.g. an
+// address with its dots and colons.
+func promMetric(name string) (family, labels string) {
+	parts := strings.Split(name, ".")
+	if label, ok := promLabels[parts[0]]; ok && len(parts) > 1 {
+		labels = fmt.Sprintf(`%s="%s"`, label, promLabelValue.Replace(metricPart(parts[1])))
+		parts = append(parts[:1], parts[2:]...)
+	}
+	family = strings.Join(append([]string{*metricsPrefix}, parts...), "_")
+	family = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, family)
+	return family, labels
+}
+
+// promFamily is the samples of a family of metrics in the text format.
+type promFamily struct {
+	kind    string // counter, gauge or histogram
+	samples []string
+}
+
+// servePrometheus writes the metrics in the Prometheus text format: the
+// counters, the timers as histograms in seconds and the gauges.
+func servePrometheus(w http.ResponseWriter, r *http.Request) {
+	families := make(map[string]*promFamily)
+	add := func(family, kind, sample string) {
+		f, ok := families[family]
+		if !ok {
+			f = &promFamily{kind: kind}
+			families[family] = f
+		}
+		f.samples = append(f.samples, sample)
+	}
+	withLabel := func(labels, label string) string {
+		if labels == "" {
+			return "{" + label + "}"
+		}
+		return "{" + labels + "," + label + "}"
+	}
+	braces := func(labels string) string {
+		if labels == "" {
+			return ""
+		}
+		return "{" + labels + "}"
+	}
+	g := gauges()
+	stats.Lock()
+	for name, value := range stats.counters {
+		family, labels := promMetric(name)
+		family += "_total"
+		add(family, "counter", fmt.Sprintf("%s%s %d", family, braces(labels), value))
+	}
+	for name, t := range stats.timers {
+		family, labels := promMetric(name)
+		family += "_seconds"
+		for i, le := range latencyBuckets {
+			add(family, "histogram", fmt.Sprintf("%s_bucket%s %d", family, withLabel(labels, fmt.Sprintf("le=%q", fmt.Sprint(le.Seconds()))), t.buckets[i]))
+		}
+		add(family, "histogram", fmt.Sprintf("%s_bucket%s %d", family, withLabel(labels, `le="+Inf"`), t.count))
+		add(family, "histogram", fmt.Sprintf("%s_sum%s %g", family, braces(labels), t.sum.Seconds()))
+		add(family, "histogram", fmt.Sprintf("%s_count%s %d", family, braces(labels), t.count))
+	}
+	stats.Unlock()
+	for name, value := range g {
+		family, labels := promMetric(name)
+		add(family, "gauge", fmt.Sprintf("%s%s %g", family, braces(labels), value))
+	}
+	var names []string
+	for family := range families {
+		names = append(names, family)
+	}
+	sort.Strings(names)
+	var b bytes.Buffer
+	for _, family := range names {
+		f := families[family]
+		if f.kind != "histogram" {
+			sort.Strings(f.samples)
+		}
+		fmt.Fprintf(&b, "# TYPE %s %s\n", family, f.kind)
+		for _, sample := range f.samples {
+			b.WriteString(sample + "\n")
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(b.Bytes())
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// explainQuery implements the query subcommand: query name [type [client]].
+// It prints how each view the query could be received in would handle it,
+// in evaluation order, without sending anything.
+func explainQuery(out io.Writer, args []string) error {
+	if len(args) == 0 || len(args) > 3 {
+		return fmt.Errorf("usage: query name [type [client]]")
+	}
+	args = append(args, "", "")
+	q, client, err := parseExplain(args[0], args[1], args[2])
+	if err != nil {
+		return err
+	}
+	for _, name := range clientViews(client) {
+		fmt.Fprintf(out, "view %q:\n", name)
+		for _, line := range views[name].live().explain(client, q) {
+			fmt.Fprintln(out, "  "+line)
+		}
+	}
+	return nil
+}
+
+// parseExplain parses the question and client of a query to explain, the
+// type defaulting to A and the client to localhost.
+func parseExplain(name, qtype, client string) (dns.Question, net.IP, error) {
+	q := dns.Question{Name: dns.Fqdn(name), Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	if qtype != "" {
+		t, ok := dns.StringToType[strings.ToUpper(qtype)]
+		if !ok {
+			return q, nil, fmt.Errorf("unknown type %v", qtype)
+		}
+		q.Qtype = t
+	}
+	ip := net.IPv4(127, 0, 0, 1)
+	if client != "" {
+		if ip = net.ParseIP(client); ip == nil {
+			return q, nil, fmt.Errorf("invalid client IP %v", client)
+		}
+	}
+	return q, ip, nil
+}
+
+// clientViews returns the names of the views a query from client could be
+// received in: the one selected by -view-source for the client, or else all
+// of them as it depends on the address receiving the query.
+func clientViews(client net.IP) []string {
+	if v := sourceView(client); v != nil {
+		return []string{v.name}
+	}
+	return viewNames()
+}
+
+// viewNames returns the names of the views, sorted.
+func viewNames() []string {
+	var names []string
+	for name := range views {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// explain returns the evaluation steps of a query from client in v, the
+// decision last.
+func (v *view) explain(client net.IP, q dns.Question) []string {
+	req := new(dns.Msg)
+	req.Question = []dns.Question{q}
+	e := &evaluation{req: req, addr: &net.UDPAddr{IP: client}}
+	d := v.decide(e)
+	return append(e.steps, d.text)
+}
+
+// explainRoute returns why a query is forwarded to r, the route matched
+// by its name.
+func (v *view) explainRoute(e *evaluation, r *routeEntry, q dns.Question) string {
+	text := v.describeRoute(e, r, normalizeName(q.Name))
+	if rebindChecked(q) {
+		text += ", private answers REFUSED"
+	}
+	return text
+}
+
+// describeRoute returns which route r matched a normalized name, as match
+// found it.
+func (v *view) describeRoute(e *evaluation, r *routeEntry, name string) string {
+	if route := controlRoute(v.name, name); route == r {
+		return fmt.Sprintf("control route %v: backends %v", r.domain, r.backends)
+	}
+	if r != v.defaultFor(name) {
+		if r.stub != nil {
+			return fmt.Sprintf("route %v (priority %d): stub zone, name servers %v", r.domain, r.priority, r.stub.nameServers())
+		}
+		return fmt.Sprintf("route %v (priority %d): backends %v", r.domain, r.priority, r.backends)
+	}
+	for _, except := range v.exceptions {
+		if except.matches(name) {
+			e.step("exception %v: default", except.domain)
+			break
+		}
+	}
+	if r != v.defaultRoute {
+		return fmt.Sprintf("default for %v: backends %v", r.domain, r.backends)
+	}
+	return v.explainDefault()
+}
+
+func (v *view) explainDefault() string {
+	if v.defaultRoute == nil {
+		return "no route and no default: SERVFAIL"
+	}
+	if v.defaultRoute.recursive {
+		return "default: recursive resolution"
+	}
+	return fmt.Sprintf("default: backends %v", v.defaultRoute.backends)
+}
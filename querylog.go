@@ -0,0 +1,27 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+var logQueries = flag.Bool("log-queries", false,
+	"Log every query answered to clients to stdout, with the route which matched and the backend which answered, "+
+		"as -log-sink \"format=text output=-\"")
+
+// logFields returns the route fields of a query log line, empty for a nil
+// route: the domain of the route, "default" for the default route, and its
+// tag if any.
+func (r *routeEntry) logFields() string {
+	if r == nil {
+		return ""
+	}
+	route := r.domain
+	if route == "" {
+		route = "default"
+	}
+	if r.tag == "" {
+		return fmt.Sprintf(" route=%s", route)
+	}
+	return fmt.Sprintf(" route=%s tag=%s", route, r.tag)
+}
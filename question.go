@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+var multiQuestion = flag.String("multi-question", multiFormerr,
+	"Handling of queries with more than one question: formerr, refuse, or first to answer only the first question")
+
+// Multi-question handling.
+const (
+	multiFormerr = "formerr" // answer FORMERR, before any processing
+	multiRefuse  = "refuse"  // answer REFUSED
+	multiFirst   = "first"   // drop all questions but the first
+)
+
+func validMultiQuestion(s string) bool {
+	switch s {
+	case multiFormerr, multiRefuse, multiFirst:
+		return true
+	}
+	return false
+}
+
+// parseMultiQuestion checks the -multi-question flag.
+func parseMultiQuestion() error {
+	if !validMultiQuestion(*multiQuestion) {
+		return fmt.Errorf("invalid -multi-question %v, must be formerr, refuse or first", *multiQuestion)
+	}
+	return nil
+}
+
+// acceptMsg accepts queries with more than one question unless they are
+// answered FORMERR, otherwise as the dns package does by default.
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	if dh.Qdcount > 1 && *multiQuestion != multiFormerr {
+		dh.Qdcount = 1
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
+// multiQuestionAnswered handles a query with more than one question, and
+// returns whether it was answered. Otherwise, the query is left with its
+// first question so that routing, transfers and the response all agree.
+func (v *view) multiQuestionAnswered(w dns.ResponseWriter, req *dns.Msg) bool {
+	if len(req.Question) <= 1 {
+		return false
+	}
+	if *multiQuestion == multiRefuse {
+		v.refuse(w, req)
+		return true
+	}
+	req.Question = req.Question[:1]
+	return false
+}
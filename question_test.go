@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// recordWriter is a dns.ResponseWriter keeping the messages written.
+type recordWriter struct {
+	remote net.Addr
+	msgs   []*dns.Msg
+}
+
+func (w *recordWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *recordWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *recordWriter) WriteMsg(m *dns.Msg) error {
+	w.msgs = append(w.msgs, m)
+	return nil
+}
+
+func (w *recordWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *recordWriter) Close() error                { return nil }
+func (w *recordWriter) TsigStatus() error           { return nil }
+func (w *recordWriter) TsigTimersOnly(bool)         {}
+func (w *recordWriter) Hijack()                     {}
+
+func withMultiQuestion(t *testing.T, mode string) {
+	t.Helper()
+	prev := *multiQuestion
+	*multiQuestion = mode
+	t.Cleanup(func() { *multiQuestion = prev })
+}
+
+func TestAcceptMsg(t *testing.T) {
+	for _, tt := range []struct {
+		mode    string
+		qdcount uint16
+		want    dns.MsgAcceptAction
+	}{
+		{multiFormerr, 1, dns.MsgAccept},
+		{multiFormerr, 2, dns.MsgReject},
+		{multiRefuse, 1, dns.MsgAccept},
+		{multiRefuse, 2, dns.MsgAccept},
+		{multiFirst, 1, dns.MsgAccept},
+		{multiFirst, 3, dns.MsgAccept},
+		{multiFirst, 0, dns.MsgReject},
+	} {
+		withMultiQuestion(t, tt.mode)
+		if got := acceptMsg(dns.Header{Qdcount: tt.qdcount}); got != tt.want {
+			t.Errorf("acceptMsg(%v, qdcount %d) = %v, want %v", tt.mode, tt.qdcount, got, tt.want)
+		}
+	}
+}
+
+func TestMultiQuestionAnswered(t *testing.T) {
+	a := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	aaaa := dns.Question{Name: "example.net.", Qtype: dns.TypeAAAA, Qclass: dns.ClassINET}
+	axfr := dns.Question{Name: "example.com.", Qtype: dns.TypeAXFR, Qclass: dns.ClassINET}
+	for _, tt := range []struct {
+		name      string
+		mode      string
+		questions []dns.Question
+		answered  bool
+		rcode     int
+		remaining []dns.Question
+	}{
+		{"single", multiRefuse, []dns.Question{a}, false, 0, []dns.Question{a}},
+		{"single first", multiFirst, []dns.Question{a}, false, 0, []dns.Question{a}},
+		{"refuse", multiRefuse, []dns.Question{a, aaaa}, true, dns.RcodeRefused, nil},
+		{"refuse axfr", multiRefuse, []dns.Question{axfr, a}, true, dns.RcodeRefused, nil},
+		{"first", multiFirst, []dns.Question{a, aaaa}, false, 0, []dns.Question{a}},
+		{"first axfr", multiFirst, []dns.Question{axfr, a}, false, 0, []dns.Question{axfr}},
+		{"first behind axfr", multiFirst, []dns.Question{a, axfr}, false, 0, []dns.Question{a}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			withMultiQuestion(t, tt.mode)
+			req := new(dns.Msg)
+			req.Id = dns.Id()
+			req.Question = append([]dns.Question(nil), tt.questions...)
+			w := &recordWriter{remote: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}}
+			v := &view{name: "test"}
+			if got := v.multiQuestionAnswered(w, req); got != tt.answered {
+				t.Fatalf("multiQuestionAnswered() = %v, want %v", got, tt.answered)
+			}
+			if !tt.answered {
+				if len(w.msgs) != 0 {
+					t.Fatalf("wrote %d messages, want none", len(w.msgs))
+				}
+				if len(req.Question) != len(tt.remaining) {
+					t.Fatalf("questions left %v, want %v", req.Question, tt.remaining)
+				}
+				for i, q := range req.Question {
+					if q != tt.remaining[i] {
+						t.Errorf("question %d = %v, want %v", i, q, tt.remaining[i])
+					}
+				}
+				return
+			}
+			if len(w.msgs) != 1 {
+				t.Fatalf("wrote %d messages, want 1", len(w.msgs))
+			}
+			if m := w.msgs[0]; m.Rcode != tt.rcode || m.Id != req.Id {
+				t.Errorf("answered %v id %d, want %v id %d", dns.RcodeToString[m.Rcode], m.Id, dns.RcodeToString[tt.rcode], req.Id)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	clientRate = flag.String("client-rate", "",
+		"Maximum UDP queries per second of a client IP, IPv6 clients by /64, with bursts of up to N queries, default 1 (rate[/N])")
+	globalRate = flag.String("global-rate", "",
+		"Maximum UDP queries per second of all clients, with bursts of up to N queries, default 1 (rate[/N])")
+	rateSlip = flag.Int("rate-slip", 2,
+		"Every Nth UDP query over -client-rate or -global-rate is answered empty and truncated for the client to retry over TCP, "+
+			"the others dropped, 0 to drop all")
+	rateExempt = flag.String("rate-exempt", "", "List of clients without -client-rate (cidr,[cidr,...])")
+)
+
+// rateSweepInterval is the interval between removals of the clients back
+// to a full burst, which need no state.
+const rateSweepInterval = time.Minute
+
+// maxRateClients is the most clients whose rate is tracked, so that a flood
+// of spoofed sources cannot grow the table without bound. Beyond, the new
+// clients share a single -client-rate until the next sweep.
+const maxRateClients = 100000
+
+// rateLimit spaces queries by a minimum interval with the generic cell rate
+// algorithm, as pacer, but drops the queries too early instead of waiting.
+type rateLimit struct {
+	interval time.Duration
+	burst    time.Duration // how early a query may be
+}
+
+// allow returns whether a query is allowed at now, given the time due
+// of the next query, which it updates.
+func (l *rateLimit) allow(due *time.Time, now time.Time) bool {
+	if due.Before(now) {
+		*due = now
+	}
+	if due.Sub(now) > l.burst {
+		return false
+	}
+	*due = due.Add(l.interval)
+	return true
+}
+
+// parseRate parses rate[/N] queries per second with a burst of N queries.
+func parseRate(s string) (*rateLimit, error) {
+	rate, burstFlag, hasBurst := strings.Cut(s, "/")
+	qps, err := strconv.ParseFloat(rate, 64)
+	if err != nil || qps <= 0 {
+		return nil, fmt.Errorf("rate must be positive")
+	}
+	burst := 1
+	if hasBurst {
+		if burst, err = strconv.Atoi(burstFlag); err != nil || burst < 1 {
+			return nil, fmt.Errorf("burst must be at least 1")
+		}
+	}
+	interval := time.Duration(float64(time.Second) / qps)
+	return &rateLimit{interval: interval, burst: time.Duration(burst-1) * interval}, nil
+}
+
+var (
+	clientLimit *rateLimit // nil without -client-rate
+	globalLimit *rateLimit // nil without -global-rate
+	exemptRate  []clientNet
+	rateMu      sync.Mutex
+	clientsDue  = make(map[string]time.Time) // by client IP or IPv6 /64
+	overflowDue time.Time                    // of the clients beyond maxRateClients
+	globalDue   time.Time
+	slipCount   atomic.Uint64 // of the queries over the limits, for -rate-slip
+)
+
+// parseRateLimits parses the rate limiting flags and removes the state of
+// the clients within their limit in background.
+func parseRateLimits() error {
+	var err error
+	if *clientRate != "" {
+		if clientLimit, err = parseRate(*clientRate); err != nil {
+			return fmt.Errorf("invalid -client-rate %q: %v", *clientRate, err)
+		}
+	}
+	if *globalRate != "" {
+		if globalLimit, err = parseRate(*globalRate); err != nil {
+			return fmt.Errorf("invalid -global-rate %q: %v", *globalRate, err)
+		}
+	}
+	if *rateSlip < 0 {
+		return fmt.Errorf("invalid -rate-slip %d, must be positive", *rateSlip)
+	}
+	if *rateExempt != "" {
+		if exemptRate, err = parseClientNets(*rateExempt); err != nil {
+			return fmt.Errorf("invalid -rate-exempt: %v", err)
+		}
+	}
+	if clientLimit == nil {
+		return nil
+	}
+	go func() {
+		for range time.Tick(rateSweepInterval) {
+			now := time.Now()
+			rateMu.Lock()
+			for client, due := range clientsDue {
+				if due.Before(now) {
+					delete(clientsDue, client)
+				}
+			}
+			rateMu.Unlock()
+		}
+	}()
+	return nil
+}
+
+// rateKey returns the client whose queries are limited together: its IP,
+// or its /64 for IPv6 as a host usually has a whole prefix.
+func rateKey(ip net.IP) string {
+	if ip.To4() == nil && len(ip) == net.IPv6len {
+		return ip.Mask(net.CIDRMask(64, 128)).String()
+	}
+	return ip.String()
+}
+
+// rateLimited returns whether a UDP query is over -client-rate or
+// -global-rate, having answered it truncated, one in -rate-slip counted in
+// ratelimit.slipped, or dropped it, counted in ratelimit.dropped.
+func (v *view) rateLimited(w dns.ResponseWriter, req *dns.Msg) bool {
+	if clientLimit == nil && globalLimit == nil || w.RemoteAddr().Network() != "udp" {
+		return false
+	}
+	ip := remoteIP(w)
+	now := time.Now()
+	rateMu.Lock()
+	allowed := true
+	if clientLimit != nil && !containsAddr(exemptRate, w.RemoteAddr()) {
+		key := rateKey(ip)
+		if due, ok := clientsDue[key]; ok || len(clientsDue) < maxRateClients {
+			allowed = clientLimit.allow(&due, now)
+			clientsDue[key] = due
+		} else {
+			countMetric("ratelimit.overflow")
+			allowed = clientLimit.allow(&overflowDue, now)
+		}
+	}
+	if allowed && globalLimit != nil {
+		allowed = globalLimit.allow(&globalDue, now)
+	}
+	rateMu.Unlock()
+	if allowed {
+		return false
+	}
+	if n := uint64(*rateSlip); n > 0 && slipCount.Add(1)%n == 0 {
+		countMetric("ratelimit.slipped")
+		m := v.replyMsg(req, dns.RcodeSuccess)
+		m.Truncated = true
+		w.WriteMsg(m)
+		return true
+	}
+	countMetric("ratelimit.dropped")
+	return true
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	blockPrivateAnswers = flag.Bool("block-private-answers", false,
+		"DNS rebinding protection: refuse answers with private, loopback or link-local addresses")
+	privateAnswersAllow = flag.String("private-answers-allow", "",
+		"Domains allowed private answers with -block-private-answers, with their subdomains (domain,...)")
+)
+
+// privateNets are the ranges a public name should not resolve to.
+var privateNets = mustParseCIDRs("0.0.0.0/8,10.0.0.0/8,100.64.0.0/10,127.0.0.0/8,169.254.0.0/16," +
+	"172.16.0.0/12,192.168.0.0/16,::/128,::1/128,fc00::/7,fe80::/10")
+
+func mustParseCIDRs(s string) []*net.IPNet {
+	nets, err := parseCIDRs(s)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
+
+func mustParseClientNets(s string) []clientNet {
+	nets, err := parseClientNets(s)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
+
+// privateAllowed are the internal domains allowed private answers.
+var privateAllowed = make(map[string]bool)
+
+// parsePrivateAnswers parses the -private-answers-allow flag.
+func parsePrivateAnswers() {
+	if *privateAnswersAllow == "" {
+		return
+	}
+	for _, domain := range strings.Split(*privateAnswersAllow, ",") {
+		privateAllowed[routeDomain(strings.TrimPrefix(domain, "."))] = true
+	}
+}
+
+// rebindChecked returns whether the answers to q are checked for private
+// addresses by -block-private-answers.
+func rebindChecked(q dns.Question) bool {
+	return *blockPrivateAnswers && !domainListed(privateAllowed, normalizeName(q.Name))
+}
+
+// rebindBlocked returns whether resp to req has a private address and is
+// refused by -block-private-answers, logging it.
+func rebindBlocked(w dns.ResponseWriter, req, resp *dns.Msg) bool {
+	q := req.Question[0]
+	if !rebindChecked(q) {
+		return false
+	}
+	for _, rr := range resp.Answer {
+		if ip := answerIP(rr); ip != nil && containsIP(privateNets, ip) {
+			logf("rebind: %s %s from %s answered %v, refused", displayName(q.Name), dns.TypeToString[q.Qtype], clientLabel(w, req), ip)
+			return true
+		}
+	}
+	return false
+}
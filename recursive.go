@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	recursive = flag.Bool("recursive", false,
+		"Resolve iteratively from the root servers the queries of views without default server")
+	rootHints = flag.String("root-hints", strings.Join(ianaRoots, ","),
+		"Root servers to start iterative resolution from (ip[:port],...)")
+)
+
+// ianaRoots are the IPv4 addresses of the root servers a to m.
+var ianaRoots = []string{
+	"198.41.0.4", "170.247.170.2", "192.33.4.12", "199.7.91.13", "192.203.230.10",
+	"192.5.5.241", "192.112.36.4", "198.97.190.53", "192.36.148.17", "192.58.128.30",
+	"193.0.14.129", "199.7.83.42", "202.12.27.33",
+}
+
+// Limits of iterative resolution.
+const (
+	maxReferrals = 16 // delegations followed for a name
+	maxCNAMEs    = 8  // aliases followed for a query
+	maxNSDepth   = 4  // nested resolutions of name server addresses
+)
+
+// maxDelegations is the number of referrals and name server addresses kept
+// by iterative resolution, from the root servers or in a stub zone.
+const maxDelegations = 10000
+
+var errLameDelegation = errors.New("referral not closer to the name")
+
+// rootDelegations are the referrals and name server addresses followed
+// from the root servers.
+var rootDelegations = newResponseStore(maxDelegations)
+
+// recursiveRoute returns the route resolving iteratively.
+func recursiveRoute() *routeEntry {
+	return &routeEntry{recursive: true, retries: newRetryBudget(*retryBudgetRatio)}
+}
+
+// roots returns the -root-hints as host:port.
+func roots() ([]string, error) {
+	var servers []string
+	for _, s := range strings.Split(*rootHints, ",") {
+		if net.ParseIP(s) != nil {
+			s = net.JoinHostPort(s, "53")
+		}
+		if !validHostPort(s) {
+			return nil, fmt.Errorf("invalid -root-hints %v, must be ip[:port]", s)
+		}
+		servers = append(servers, s)
+	}
+	return servers, nil
+}
+
+// resolve answers req by iterative resolution, following aliases, from the
+// root servers or from the name servers of stub if not nil, only following
+// the aliases within its zone.
+func resolve(ctx context.Context, stub *stubZone, req *dns.Msg) (*dns.Msg, error) {
+	q := req.Question[0]
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.RecursionAvailable = true
+	if opt := req.IsEdns0(); opt != nil {
+		m.SetEdns0(dns.DefaultMsgSize, false)
+	}
+	name := q.Name
+	for i := 0; ; i++ {
+		if i == maxCNAMEs {
+			return nil, fmt.Errorf("more than %d aliases for %v", maxCNAMEs, q.Name)
+		}
+		var resp *dns.Msg
+		var err error
+		if stub != nil {
+			resp, err = stub.iterate(ctx, name, q.Qtype, 0)
+		} else {
+			resp, err = iterate(ctx, name, q.Qtype, 0)
+		}
+		if err != nil {
+			return nil, err
+		}
+		m.Rcode = resp.Rcode
+		target, answered := "", false
+		for _, rr := range resp.Answer {
+			h := rr.Header()
+			if !strings.EqualFold(h.Name, name) {
+				continue // not in the alias chain
+			}
+			m.Answer = append(m.Answer, rr)
+			if h.Rrtype == q.Qtype {
+				answered = true
+			}
+			if cname, ok := rr.(*dns.CNAME); ok {
+				target = cname.Target
+			}
+		}
+		if answered || target == "" || q.Qtype == dns.TypeCNAME || stub != nil && !dns.IsSubDomain(stub.zone, target) {
+			if len(m.Answer) == 0 {
+				// SOA of negative answers, for caching
+				for _, rr := range resp.Ns {
+					if soa, ok := rr.(*dns.SOA); ok && dns.IsSubDomain(soa.Hdr.Name, name) {
+						m.Ns = append(m.Ns, soa)
+					}
+				}
+			}
+			return m, nil
+		}
+		name = target
+	}
+}
+
+// iterate follows the delegations from the root to the servers of name and
+// returns their response for name and qtype.
+func iterate(ctx context.Context, name string, qtype uint16, depth int) (*dns.Msg, error) {
+	servers, err := roots()
+	if err != nil {
+		return nil, err
+	}
+	return iterateFrom(ctx, nil, ".", servers, name, qtype, depth)
+}
+
+// iterateFrom follows the delegations from the servers of zone, those of
+// stub or else the root servers resolving the addresses of name servers.
+// It starts from the closest delegation kept for name, and keeps those it
+// follows for their TTL.
+func iterateFrom(ctx context.Context, stub *stubZone, zone string, servers []string, name string, qtype uint16, depth int) (*dns.Msg, error) {
+	store := delegationStore(stub)
+	if child, addrs := cachedDelegation(ctx, stub, zone, name, depth); child != "" {
+		zone, servers = child, addrs
+	}
+	for i := 0; i < maxReferrals; i++ {
+		resp, err := queryServers(ctx, servers, name, qtype)
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Answer) > 0 || resp.Rcode != dns.RcodeSuccess {
+			return resp, nil
+		}
+		child, nsNames := referral(resp)
+		if len(nsNames) == 0 {
+			return resp, nil // no data
+		}
+		if child == zone || !dns.IsSubDomain(zone, child) || !dns.IsSubDomain(child, name) {
+			return nil, errLameDelegation
+		}
+		zone = child
+		if ttl, ok := responseTTL(resp); ok {
+			store.put(delegationKey(zone), resp, ttl)
+		}
+		if len(glue(resp, nsNames)) == 0 && depth == maxNSDepth {
+			return nil, fmt.Errorf("name servers of %v nested too deep", zone)
+		}
+		servers = nameServerAddrs(ctx, stub, resp, nsNames, depth)
+		if len(servers) == 0 {
+			return nil, fmt.Errorf("no address for the name servers of %v", zone)
+		}
+	}
+	return nil, fmt.Errorf("more than %d referrals for %v", maxReferrals, name)
+}
+
+// delegationStore returns the referrals and name server addresses kept
+// when following the delegations from the name servers of stub, or from
+// the root servers if nil.
+func delegationStore(stub *stubZone) *responseStore {
+	if stub != nil {
+		return stub.delegations
+	}
+	return rootDelegations
+}
+
+// delegationKey returns the key of the referral to zone in a store.
+func delegationKey(zone string) storeKey {
+	return questionKey(dns.Question{Name: zone, Qtype: dns.TypeNS, Qclass: dns.ClassINET})
+}
+
+// cachedDelegation returns the closest zone of name below zone whose
+// referral is kept, with the addresses of its name servers, "" if none.
+func cachedDelegation(ctx context.Context, stub *stubZone, zone, name string, depth int) (string, []string) {
+	store := delegationStore(stub)
+	zone = dns.CanonicalName(zone)
+	for child := dns.CanonicalName(name); child != zone && dns.IsSubDomain(zone, child); {
+		req := new(dns.Msg)
+		req.SetQuestion(child, dns.TypeNS)
+		if resp := store.get(delegationKey(child), req); resp != nil {
+			_, nsNames := referral(resp)
+			if servers := nameServerAddrs(ctx, stub, resp, nsNames, depth); len(servers) > 0 {
+				return child, servers
+			}
+		}
+		next, end := dns.NextLabel(child, 0)
+		if end {
+			break
+		}
+		child = child[next:]
+	}
+	return "", nil
+}
+
+// nameServerAddrs returns the addresses of the name servers of a referral:
+// its glue, or else the addresses of the first name server resolved, kept
+// for their TTL.
+func nameServerAddrs(ctx context.Context, stub *stubZone, resp *dns.Msg, nsNames []string, depth int) []string {
+	if servers := glue(resp, nsNames); len(servers) > 0 {
+		return servers
+	}
+	if depth == maxNSDepth {
+		return nil
+	}
+	store := delegationStore(stub)
+	for _, ns := range nsNames {
+		req := new(dns.Msg)
+		req.SetQuestion(ns, dns.TypeA)
+		key := questionKey(req.Question[0])
+		addrs := store.get(key, req)
+		if addrs == nil {
+			var err error
+			if stub != nil && dns.IsSubDomain(stub.zone, ns) {
+				addrs, err = stub.iterate(ctx, ns, dns.TypeA, depth+1)
+			} else {
+				addrs, err = iterate(ctx, ns, dns.TypeA, depth+1)
+			}
+			if err != nil {
+				continue
+			}
+			if ttl, ok := responseTTL(addrs); ok {
+				store.put(key, addrs, ttl)
+			}
+		}
+		var servers []string
+		for _, rr := range addrs.Answer {
+			if a, ok := rr.(*dns.A); ok && dns.CanonicalName(a.Hdr.Name) == ns {
+				servers = append(servers, net.JoinHostPort(a.A.String(), "53"))
+			}
+		}
+		if len(servers) > 0 {
+			return servers
+		}
+	}
+	return nil
+}
+
+// referral returns the delegated zone and its name servers of a response.
+func referral(resp *dns.Msg) (string, []string) {
+	zone := ""
+	var names []string
+	for _, rr := range resp.Ns {
+		if ns, ok := rr.(*dns.NS); ok {
+			zone = dns.CanonicalName(ns.Hdr.Name)
+			names = append(names, dns.CanonicalName(ns.Ns))
+		}
+	}
+	return zone, names
+}
+
+// glue returns the addresses of the name servers given in a referral.
+func glue(resp *dns.Msg, nsNames []string) []string {
+	var servers []string
+	for _, rr := range resp.Extra {
+		a, ok := rr.(*dns.A)
+		if !ok {
+			continue
+		}
+		for _, name := range nsNames {
+			if dns.CanonicalName(a.Hdr.Name) == name {
+				servers = append(servers, net.JoinHostPort(a.A.String(), "53"))
+			}
+		}
+	}
+	return servers
+}
+
+// queryServers asks the servers of a zone in random order until one
+// answers or ctx is done, retrying over TCP when truncated.
+func queryServers(ctx context.Context, servers []string, name string, qtype uint16) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(name, qtype)
+	req.RecursionDesired = false
+	req.SetEdns0(1232, false)
+	var err error
+	for _, i := range rand.Perm(len(servers)) {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		c := &dns.Client{Timeout: 2 * time.Second}
+		var resp *dns.Msg
+		resp, _, err = c.ExchangeContext(ctx, req, servers[i])
+		if err == nil && resp.Truncated {
+			c.Net = "tcp"
+			resp, _, err = c.ExchangeContext(ctx, req, servers[i])
+		}
+		if err == nil && resp.Rcode != dns.RcodeServerFailure && resp.Rcode != dns.RcodeRefused {
+			return resp, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("%v answered %v", servers[i], dns.RcodeToString[resp.Rcode])
+		}
+	}
+	return nil, err
+}
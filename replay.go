@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	recordFile = flag.String("record", "",
+		"File where to record upstream responses for later -replay")
+	replayFile = flag.String("replay", "",
+		"File of recorded responses to answer from, without querying any upstream")
+)
+
+// A recording has one line per response: qname qtype base64(wire message).
+// The name may have escaped spaces, so the message is after the last space,
+// and it is keyed by its own question when loaded.
+
+// recorder appends upstream responses to the -record file.
+type recorder struct {
+	sync.Mutex
+	f *os.File
+}
+
+var (
+	recording *recorder
+	replaying map[string]*dns.Msg // by recordKey
+)
+
+func recordKey(name string, qtype uint16) string {
+	return normalizeName(name) + " " + dns.Type(qtype).String()
+}
+
+func openRecorder(path string) (*recorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &recorder{f: f}, nil
+}
+
+// record appends the response to a question to the recording.
+func (r *recorder) record(resp *dns.Msg) error {
+	if len(resp.Question) == 0 {
+		return nil
+	}
+	b, err := resp.Pack()
+	if err != nil {
+		return err
+	}
+	q := resp.Question[0]
+	r.Lock()
+	defer r.Unlock()
+	_, err = fmt.Fprintf(r.f, "%s %s\n", recordKey(q.Name, q.Qtype), base64.StdEncoding.EncodeToString(b))
+	return err
+}
+
+// loadReplay reads a recording, later responses to a question replace earlier.
+func loadReplay(path string) (map[string]*dns.Msg, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	responses := make(map[string]*dns.Msg)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 4*dns.MaxMsgSize)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			return nil, fmt.Errorf("%v:%d: invalid recording", path, n)
+		}
+		b, err := base64.StdEncoding.DecodeString(line[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("%v:%d: %v", path, n, err)
+		}
+		m := new(dns.Msg)
+		if err := m.Unpack(b); err != nil {
+			return nil, fmt.Errorf("%v:%d: %v", path, n, err)
+		}
+		if len(m.Question) == 0 {
+			return nil, fmt.Errorf("%v:%d: recorded response without question", path, n)
+		}
+		responses[recordKey(m.Question[0].Name, m.Question[0].Qtype)] = m
+	}
+	return responses, scanner.Err()
+}
+
+// replay returns the recorded response to req, nil if none.
+func replay(req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	m, ok := replaying[recordKey(q.Name, q.Qtype)]
+	if !ok {
+		return nil
+	}
+	resp := m.Copy()
+	resp.Id = req.Id
+	resp.Question = req.Question
+	return resp
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+)
+
+var (
+	retryBudgetRatio = flag.Float64("retry-budget", 0,
+		"Retries of the queries of each route to its other backends, or after a SERVFAIL, allowed as a share of its queries, "+
+			"e.g. 0.2 for at most 20% extra load, 0 for unlimited")
+	routeRetryBudgets flagStringList
+)
+
+func init() {
+	flag.Var(&routeRetryBudgets, "route-retry-budget", "Retry budget of a route, instead of -retry-budget ([view/]domain=ratio)")
+}
+
+// retryBudgetBurst is the number of retries a route may make beyond its
+// budget, so that routes with little traffic can still retry, and the most
+// retries saved by its queries.
+const retryBudgetBurst = 10
+
+// retryBudget is the retries a route may make, earned by its queries and
+// shared by all of them.
+type retryBudget struct {
+	sync.Mutex
+	ratio  float64
+	tokens float64
+}
+
+// newRetryBudget returns a retry budget of ratio, nil for 0 as unlimited.
+// A route keeps its budget when reloaded, its copies sharing it.
+func newRetryBudget(ratio float64) *retryBudget {
+	if ratio == 0 {
+		return nil
+	}
+	return &retryBudget{ratio: ratio, tokens: retryBudgetBurst}
+}
+
+// parseRetryBudget checks -retry-budget and applies -route-retry-budget to
+// the routes.
+func parseRetryBudget() error {
+	if *retryBudgetRatio < 0 || math.IsNaN(*retryBudgetRatio) || math.IsInf(*retryBudgetRatio, 0) {
+		return fmt.Errorf("invalid -retry-budget %v, must be positive or 0", *retryBudgetRatio)
+	}
+	return setRouteOption("route-retry-budget", routeRetryBudgets, func(r *routeEntry, s string) error {
+		ratio, err := strconv.ParseFloat(s, 64)
+		if err != nil || ratio < 0 || math.IsNaN(ratio) || math.IsInf(ratio, 0) {
+			return fmt.Errorf("invalid ratio %q, must be positive or 0", s)
+		}
+		r.retries = newRetryBudget(ratio)
+		return nil
+	})
+}
+
+// query earns the retries of a query of the route.
+func (b *retryBudget) query() {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.tokens = min(b.tokens+b.ratio, retryBudgetBurst)
+}
+
+// retry returns whether the route may retry a query, spending one retry,
+// or counts it in the retry_budget.exhausted metric.
+func (b *retryBudget) retry() bool {
+	if b == nil {
+		return true
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.tokens < 1 {
+		countMetric("retry_budget.exhausted")
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// domainMatch matches names by suffix like the -route flags or, for zones,
+// only the domain itself and its subdomains.
+type domainMatch struct {
+	domain string // normalized
+	zone   bool
+}
+
+// matches returns whether a normalized name matches.
+func (d domainMatch) matches(name string) bool {
+	if d.zone {
+		return name == d.domain || strings.HasSuffix(name, "."+d.domain)
+	}
+	return strings.HasSuffix(name, d.domain)
+}
+
+// routeEntry is where queries for a domain are sent to.
+type routeEntry struct {
+	domainMatch
+	priority int // higher is evaluated first
+	backends []string
+	tsig     *tsigKey // optional
+	fallback bool     // to the default route when all backends fail
+	fault    *faultInjection
+	delay    time.Duration // before writing the response
+	// recursive resolves iteratively instead of forwarding to backends.
+	recursive bool
+	stub      *stubZone // resolves from its name servers, optional
+	tag       string    // metrics and logging label, e.g. team=payments
+	// answerFilter filters the answers by address, optional.
+	answerFilter *answerFilter
+	// escalate are the transports to try in order, nil for the one of
+	// the client.
+	escalate []string
+	// transport is the one of the queries to the backends, "" for the one
+	// of the client.
+	transport string
+	// blackout are the times when the route only answers from the
+	// responses it kept, optional.
+	blackout *blackout
+	alerts   []*alert // on the share of an rcode of the responses
+	// balancing orders the backends, nil for -lb.
+	balancing *balancing
+	pool      *pool        // the backends are of this pool, optional
+	ecs       *ecsPrefix   // client subnet sent, nil for -ecs
+	retries   *retryBudget // of -route-retry-budget or -retry-budget, nil if unlimited
+}
+
+var (
+	routeTSIGs     flagStringList
+	routeFallbacks flagStringList
+	routeDelays    flagStringList
+	routeExcepts   flagStringList
+	routePriority  flagStringList
+	routeTags      flagStringList
+)
+
+func init() {
+	flag.Var(&routeFallbacks, "route-fallback", "Route trying the default server when all its backends fail ([view/]domain)")
+	flag.Var(&routeTSIGs, "route-tsig", "TSIG key to sign all queries of a route with, or the name of a -tsig-keys key ([view/]domain=[algorithm:]name:secret|name)")
+	flag.Var(&routeExcepts, "route-except", "Domain falling through to the default server even if a route matches ([view/]domain)")
+	flag.Var(&routePriority, "route-priority", "Priority of a route, higher first, default 0 ([view/]domain=N)")
+	flag.Var(&routeDelays, "route-delay", "Artificial delay before answering queries of a route ([view/]domain=duration)")
+	flag.Var(&routeTags, "route-tag", "Tag of a route in metrics and logs, e.g. team=payments ([view/]domain=tag)")
+}
+
+// parseRoute parses a route flag: domain=host:port,[host:port,...] or
+// domain=pool:name.
+func parseRoute(s string) (string, *routeEntry, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return "", nil, fmt.Errorf("must be domain=host:port,[host:port,...]")
+	}
+	if strings.HasPrefix(parts[1], poolPrefix) {
+		r, err := poolRoute(parts[1])
+		if err != nil {
+			return "", nil, err
+		}
+		r.domain = routeDomain(parts[0])
+		return r.domain, r, nil
+	}
+	var backends []string
+	for _, backend := range strings.Split(parts[1], ",") {
+		if !validBackend(backend) {
+			return "", nil, fmt.Errorf("invalid host:port or unix:/path for %v", backend)
+		}
+		backends = append(backends, backend)
+	}
+	domain := routeDomain(parts[0])
+	return domain, &routeEntry{
+		domainMatch: domainMatch{domain: domain},
+		backends:    backends,
+		retries:     newRetryBudget(*retryBudgetRatio),
+	}, nil
+}
+
+// findRoute returns the route of a per-route flag key: [view/]domain.
+func findRoute(key string) (*routeEntry, error) {
+	name, domain := "", key
+	if s := strings.SplitN(key, "/", 2); len(s) == 2 {
+		name, domain = s[0], s[1]
+	}
+	v, ok := views[name]
+	if !ok {
+		return nil, fmt.Errorf("no -view %v", name)
+	}
+	r, ok := v.routes[routeDomain(domain)]
+	if !ok {
+		return nil, fmt.Errorf("no route for %v", key)
+	}
+	return r, nil
+}
+
+// setRouteOption applies a per-route flag: [view/]domain=value.
+func setRouteOption(name string, values flagStringList, set func(r *routeEntry, value string) error) error {
+	for _, value := range values {
+		s := strings.SplitN(value, "=", 2)
+		if len(s) != 2 || len(s[0]) == 0 || len(s[1]) == 0 {
+			return fmt.Errorf("invalid -%v %q, must be [view/]domain=value", name, value)
+		}
+		r, err := findRoute(s[0])
+		if err != nil {
+			return fmt.Errorf("invalid -%v: %v", name, err)
+		}
+		if err := set(r, s[1]); err != nil {
+			return fmt.Errorf("invalid -%v for %v: %v", name, s[0], err)
+		}
+	}
+	return nil
+}
+
+// parseRouteOptions applies the per-route flags to the routes of all views.
+func parseRouteOptions() error {
+	for _, routeExcept := range routeExcepts {
+		name, domain := "", routeExcept
+		if s := strings.SplitN(routeExcept, "/", 2); len(s) == 2 {
+			name, domain = s[0], s[1]
+		}
+		v, ok := views[name]
+		if !ok || domain == "" {
+			return fmt.Errorf("invalid -route-except %q, no -view %v or empty domain", routeExcept, name)
+		}
+		v.addException(domain)
+	}
+	for _, routeFallback := range routeFallbacks {
+		r, err := findRoute(routeFallback)
+		if err != nil {
+			return fmt.Errorf("invalid -route-fallback: %v", err)
+		}
+		r.fallback = true
+	}
+	if err := setRouteOption("route-tsig", routeTSIGs, func(r *routeEntry, s string) (err error) {
+		r.tsig, err = keyFlag(s)
+		return err
+	}); err != nil {
+		return err
+	}
+	if err := setRouteOption("route-priority", routePriority, func(r *routeEntry, s string) (err error) {
+		r.priority, err = strconv.Atoi(s)
+		return err
+	}); err != nil {
+		return err
+	}
+	if err := setRouteOption("route-delay", routeDelays, func(r *routeEntry, s string) (err error) {
+		r.delay, err = time.ParseDuration(s)
+		return err
+	}); err != nil {
+		return err
+	}
+	if err := setRouteOption("route-tag", routeTags, func(r *routeEntry, s string) error {
+		r.tag = s
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := setRouteOption("answer-filter", answerFilters, func(r *routeEntry, s string) (err error) {
+		r.answerFilter, err = parseAnswerFilter(s)
+		return err
+	}); err != nil {
+		return err
+	}
+	if err := setRouteOption("route-escalate", routeEscalations, func(r *routeEntry, s string) (err error) {
+		r.escalate, err = parseEscalation(s)
+		return err
+	}); err != nil {
+		return err
+	}
+	if err := setRouteOption("route-transport", routeTransports, func(r *routeEntry, s string) (err error) {
+		r.transport, err = parseRouteTransport(r, s)
+		return err
+	}); err != nil {
+		return err
+	}
+	if err := setRouteOption("route-blackout", routeBlackouts, func(r *routeEntry, s string) (err error) {
+		r.blackout, err = parseBlackout(s)
+		return err
+	}); err != nil {
+		return err
+	}
+	if err := setRouteOption("route-alert", routeAlerts, func(r *routeEntry, s string) error {
+		a, err := parseAlert(r, s)
+		if err != nil {
+			return err
+		}
+		r.alerts = append(r.alerts, a)
+		alerts = append(alerts, a)
+		return nil
+	}); err != nil {
+		return err
+	}
+	return setRouteOption("test-fault", routeFaults, func(r *routeEntry, s string) (err error) {
+		if r.fault, err = parseFault(s); err == nil {
+			log.Printf("WARNING: fault injection enabled, for testing only")
+		}
+		return err
+	})
+}
+
+// sortRoutes orders the routes of v for matching, deterministically:
+// by descending priority, then longest domain first so that the most
+// specific route wins, then alphabetically.
+func (v *view) sortRoutes() {
+	v.order = v.order[:0]
+	for _, r := range v.routes {
+		v.order = append(v.order, r)
+	}
+	sort.Slice(v.order, func(i, j int) bool {
+		a, b := v.order[i], v.order[j]
+		if a.priority != b.priority {
+			return a.priority > b.priority
+		}
+		if len(a.domain) != len(b.domain) {
+			return len(a.domain) > len(b.domain)
+		}
+		return a.domain < b.domain
+	})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	routesTXT = flag.String("routes-txt", "",
+		"Answer TXT queries for this name, e.g. routes.proxy.internal, with the routing table of all views, "+
+			"page N at N.name, to the clients of -routes-txt-allow")
+	routesTXTAllow = flag.String("routes-txt-allow", "127.0.0.1,::1",
+		"List of clients allowed to query -routes-txt (cidr,[cidr,...])")
+)
+
+// routesTXTPage is the number of lines of the routing table per page, each
+// a TXT record after the one describing the page.
+const routesTXTPage = 20
+
+var (
+	routesTXTName   string // normalized -routes-txt, empty if off
+	routesTXTIPNets []*net.IPNet
+)
+
+// parseRoutesTXT parses the -routes-txt flags.
+func parseRoutesTXT() error {
+	if *routesTXT == "" {
+		return nil
+	}
+	nets, err := parseCIDRs(*routesTXTAllow)
+	if err != nil {
+		return fmt.Errorf("invalid -routes-txt-allow: %v", err)
+	}
+	routesTXTName = routeDomain(*routesTXT)
+	routesTXTIPNets = nets
+	return nil
+}
+
+// routesTXTQuery returns the page of the routing table req asks for, and
+// whether it is a name of -routes-txt at all: the name itself for the first
+// page, N.name for page N, anything else under it not being a page.
+func routesTXTQuery(req *dns.Msg) (page int, ok bool) {
+	if routesTXTName == "" {
+		return 0, false
+	}
+	name := normalizeName(req.Question[0].Name)
+	if name == routesTXTName {
+		return 1, true
+	}
+	prefix, ok := strings.CutSuffix(name, "."+routesTXTName)
+	if !ok {
+		return 0, false
+	}
+	page, err := strconv.Atoi(prefix)
+	if err != nil || page < 1 {
+		return 0, true
+	}
+	return page, true
+}
+
+// answerRoutesTXT answers the queries for -routes-txt names: REFUSED to the
+// clients not in -routes-txt-allow, NXDOMAIN past the last page, and for
+// TXT a first record "generation G page N of M" followed by one record per
+// line of the routing table, as listed by the routes console command with
+// the view in front. It returns whether req was answered.
+func (v *view) answerRoutesTXT(w dns.ResponseWriter, req *dns.Msg) bool {
+	page, ok := routesTXTQuery(req)
+	if !ok {
+		return false
+	}
+	if !containsIP(routesTXTIPNets, remoteIP(w)) {
+		countMetric("routes_txt.refused")
+		v.refuse(w, req)
+		return true
+	}
+	var lines []string
+	for _, name := range viewNames() {
+		for _, line := range views[name].live().routeTable() {
+			lines = append(lines, fmt.Sprintf("view %q: %v", name, line))
+		}
+	}
+	pages := (len(lines) + routesTXTPage - 1) / routesTXTPage
+	if page < 1 || page > pages {
+		v.reply(w, req, dns.RcodeNameError)
+		return true
+	}
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+	q := req.Question[0]
+	if q.Qtype == dns.TypeTXT || q.Qtype == dns.TypeANY {
+		lines = lines[(page-1)*routesTXTPage : min(page*routesTXTPage, len(lines))]
+		lines = append([]string{fmt.Sprintf("generation %d page %d of %d", configGeneration.Load(), page, pages)}, lines...)
+		for _, line := range lines {
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET},
+				Txt: splitTXT(line),
+			})
+		}
+	}
+	if w.RemoteAddr().Network() == "udp" {
+		m.Truncate(udpSize(req))
+	}
+	countMetric("routes_txt.answered")
+	w.WriteMsg(m)
+	return true
+}
+
+// splitTXT splits s in TXT strings of at most 255 bytes.
+func splitTXT(s string) []string {
+	var chunks []string
+	for len(s) > 255 {
+		chunks = append(chunks, s[:255])
+		s = s[255:]
+	}
+	return append(chunks, s)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+var selfTest = flag.Bool("selftest", false,
+	"Run queries through the proxy against a built-in mock upstream, report and exit")
+
+// selfTestZone is the zone served by the mock upstream.
+const selfTestZone = "selftest.example."
+
+// mockUpstream answers A queries under selfTestZone with one record, or
+// many for big.selfTestZone, and serves a small zone transfer.
+func mockUpstream(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	q := req.Question[0]
+	soa := &dns.SOA{Hdr: dns.RR_Header{Name: selfTestZone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+		Ns: "ns." + selfTestZone, Mbox: "hostmaster." + selfTestZone, Serial: 1,
+		Refresh: 60, Retry: 60, Expire: 60, Minttl: 60}
+	a := func(name string, i int) dns.RR {
+		return &dns.A{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A: net.IPv4(192, 0, 2, byte(i))}
+	}
+	switch {
+	case q.Qtype == dns.TypeAXFR:
+		ch := make(chan *dns.Envelope, 1)
+		ch <- &dns.Envelope{RR: []dns.RR{soa, a("www."+selfTestZone, 1), soa}}
+		close(ch)
+		new(dns.Transfer).Out(w, req, ch)
+		return
+	case q.Name == "big."+selfTestZone:
+		for i := 1; i <= 100; i++ {
+			m.Answer = append(m.Answer, a(q.Name, i))
+		}
+	default:
+		m.Answer = append(m.Answer, a(q.Name, 1))
+	}
+	size := dns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil {
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		size = int(opt.UDPSize())
+	}
+	if w.LocalAddr().Network() == "udp" {
+		m.Truncate(size)
+	}
+	w.WriteMsg(m)
+}
+
+// serveLocal serves handler on UDP and TCP on a random loopback port.
+func serveLocal(handler dns.Handler) (string, func(), error) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	addr := pc.LocalAddr().String()
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		return "", nil, err
+	}
+	udp := &dns.Server{PacketConn: pc, Handler: handler}
+	tcp := &dns.Server{Listener: l, Handler: handler}
+	go udp.ActivateAndServe()
+	go tcp.ActivateAndServe()
+	return addr, func() {
+		udp.Shutdown()
+		tcp.Shutdown()
+	}, nil
+}
+
+// runSelfTest sends a battery of queries through a listener using the real
+// routing path to the mock upstream and reports whether they all passed.
+func runSelfTest() bool {
+	upstreamAddr, stopUpstream, err := serveLocal(dns.HandlerFunc(mockUpstream))
+	if err != nil {
+		fmt.Println("FAIL: mock upstream:", err)
+		return false
+	}
+	defer stopUpstream()
+	v := &view{
+		routes:       map[string]*routeEntry{},
+		defaultRoute: defaultRoute(upstreamAddr),
+		transferNets: mustParseClientNets("127.0.0.1"),
+	}
+	proxyAddr, stopProxy, err := serveLocal(v.handler())
+	if err != nil {
+		fmt.Println("FAIL: proxy listener:", err)
+		return false
+	}
+	defer stopProxy()
+
+	query := func(transport, name string, qtype uint16, edns bool) (*dns.Msg, error) {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		if edns {
+			m.SetEdns0(dns.DefaultMsgSize, false)
+		}
+		c := &dns.Client{Net: transport}
+		resp, _, err := c.Exchange(m, proxyAddr)
+		return resp, err
+	}
+	tests := []struct {
+		name string
+		run  func() error
+	}{
+		{"UDP", func() error {
+			resp, err := query("udp", "www."+selfTestZone, dns.TypeA, false)
+			return expectAnswers(resp, err, 1)
+		}},
+		{"TCP", func() error {
+			resp, err := query("tcp", "www."+selfTestZone, dns.TypeA, false)
+			return expectAnswers(resp, err, 1)
+		}},
+		{"truncation", func() error {
+			resp, err := query("udp", "big."+selfTestZone, dns.TypeA, false)
+			if err != nil {
+				return err
+			}
+			if !resp.Truncated {
+				return fmt.Errorf("TC not set on %d bytes response", resp.Len())
+			}
+			resp, err = query("tcp", "big."+selfTestZone, dns.TypeA, false)
+			return expectAnswers(resp, err, 100)
+		}},
+		{"EDNS", func() error {
+			resp, err := query("udp", "www."+selfTestZone, dns.TypeA, true)
+			if err := expectAnswers(resp, err, 1); err != nil {
+				return err
+			}
+			if resp.IsEdns0() == nil {
+				return fmt.Errorf("no OPT record in response")
+			}
+			return nil
+		}},
+		{"AXFR", func() error {
+			m := new(dns.Msg)
+			m.SetAxfr(selfTestZone)
+			ch, err := new(dns.Transfer).In(m, proxyAddr)
+			if err != nil {
+				return err
+			}
+			var n int
+			for env := range ch {
+				if env.Error != nil {
+					return env.Error
+				}
+				n += len(env.RR)
+			}
+			if n != 3 {
+				return fmt.Errorf("got %d records, want 3", n)
+			}
+			return nil
+		}},
+	}
+	ok := true
+	for _, tt := range tests {
+		if err := tt.run(); err != nil {
+			fmt.Printf("FAIL: %s: %v\n", tt.name, err)
+			ok = false
+			continue
+		}
+		fmt.Printf("PASS: %s\n", tt.name)
+	}
+	return ok
+}
+
+func expectAnswers(resp *dns.Msg, err error, n int) error {
+	if err != nil {
+		return err
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("rcode %v", dns.RcodeToString[resp.Rcode])
+	}
+	if len(resp.Answer) != n {
+		return fmt.Errorf("got %d answers, want %d", len(resp.Answer), n)
+	}
+	return nil
+}
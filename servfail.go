@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+var servfailAction = flag.String("servfail", servfailRelay,
+	"SERVFAIL from a backend: relay it to the client, or retry on the next backend, again on the only "+
+		"backend of a route, relaying the last SERVFAIL when all answer it (relay|retry)")
+
+// SERVFAIL actions.
+const (
+	servfailRelay = "relay" // answer the client with it
+	servfailRetry = "retry" // as a failure of the backend
+)
+
+var errServfail = errors.New("SERVFAIL")
+
+// parseServfail checks -servfail.
+func parseServfail() error {
+	switch *servfailAction {
+	case servfailRelay, servfailRetry:
+		return nil
+	}
+	return fmt.Errorf("invalid -servfail %v, must be relay or retry", *servfailAction)
+}
+
+// retryServfail returns whether a response with rcode from the backend at
+// addr is retried, counting the SERVFAIL retried.
+func retryServfail(addr string, rcode int) bool {
+	if rcode != dns.RcodeServerFailure || *servfailAction != servfailRetry {
+		return false
+	}
+	countMetric(metricName("upstream", addr, "servfail"))
+	return true
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	sinkLists flagStringList
+	logFormat = flag.String("log-format", "none",
+		"Format of the log of all queries written to -log-file: json, text, passivedns or none, a -log-sink without filters")
+	logFile = flag.String("log-file", "-", "File of the -log-format log, - for stdout, reopened when rotated")
+)
+
+func init() {
+	flag.Var(&sinkLists, "log-sink", "Additional log of the forwarded, blocked and failed queries, each with its own filters "+
+		"(format=json|text|passivedns|dnstap output=path|-|unix:/path [blocked] [rcode=RCODE,...] [route=[view/]domain,...] "+
+		"[client=cidr,...] [name=domain,...])")
+}
+
+// Log sink formats.
+const (
+	sinkJSON       = "json"       // one object per line, e.g. for a SIEM
+	sinkText       = "text"       // a query per line, as -log-queries
+	sinkPassiveDNS = "passivedns" // answers aggregated over -passivedns-window
+	sinkDnstap     = "dnstap"     // frame streams of client responses
+)
+
+// sinkReopenInterval is the interval between checks of whether the file
+// of a sink was rotated, e.g. by logrotate, to reopen it.
+const sinkReopenInterval = 10 * time.Second
+
+// sinkBuffer is the number of queries waiting to be written to a sink,
+// queries beyond are dropped so that a slow sink does not slow queries.
+const sinkBuffer = 1024
+
+// sinkEvent is a query answered to a client.
+type sinkEvent struct {
+	time      time.Time
+	client    net.Addr
+	server    net.Addr
+	view      string // name of the view which answered
+	clientID  string
+	req, resp *dns.Msg
+	route     *routeEntry // nil if not forwarded
+	upstream  string
+	cached    bool
+	blocked   string // what blocked the query, "" if not blocked
+}
+
+// sink writes the queries matching its filters in a format.
+type sink struct {
+	text    string // as configured, for logging
+	format  string
+	output  string
+	blocked bool // only blocked queries
+	rcodes  map[int]bool
+	routes  map[sinkRoute]bool
+	clients []*net.IPNet
+	names   []domainMatch
+
+	passive *passiveLog // of the passivedns format
+
+	events  chan *sinkEvent
+	flush   chan chan struct{}
+	dropped string // metric of the queries dropped
+}
+
+// sinkRoute is a route of a route filter, by view and domain rather than
+// by entry as a reload replaces the entries of the routes it changes.
+type sinkRoute struct {
+	view, domain string
+}
+
+var sinks []*sink
+
+// parseSinks parses the -log-sink flags, after the routes, and the sinks
+// without filters of -log-queries, -passivedns and -log-format, and starts
+// writing to them in background.
+func parseSinks() error {
+	for _, text := range sinkLists {
+		s, err := parseSink(text)
+		if err != nil {
+			return fmt.Errorf("invalid -log-sink %q: %v", text, err)
+		}
+		if err := s.start(); err != nil {
+			return fmt.Errorf("-log-sink %q: %v", text, err)
+		}
+	}
+	var unfiltered []*sink
+	if *logQueries {
+		unfiltered = append(unfiltered, newSink("-log-queries", sinkText, "-"))
+	}
+	if *passiveDNSFile != "" {
+		unfiltered = append(unfiltered, newSink("-passivedns", sinkPassiveDNS, *passiveDNSFile))
+	}
+	switch *logFormat {
+	case "none":
+	case sinkJSON, sinkText, sinkPassiveDNS:
+		unfiltered = append(unfiltered, newSink("-log-format", *logFormat, *logFile))
+	default:
+		return fmt.Errorf("invalid -log-format %v, must be json, text, passivedns or none", *logFormat)
+	}
+	for _, s := range unfiltered {
+		if err := s.start(); err != nil {
+			return fmt.Errorf("%v %v: %v", s.text, s.output, err)
+		}
+	}
+	return nil
+}
+
+// newSink returns a sink of format to output, without filters.
+func newSink(text, format, output string) *sink {
+	return &sink{
+		text:    text,
+		format:  format,
+		output:  output,
+		events:  make(chan *sinkEvent, sinkBuffer),
+		flush:   make(chan chan struct{}),
+		dropped: metricName("sink", format, "dropped"),
+	}
+}
+
+// start opens the output of the sink and writes to it in background.
+func (s *sink) start() error {
+	onShutdown(s.wait) // before closing the output
+	w, err := s.open()
+	if err != nil {
+		return err
+	}
+	if s.format == sinkPassiveDNS {
+		s.passive = newPassiveLog()
+	}
+	sinks = append(sinks, s)
+	go s.run(w)
+	return nil
+}
+
+// parseSink parses space separated key=value settings and filters.
+func parseSink(text string) (*sink, error) {
+	s := newSink(text, "", "")
+	for _, field := range strings.Fields(text) {
+		if field == "blocked" {
+			s.blocked = true
+			continue
+		}
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("%q must be key=value", field)
+		}
+		switch kv[0] {
+		case "format":
+			switch kv[1] {
+			case sinkJSON, sinkText, sinkPassiveDNS, sinkDnstap:
+			default:
+				return nil, fmt.Errorf("unknown format %v, must be json, text, passivedns or dnstap", kv[1])
+			}
+			s.format = kv[1]
+		case "output":
+			s.output = kv[1]
+		default:
+			if err := s.setFilter(kv[0], kv[1]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if s.format == "" || s.output == "" {
+		return nil, fmt.Errorf("format and output are required")
+	}
+	s.dropped = metricName("sink", s.format, "dropped")
+	return s, nil
+}
+
+// setFilter parses a filter of the sink: rcode, route, client or name.
+func (s *sink) setFilter(key, value string) error {
+	switch key {
+	case "rcode":
+		s.rcodes = make(map[int]bool)
+		for _, name := range strings.Split(value, ",") {
+			rcode, ok := dns.StringToRcode[strings.ToUpper(name)]
+			if !ok {
+				return fmt.Errorf("unknown rcode %v", name)
+			}
+			s.rcodes[rcode] = true
+		}
+	case "route":
+		s.routes = make(map[sinkRoute]bool)
+		for _, key := range strings.Split(value, ",") {
+			r, err := findRoute(key)
+			if err != nil {
+				return err
+			}
+			view := ""
+			if i := strings.Index(key, "/"); i >= 0 {
+				view = key[:i]
+			}
+			s.routes[sinkRoute{view: view, domain: r.domain}] = true
+		}
+	case "client":
+		clients, err := parseCIDRs(value)
+		if err != nil {
+			return err
+		}
+		s.clients = clients
+	case "name":
+		s.names = nil
+		for _, name := range strings.Split(value, ",") {
+			s.names = append(s.names, domainMatch{domain: routeDomain(name), zone: true})
+		}
+	default:
+		return fmt.Errorf("unknown key %q", key)
+	}
+	return nil
+}
+
+// open opens the output of the sink.
+func (s *sink) open() (io.Writer, error) {
+	switch {
+	case s.format == sinkDnstap:
+		return newDnstapWriter(s.output)
+	case s.output == "-":
+		return os.Stdout, nil
+	case strings.HasPrefix(s.output, unixPrefix):
+		return nil, fmt.Errorf("unix socket output is only for dnstap")
+	}
+	return os.OpenFile(s.output, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+}
+
+// matches returns whether the query passes the filters of the sink.
+func (s *sink) matches(e *sinkEvent) bool {
+	if s.blocked && e.blocked == "" {
+		return false
+	}
+	if s.rcodes != nil && !s.rcodes[e.resp.Rcode] {
+		return false
+	}
+	if s.routes != nil && (e.route == nil || !s.routes[sinkRoute{view: e.view, domain: e.route.domain}]) {
+		return false
+	}
+	if s.clients != nil && !containsIP(s.clients, addrIP(e.client)) {
+		return false
+	}
+	if s.names == nil {
+		return true
+	}
+	name := normalizeName(e.req.Question[0].Name)
+	for _, d := range s.names {
+		if d.matches(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// run writes the queries to w until the process exits, flushing once
+// there are no more waiting.
+func (s *sink) run(w io.Writer) {
+	bw := bufio.NewWriter(w)
+	var out io.Writer = bw
+	if s.format == sinkDnstap {
+		out = w // one frame per write
+	}
+	write := func(e *sinkEvent) {
+		if err := s.write(out, e); err != nil {
+			logf("log sink %q: %v", s.text, err)
+		}
+	}
+	var window <-chan time.Time
+	if s.passive != nil {
+		window = time.Tick(*passiveDNSWindow)
+	}
+	var reopen <-chan time.Time
+	f, ok := w.(*os.File)
+	if ok && f != os.Stdout {
+		reopen = time.Tick(sinkReopenInterval)
+	}
+	for {
+		select {
+		case <-reopen:
+			if !s.rotated(f) {
+				continue
+			}
+			if f != nil {
+				bw.Flush()
+				f.Close()
+			}
+			// Queries are dropped until the file can be reopened.
+			bw.Reset(io.Discard)
+			nw, err := s.open()
+			if err != nil {
+				logf("log sink %q: reopen: %v", s.text, err)
+				f = nil
+				continue
+			}
+			f = nw.(*os.File)
+			bw.Reset(f)
+			continue
+		case <-window:
+			s.passive.flush(bw)
+		case e := <-s.events:
+			write(e)
+			if len(s.events) > 0 {
+				continue
+			}
+		case done := <-s.flush:
+			for len(s.events) > 0 {
+				write(<-s.events)
+			}
+			if s.passive != nil {
+				s.passive.flush(bw)
+			}
+			bw.Flush()
+			close(done)
+			continue
+		}
+		if err := bw.Flush(); err != nil {
+			logf("log sink %q: %v", s.text, err)
+		}
+	}
+}
+
+// rotated returns whether the output of s is no longer the file f, moved
+// or removed, or f is nil after a failed reopen.
+func (s *sink) rotated(f *os.File) bool {
+	if f == nil {
+		return true
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(s.output)
+	return err != nil || !os.SameFile(fi, current)
+}
+
+// wait writes the queries waiting and flushes the output, on shutdown.
+func (s *sink) wait() {
+	done := make(chan struct{})
+	s.flush <- done
+	<-done
+}
+
+// write writes a query in the format of the sink.
+func (s *sink) write(w io.Writer, e *sinkEvent) error {
+	q := e.req.Question[0]
+	switch s.format {
+	case sinkJSON:
+		var answers []string
+		for _, rr := range e.resp.Answer {
+			answers = append(answers, rr.String())
+		}
+		b, err := json.Marshal(struct {
+			Time      time.Time `json:"time"`
+			Client    string    `json:"client"`
+			ClientID  string    `json:"client_id,omitempty"`
+			Name      string    `json:"name"`
+			Type      string    `json:"type"`
+			Rcode     string    `json:"rcode"`
+			Route     string    `json:"route,omitempty"`
+			Tag       string    `json:"tag,omitempty"`
+			Upstream  string    `json:"upstream,omitempty"`
+			Transport string    `json:"transport"`
+			Cached    bool      `json:"cached"`
+			Blocked   string    `json:"blocked,omitempty"`
+			Answers   []string  `json:"answers,omitempty"`
+		}{
+			e.time, addrHost(e.client), e.clientID, q.Name, dns.TypeToString[q.Qtype],
+			dns.RcodeToString[e.resp.Rcode], routeName(e.route), routeTag(e.route), e.upstream,
+			e.client.Network(), e.cached, e.blocked, answers,
+		})
+		if err != nil {
+			return err
+		}
+		w.Write(append(b, '\n'))
+	case sinkText:
+		client := addrHost(e.client)
+		if e.clientID != "" {
+			client = e.clientID
+		}
+		fields := e.route.logFields()
+		if e.blocked != "" {
+			fields += " blocked=" + e.blocked
+		}
+		fmt.Fprintf(w, "%s query: qname=%s qtype=%s client=%s%s upstream=%s transport=%s rcode=%s cached=%t\n",
+			e.time.Format(time.RFC3339Nano), displayName(q.Name), dns.TypeToString[q.Qtype], client, fields,
+			e.upstream, e.client.Network(), dns.RcodeToString[e.resp.Rcode], e.cached)
+	case sinkPassiveDNS:
+		s.passive.add(e)
+	case sinkDnstap:
+		return writeDnstap(w, e)
+	}
+	return nil
+}
+
+// routeName returns the domain of a route, "default" for a default route,
+// "" for none.
+func routeName(r *routeEntry) string {
+	switch {
+	case r == nil:
+		return ""
+	case r.domain == "":
+		return "default"
+	}
+	return r.domain
+}
+
+func routeTag(r *routeEntry) string {
+	if r == nil {
+		return ""
+	}
+	return r.tag
+}
+
+// sinkQuery sends a query answered in v with resp to the sinks whose
+// filters it passes, r being the route which forwarded it if any and
+// blocked what blocked it if anything.
+func (v *view) sinkQuery(w dns.ResponseWriter, req, resp *dns.Msg, r *routeEntry, upstream string, cached bool, blocked string) {
+	if len(sinks) == 0 && tapping.Load() == 0 || len(req.Question) == 0 {
+		return
+	}
+	e := &sinkEvent{
+		time:     time.Now(),
+		client:   w.RemoteAddr(),
+		server:   w.LocalAddr(),
+		view:     v.name,
+		clientID: clientID(w, req),
+		req:      req,
+		resp:     resp,
+		route:    r,
+		upstream: upstream,
+		cached:   cached,
+		blocked:  blocked,
+	}
+	for _, s := range sinks {
+		s.send(e)
+	}
+	if tapping.Load() > 0 {
+		tapsMu.Lock()
+		for s := range taps {
+			s.send(e)
+		}
+		tapsMu.Unlock()
+	}
+}
+
+// send queues a query to write if it passes the filters of the sink, or
+// drops it if the sink fell behind.
+func (s *sink) send(e *sinkEvent) {
+	if !s.matches(e) {
+		return
+	}
+	select {
+	case s.events <- e:
+	default:
+		countMetric(s.dropped)
+	}
+}
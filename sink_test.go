@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSinkRouteFilterAfterReload(t *testing.T) {
+	old := configView{Route: []string{".example.com.=192.0.2.1:53"}}
+	c := configView{Route: []string{".example.com.=192.0.2.2:53"}}
+	v := &view{name: "lan", routes: make(map[string]*routeEntry)}
+	for _, s := range old.Route {
+		if err := v.addRoute(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	prev := views
+	views = map[string]*view{"lan": v}
+	t.Cleanup(func() { views = prev })
+
+	s := newSink("test", sinkJSON, "-")
+	if err := s.setFilter("route", "lan/.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	nv, err := v.reloaded(old, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := nv.routes[".example.com."]
+	if r == nil || r == v.routes[".example.com."] {
+		t.Fatalf("reloaded route %v, want a new entry", r)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	e := &sinkEvent{client: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 9)}, view: nv.name, req: req, resp: resp, route: r}
+	if !s.matches(e) {
+		t.Errorf("filter does not match the reloaded route")
+	}
+	e.view = ""
+	if s.matches(e) {
+		t.Errorf("filter matches the route of another view")
+	}
+	e.view, e.route = nv.name, nil
+	if s.matches(e) {
+		t.Errorf("filter matches a query not forwarded")
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func tfoListenControl(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN, tfoQueueLength)
+	}); cerr != nil {
+		return cerr
+	}
+	if err != nil {
+		logf("tcp fast open: listener %v: %v", address, err)
+	}
+	return nil
+}
+
+func tfoDialControl(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+	}); cerr != nil {
+		return cerr
+	}
+	if err != nil {
+		logf("tcp fast open: connect %v: %v", address, err)
+	}
+	return nil
+}
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
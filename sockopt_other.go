@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import "syscall"
+
+// TCP Fast Open and SO_REUSEPORT are only used on Linux, elsewhere the
+// flags have no effect.
+
+func tfoListenControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+func tfoDialControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
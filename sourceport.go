@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	sourcePort = flag.String("source-port", sourcePortRandom,
+		"Source port strategy of the UDP queries to backends: random for a new socket and port per query, "+
+			"reuse for connected sockets kept open per backend")
+	routeSourcePorts flagStringList
+)
+
+func init() {
+	flag.Var(&routeSourcePorts, "route-source-port", "Source port strategy of the UDP queries to the backends of a route, "+
+		"instead of -source-port ([view/]domain=random|reuse)")
+}
+
+// Source port strategies.
+const (
+	sourcePortRandom = "random"
+	sourcePortReuse  = "reuse"
+)
+
+// sourcePortIdle is the maximum number of idle sockets kept per backend to
+// reuse, concurrent queries beyond open new sockets closed after.
+const sourcePortIdle = 16
+
+// backendSourcePorts are the -route-source-port strategies by backend,
+// the others use -source-port.
+var backendSourcePorts = make(map[string]string)
+
+// parseSourcePorts checks -source-port and applies -route-source-port to
+// the backends of the routes, which must agree for a backend they share.
+func parseSourcePorts() error {
+	if err := checkSourcePort(*sourcePort); err != nil {
+		return fmt.Errorf("invalid -source-port: %v", err)
+	}
+	if err := setRouteOption("route-source-port", routeSourcePorts, func(r *routeEntry, s string) error {
+		if err := checkSourcePort(s); err != nil {
+			return err
+		}
+		for _, addr := range r.backends {
+			if old, ok := backendSourcePorts[addr]; ok && old != s {
+				return fmt.Errorf("backend %v is also used with %v", addr, old)
+			}
+			backendSourcePorts[addr] = s
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if *sourcePort == sourcePortReuse || len(backendSourcePorts) > 0 {
+		log.Printf("UDP source ports: %v by default, %d backends with -route-source-port", *sourcePort, len(backendSourcePorts))
+	}
+	return nil
+}
+
+func checkSourcePort(s string) error {
+	switch s {
+	case sourcePortRandom, sourcePortReuse:
+		return nil
+	}
+	return fmt.Errorf("unknown strategy %v, must be random or reuse", s)
+}
+
+// sourcePortOf returns the source port strategy of the backend at addr.
+func sourcePortOf(addr string) string {
+	if s, ok := backendSourcePorts[addr]; ok {
+		return s
+	}
+	return *sourcePort
+}
+
+// reuseSockets returns whether queries to addr over transport reuse
+// connected sockets.
+func reuseSockets(addr, transport string) bool {
+	return transport == transportUDP && sourcePortOf(addr) == sourcePortReuse && !strings.HasPrefix(addr, unixPrefix)
+}
+
+var udpPools sync.Map // by backend, of chan *dns.Conn of idle sockets
+
+func udpPool(addr string) chan *dns.Conn {
+	if p, ok := udpPools.Load(addr); ok {
+		return p.(chan *dns.Conn)
+	}
+	p, _ := udpPools.LoadOrStore(addr, make(chan *dns.Conn, sourcePortIdle))
+	return p.(chan *dns.Conn)
+}
+
+// getSocket returns an idle socket connected to addr, or a new one.
+func getSocket(ctx context.Context, c *dns.Client, addr string) (*dns.Conn, error) {
+	select {
+	case conn := <-udpPool(addr):
+		return conn, nil
+	default:
+	}
+	return c.DialContext(ctx, addr)
+}
+
+// putSocket keeps the socket of an answered query to reuse, or closes it
+// if there are enough idle sockets. The socket of a failed query is closed
+// instead, not to read its late response.
+func putSocket(addr string, conn *dns.Conn) {
+	select {
+	case udpPool(addr) <- conn:
+	default:
+		conn.Close()
+	}
+}
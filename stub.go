@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var routeStubs flagStringList
+
+func init() {
+	flag.Var(&routeStubs, "route-stub", "Route of a stub zone: its backends are asked for the name servers of the zone, "+
+		"which are queried directly and followed in their delegations instead of forwarding ([view/]domain)")
+}
+
+// Bounds of the refresh interval of the name servers of a stub zone, by
+// their TTL, and the interval between attempts after a failure.
+const (
+	stubMinRefresh = time.Minute
+	stubMaxRefresh = time.Hour
+	stubRetry      = 30 * time.Second
+)
+
+// stubZone is a zone whose name servers are learned from the backends of
+// its route, and queried without recursion.
+type stubZone struct {
+	zone    string
+	primers []string // the backends of the route, host:port
+
+	// delegations followed from the name servers of the zone
+	delegations *responseStore
+
+	sync.Mutex
+	servers []string // of the zone, host:port, nil until learned
+}
+
+// parseStubs marks the -route-stub routes and learns their name servers in
+// background, refreshed by their TTL.
+func parseStubs() error {
+	for _, routeStub := range routeStubs {
+		r, err := findRoute(routeStub)
+		if err != nil {
+			return fmt.Errorf("invalid -route-stub: %v", err)
+		}
+		if r.pool != nil {
+			return fmt.Errorf("invalid -route-stub %v: a pool route cannot be a stub zone", routeStub)
+		}
+		for _, addr := range r.backends {
+			if !validHostPort(addr) || isEncryptedBackend(addr) {
+				return fmt.Errorf("invalid -route-stub %v: backend %v must be host:port", routeStub, addr)
+			}
+		}
+		r.stub = &stubZone{
+			zone:        dns.Fqdn(strings.TrimPrefix(r.domain, ".")),
+			primers:     r.backends,
+			delegations: newResponseStore(maxDelegations),
+		}
+		go r.stub.refresh()
+	}
+	return nil
+}
+
+// refresh learns the name servers of the zone now and again at their TTL,
+// keeping the previous ones when it fails.
+func (s *stubZone) refresh() {
+	for {
+		servers, ttl, err := s.learn()
+		if err != nil {
+			logf("stub zone %v: %v", s.zone, err)
+			time.Sleep(stubRetry)
+			continue
+		}
+		s.Lock()
+		changed := strings.Join(s.servers, ",") != strings.Join(servers, ",")
+		s.servers = servers
+		s.Unlock()
+		if changed {
+			logf("stub zone %v: name servers %v", s.zone, servers)
+		}
+		time.Sleep(min(max(ttl, stubMinRefresh), stubMaxRefresh))
+	}
+}
+
+// learn asks the backends for the name servers of the zone, authoritative
+// or in a referral of the parent zone, with their addresses from the glue
+// or else asked to the backends, and returns them with the smallest TTL.
+func (s *stubZone) learn() ([]string, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := queryServers(ctx, s.primers, s.zone, dns.TypeNS)
+	if err != nil {
+		return nil, 0, err
+	}
+	var nsNames []string
+	ttl := stubMaxRefresh
+	for _, rr := range append(resp.Answer, resp.Ns...) {
+		if ns, ok := rr.(*dns.NS); ok && dns.CanonicalName(ns.Hdr.Name) == dns.CanonicalName(s.zone) {
+			nsNames = append(nsNames, dns.CanonicalName(ns.Ns))
+			ttl = min(ttl, time.Duration(ns.Hdr.Ttl)*time.Second)
+		}
+	}
+	if len(nsNames) == 0 {
+		return nil, 0, fmt.Errorf("no NS records from %v (%v)", s.primers, dns.RcodeToString[resp.Rcode])
+	}
+	servers := glue(resp, nsNames)
+	for _, ns := range nsNames {
+		if len(glue(resp, []string{ns})) > 0 {
+			continue
+		}
+		addrs, err := queryServers(ctx, s.primers, ns, dns.TypeA)
+		if err != nil {
+			continue
+		}
+		for _, rr := range addrs.Answer {
+			if a, ok := rr.(*dns.A); ok {
+				servers = append(servers, net.JoinHostPort(a.A.String(), "53"))
+			}
+		}
+	}
+	if len(servers) == 0 {
+		return nil, 0, fmt.Errorf("no address for the name servers %v", nsNames)
+	}
+	return servers, ttl, nil
+}
+
+// nameServers returns the name servers of the zone, the backends until
+// they are learned.
+func (s *stubZone) nameServers() []string {
+	s.Lock()
+	defer s.Unlock()
+	if s.servers == nil {
+		return s.primers
+	}
+	return s.servers
+}
+
+// iterate follows the delegations from the name servers of the zone and
+// returns their response for name and qtype.
+func (s *stubZone) iterate(ctx context.Context, name string, qtype uint16, depth int) (*dns.Msg, error) {
+	return iterateFrom(ctx, s, s.zone, s.nameServers(), name, qtype, depth)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	suppressLocal = flag.Bool("suppress-local", false,
+		"Answer NXDOMAIN to single-label names and names under -suppress-suffixes going to the default server, instead of leaking them")
+	suppressSuffixes = flag.String("suppress-suffixes", "local,localdomain,home.arpa",
+		"Domains suppressed with their subdomains by -suppress-local (domain,...)")
+)
+
+// suppressed returns whether a question going to the default server is
+// answered NXDOMAIN locally by -suppress-local: the NetBIOS/LLMNR-style
+// single-label names of Windows clients such as wpad, and names under
+// the local suffixes. Single-label queries for the types of a zone apex,
+// which validating resolvers send for top-level domains, are not.
+func suppressed(q dns.Question) bool {
+	if !*suppressLocal {
+		return false
+	}
+	name := normalizeName(q.Name)
+	if name == "." {
+		return false
+	}
+	if strings.Count(name, ".") == 1 {
+		switch q.Qtype {
+		case dns.TypeDS, dns.TypeDNSKEY, dns.TypeNS, dns.TypeSOA:
+			return false
+		}
+		return true
+	}
+	for _, suffix := range strings.Split(*suppressSuffixes, ",") {
+		suffix = routeDomain(strings.Trim(suffix, "."))
+		if name == suffix || strings.HasSuffix(name, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
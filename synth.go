@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"sort"
+
+	"github.com/miekg/dns"
+)
+
+// synthTTL is the TTL of locally synthesized records.
+const synthTTL = 300
+
+// synthEntry is a domain answered locally: A and AAAA queries with its
+// addresses, other types with no data, or NXDOMAIN without addresses.
+type synthEntry struct {
+	domainMatch
+	ips []net.IP
+}
+
+// addSynth adds a locally answered zone to v, most specific first.
+func (v *view) addSynth(domain string, ips []net.IP) {
+	v.synth = append(v.synth, &synthEntry{
+		domainMatch: domainMatch{domain: routeDomain(domain), zone: true},
+		ips:         ips,
+	})
+	sort.SliceStable(v.synth, func(i, j int) bool {
+		return len(v.synth[i].domain) > len(v.synth[j].domain)
+	})
+}
+
+// matchSynth returns the local entry for a name, nil if none.
+func (v *view) matchSynth(name string) *synthEntry {
+	lcName := normalizeName(name)
+	for _, e := range v.synth {
+		if e.matches(lcName) {
+			return e
+		}
+	}
+	return nil
+}
+
+// synthMsg returns the answer to req from the local entry e of v.
+func (v *view) synthMsg(e *synthEntry, req *dns.Msg) *dns.Msg {
+	q := req.Question[0]
+	rcode := dns.RcodeSuccess
+	if len(e.ips) == 0 {
+		rcode = dns.RcodeNameError
+	}
+	m := v.replyMsg(req, rcode)
+	m.Authoritative = true
+	for _, ip := range e.ips {
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: synthTTL}
+		switch {
+		case q.Qtype == dns.TypeA && ip.To4() != nil:
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: ip.To4()})
+		case q.Qtype == dns.TypeAAAA && ip.To4() == nil:
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	return m
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	adminMux.HandleFunc("/tail", adminTail)
+}
+
+// tailKeepalive is the interval of the comments keeping an idle tail open
+// through proxies.
+const tailKeepalive = 15 * time.Second
+
+var (
+	tapsMu  sync.Mutex
+	taps    = make(map[*sink]bool) // of the clients of /tail
+	tapping atomic.Int32           // len(taps), read without the lock
+)
+
+// adminTail streams the queries answered to clients as server-sent events
+// of the JSON log sink format, until the client disconnects. The optional
+// parameters are the filters of -log-sink: name, client, route, rcode, and
+// blocked=1 for only the blocked queries.
+func adminTail(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	s := &sink{text: "tail", format: sinkJSON, events: make(chan *sinkEvent, sinkBuffer), dropped: "tail.dropped"}
+	s.blocked = r.FormValue("blocked") != ""
+	for _, key := range []string{"name", "client", "route", "rcode"} {
+		if value := r.FormValue(key); value != "" {
+			if err := s.setFilter(key, value); err != nil {
+				http.Error(w, fmt.Sprintf("invalid %v: %v", key, err), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	tapsMu.Lock()
+	taps[s] = true
+	tapping.Add(1)
+	tapsMu.Unlock()
+	defer func() {
+		tapsMu.Lock()
+		delete(taps, s)
+		tapping.Add(-1)
+		tapsMu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	keepalive := time.NewTicker(tailKeepalive)
+	defer keepalive.Stop()
+	var b bytes.Buffer
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case e := <-s.events:
+			b.Reset()
+			if err := s.write(&b, e); err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "data: %s\n\n", bytes.TrimSuffix(b.Bytes(), []byte("\n")))
+		}
+		flusher.Flush()
+	}
+}
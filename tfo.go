@@ -0,0 +1,18 @@
+package main
+
+import (
+	"flag"
+	"net"
+	"time"
+)
+
+var tcpFastOpen = flag.Bool("tcp-fast-open", false,
+	"Use TCP Fast Open on the TCP listeners and toward the backends, where supported (Linux)")
+
+// tfoQueueLength is the queue of pending TCP Fast Open requests of a listener.
+const tfoQueueLength = 256
+
+// tfoDialer returns the dialer of TCP connections to the backends.
+func tfoDialer() *net.Dialer {
+	return &net.Dialer{Timeout: 2 * time.Second, Control: tfoDialControl}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	tlsMinVersion = flag.String("tls-min-version", "1.2",
+		"Minimum TLS version of encrypted listeners and upstream connections (1.0, 1.1, 1.2 or 1.3)")
+	tlsCiphers = flag.String("tls-ciphers", "",
+		"TLS 1.2 and lower cipher suites allowed, by Go name (name,...), default Go's secure suites")
+	tlsTicketRotation = flag.Duration("tls-ticket-rotation", 0,
+		"Interval between session ticket key rotations of encrypted listeners, 0 for Go's default")
+	tlsOCSPStaple = flag.String("tls-ocsp-staple", "",
+		"DER OCSP response file stapled by encrypted listeners, re-read every hour")
+)
+
+// tlsVersions are the -tls-min-version values.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsPolicyConfig is the parsed TLS configuration shared by encrypted
+// listeners and upstream connections.
+type tlsPolicyConfig struct {
+	minVersion   uint16
+	cipherSuites []uint16 // nil for Go's default
+}
+
+var tlsPolicy tlsPolicyConfig
+
+// httpClient returns an HTTP client whose HTTPS connections follow the TLS
+// policy, e.g. to fetch feeds.
+func (p tlsPolicyConfig) httpClient(timeout time.Duration) *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = &tls.Config{MinVersion: p.minVersion, CipherSuites: p.cipherSuites}
+	return &http.Client{Timeout: timeout, Transport: t}
+}
+
+// parseTLSPolicy parses the -tls flags.
+func parseTLSPolicy() error {
+	v, ok := tlsVersions[*tlsMinVersion]
+	if !ok {
+		return fmt.Errorf("invalid -tls-min-version %v, must be 1.0, 1.1, 1.2 or 1.3", *tlsMinVersion)
+	}
+	tlsPolicy.minVersion = v
+	if *tlsCiphers == "" {
+		return nil
+	}
+	byName := make(map[string]uint16)
+	for _, c := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		byName[c.Name] = c.ID
+	}
+	for _, name := range strings.Split(*tlsCiphers, ",") {
+		id, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("invalid -tls-ciphers: unknown cipher suite %v", name)
+		}
+		tlsPolicy.cipherSuites = append(tlsPolicy.cipherSuites, id)
+	}
+	return nil
+}
+
+var (
+	clientSessionsMu sync.Mutex
+	// clientSessions are the TLS sessions to resume by upstream host:port,
+	// apart as the session caches are by server name while DNS over TLS
+	// and HTTPS may be served with different ticket keys.
+	clientSessions = make(map[string]tls.ClientSessionCache)
+)
+
+// clientSessionCache returns the TLS session cache of an upstream address.
+func clientSessionCache(addr string) tls.ClientSessionCache {
+	clientSessionsMu.Lock()
+	defer clientSessionsMu.Unlock()
+	c, ok := clientSessions[addr]
+	if !ok {
+		c = tls.NewLRUClientSessionCache(1) // the last session of the server name
+		clientSessions[addr] = c
+	}
+	return c
+}
+
+// tlsHandshakes counts the upstream TLS handshakes by server name.
+type tlsHandshakes struct {
+	total, resumed uint64
+}
+
+var (
+	tlsHandshakesMu sync.Mutex
+	tlsHandshakesBy = make(map[string]*tlsHandshakes)
+)
+
+// clientTLSConfig returns the TLS configuration to connect to an upstream
+// on a port, resuming the session of the previous connection. Handshakes
+// are counted in the tls.SERVER.handshakes and resumed metrics.
+func clientTLSConfig(serverName, port string) *tls.Config {
+	return &tls.Config{
+		ServerName:         serverName,
+		MinVersion:         tlsPolicy.minVersion,
+		CipherSuites:       tlsPolicy.cipherSuites,
+		ClientSessionCache: clientSessionCache(net.JoinHostPort(serverName, port)),
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			countTLSHandshake(serverName, cs.DidResume)
+			return nil
+		},
+	}
+}
+
+func countTLSHandshake(serverName string, resumed bool) {
+	countMetric(metricName("tls", serverName, "handshakes"))
+	if resumed {
+		countMetric(metricName("tls", serverName, "resumed"))
+	}
+	tlsHandshakesMu.Lock()
+	defer tlsHandshakesMu.Unlock()
+	h, ok := tlsHandshakesBy[serverName]
+	if !ok {
+		h = &tlsHandshakes{}
+		tlsHandshakesBy[serverName] = h
+	}
+	h.total++
+	if resumed {
+		h.resumed++
+	}
+}
+
+// tlsResumptionGauges returns the ratio of resumed upstream TLS handshakes
+// by server name, as the tls.SERVER.resumption_rate gauges.
+func tlsResumptionGauges() map[string]float64 {
+	tlsHandshakesMu.Lock()
+	defer tlsHandshakesMu.Unlock()
+	gauges := make(map[string]float64)
+	for serverName, h := range tlsHandshakesBy {
+		gauges[metricName("tls", serverName, "resumption_rate")] = float64(h.resumed) / float64(h.total)
+	}
+	return gauges
+}
+
+// tlsServer is the TLS state of an encrypted listener.
+type tlsServer struct {
+	sync.Mutex
+	cert       tls.Certificate // with the OCSP staple, if any
+	ticketKeys [][32]byte      // newest first
+	config     *tls.Config
+}
+
+// serverTLSConfig returns the TLS configuration of an encrypted listener
+// serving cert, rotating its session ticket keys and reloading its OCSP
+// staple in background as configured.
+func serverTLSConfig(cert tls.Certificate) (*tls.Config, error) {
+	s := &tlsServer{cert: cert}
+	if *tlsOCSPStaple != "" {
+		if err := s.loadOCSPStaple(); err != nil {
+			return nil, fmt.Errorf("-tls-ocsp-staple: %v", err)
+		}
+		go func() {
+			for range time.Tick(time.Hour) {
+				if err := s.loadOCSPStaple(); err != nil {
+					logf("tls: -tls-ocsp-staple: %v", err)
+				}
+			}
+		}()
+	}
+	s.config = &tls.Config{
+		MinVersion:     tlsPolicy.minVersion,
+		CipherSuites:   tlsPolicy.cipherSuites,
+		GetCertificate: s.certificate,
+	}
+	if *tlsTicketRotation > 0 {
+		if err := s.rotateTicketKeys(); err != nil {
+			return nil, err
+		}
+		go func() {
+			for range time.Tick(*tlsTicketRotation) {
+				if err := s.rotateTicketKeys(); err != nil {
+					logf("tls: session ticket rotation: %v", err)
+				}
+			}
+		}()
+	}
+	return s.config, nil
+}
+
+func (s *tlsServer) certificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.Lock()
+	defer s.Unlock()
+	cert := s.cert
+	return &cert, nil
+}
+
+func (s *tlsServer) loadOCSPStaple() error {
+	staple, err := os.ReadFile(*tlsOCSPStaple)
+	if err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.cert.OCSPStaple = staple
+	return nil
+}
+
+// rotateTicketKeys adds a new session ticket key, keeping the previous one
+// to resume the sessions of tickets issued before the rotation.
+func (s *tlsServer) rotateTicketKeys() error {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return err
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.ticketKeys = append([][32]byte{key}, s.ticketKeys...)
+	if len(s.ticketKeys) > 2 {
+		s.ticketKeys = s.ticketKeys[:2]
+	}
+	s.config.SetSessionTicketKeys(s.ticketKeys)
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// truncationRetryWindow is how long after a truncated UDP response a query
+// of the same client for the same question over TCP counts as its retry.
+const truncationRetryWindow = 10 * time.Second
+
+// truncationMax is the maximum number of truncated responses waiting for
+// their retry, the others are not followed.
+const truncationMax = 10000
+
+var (
+	udpResponses   atomic.Uint64
+	truncatedSent  atomic.Uint64
+	truncatedRetry atomic.Uint64
+
+	truncationsMu sync.Mutex
+	truncations   = make(map[string]time.Time) // by truncationKey
+	truncationsGC time.Time                    // last removal of the expired ones
+)
+
+// clientTransport returns the transport of a client query: udp, tcp, tls
+// for DNS over TLS or https for DNS over HTTPS, also received over TCP.
+func clientTransport(w dns.ResponseWriter) string {
+	if _, ok := w.(*dohWriter); ok {
+		return netHTTPS
+	}
+	if c, ok := w.(dns.ConnectionStater); ok && c.ConnectionState() != nil {
+		return "tls"
+	}
+	return w.RemoteAddr().Network()
+}
+
+func truncationKey(w dns.ResponseWriter, q dns.Question) string {
+	return remoteIP(w).String() + " " + strings.ToLower(q.Name) + " " + dns.Type(q.Qtype).String()
+}
+
+// countResponse counts a response sent over UDP and, if truncated, in the
+// truncation.sent metric, remembering it to see whether the client retries.
+func countResponse(w dns.ResponseWriter, m *dns.Msg) {
+	if w.RemoteAddr().Network() != "udp" {
+		return
+	}
+	udpResponses.Add(1)
+	if !m.Truncated {
+		return
+	}
+	truncatedSent.Add(1)
+	countMetric("truncation.sent")
+	if len(m.Question) == 0 {
+		return
+	}
+	now := time.Now()
+	truncationsMu.Lock()
+	defer truncationsMu.Unlock()
+	if now.Sub(truncationsGC) > truncationRetryWindow {
+		for key, t := range truncations {
+			if now.Sub(t) > truncationRetryWindow {
+				delete(truncations, key)
+			}
+		}
+		truncationsGC = now
+	}
+	if len(truncations) < truncationMax {
+		truncations[truncationKey(w, m.Question[0])] = now
+	}
+}
+
+// countRetry counts a query over TCP retrying one truncated over UDP, in
+// the truncation.retried metric.
+func countRetry(w dns.ResponseWriter, req *dns.Msg) {
+	if w.RemoteAddr().Network() == "udp" || len(req.Question) == 0 {
+		return
+	}
+	key := truncationKey(w, req.Question[0])
+	truncationsMu.Lock()
+	t, ok := truncations[key]
+	delete(truncations, key)
+	truncationsMu.Unlock()
+	if !ok || time.Since(t) > truncationRetryWindow {
+		return
+	}
+	truncatedRetry.Add(1)
+	countMetric("truncation.retried")
+}
+
+// truncationGauges returns the share of UDP responses truncated and the
+// share of those retried over TCP, as the truncation.rate and
+// truncation.retry_rate gauges.
+func truncationGauges() map[string]float64 {
+	gauges := make(map[string]float64)
+	if n := udpResponses.Load(); n > 0 {
+		gauges["truncation.rate"] = float64(truncatedSent.Load()) / float64(n)
+	}
+	if n := truncatedSent.Load(); n > 0 {
+		gauges["truncation.retry_rate"] = float64(truncatedRetry.Load()) / float64(n)
+	}
+	return gauges
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// tsigKey is a TSIG key used to sign queries forwarded to a backend. A
+// -tsig-keys key referred to by name only has its name, see current.
+type tsigKey struct {
+	name      string // canonical fqdn
+	algorithm string // fqdn, e.g. hmac-sha256.
+	secret    string // base64
+}
+
+// parseTSIGKey parses a key in dig -y format: [algorithm:]name:secret.
+// The algorithm defaults to hmac-sha256.
+func parseTSIGKey(s string) (*tsigKey, error) {
+	parts := strings.Split(s, ":")
+	algorithm := dns.HmacSHA256
+	switch len(parts) {
+	case 2:
+	case 3:
+		algorithm = dns.Fqdn(strings.ToLower(parts[0]))
+		parts = parts[1:]
+	default:
+		return nil, fmt.Errorf("invalid TSIG key %q, must be [algorithm:]name:secret", s)
+	}
+	switch algorithm {
+	case dns.HmacSHA1, dns.HmacSHA224, dns.HmacSHA256, dns.HmacSHA384, dns.HmacSHA512:
+	default:
+		return nil, fmt.Errorf("unsupported TSIG algorithm %v", algorithm)
+	}
+	if parts[0] == "" {
+		return nil, fmt.Errorf("invalid TSIG key %q, empty name", s)
+	}
+	if _, err := base64.StdEncoding.DecodeString(parts[1]); err != nil {
+		return nil, fmt.Errorf("invalid TSIG secret for %v: %v", parts[0], err)
+	}
+	return &tsigKey{
+		name:      dns.CanonicalName(parts[0]),
+		algorithm: algorithm,
+		secret:    parts[1],
+	}, nil
+}
+
+// current returns the key as currently loaded, after a -tsig-keys reload.
+func (k *tsigKey) current() *tsigKey {
+	if key := currentTSIG(k.name); key != nil {
+		return key
+	}
+	return k
+}
+
+// sign returns a copy of req carrying a TSIG record for this key,
+// any TSIG record set by the client is replaced.
+func (k *tsigKey) sign(req *dns.Msg) *dns.Msg {
+	m := req.Copy()
+	stripTSIG(m)
+	m.SetTsig(k.name, k.current().algorithm, 300, time.Now().Unix())
+	return m
+}
+
+// stripTSIG removes the TSIG record from m, if any.
+func stripTSIG(m *dns.Msg) {
+	if m.IsTsig() != nil {
+		m.Extra = m.Extra[:len(m.Extra)-1]
+	}
+}
+
+// viewKey is a -view-tsig key and the view it selects.
+type viewKey struct {
+	key  *tsigKey
+	view *view
+}
+
+// viewKeys are the -view-tsig keys by name.
+var viewKeys = make(map[string]*viewKey)
+
+// tsigWriter signs the responses to a query signed with key.
+type tsigWriter struct {
+	dns.ResponseWriter
+	key *tsigKey
+}
+
+func (w tsigWriter) WriteMsg(m *dns.Msg) error {
+	stripTSIG(m)
+	m.SetTsig(w.key.name, w.key.current().algorithm, 300, time.Now().Unix())
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// Write unpacks a wire response to sign it.
+func (w tsigWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	return len(b), w.WriteMsg(m)
+}
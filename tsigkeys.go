@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"hash"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	tsigKeysFile = flag.String("tsig-keys", "",
+		"File of TSIG keys, one [algorithm:]name:secret per line, which -route-tsig and -view-tsig can refer to "+
+			"by name, reloaded when modified to rotate them")
+	tsigRefresh = flag.Duration("tsig-refresh", 10*time.Second,
+		"Interval between checks of the -tsig-keys file for changes")
+)
+
+var (
+	tsigMu      sync.RWMutex
+	tsigKeys    = make(map[string]*tsigKey) // by name, of the flags and the file
+	flagKeys    = make(map[string]*tsigKey) // by name, given in flags
+	fileKeyRefs = make(map[string]bool)     // names of the file keys referred to
+	tsigModTime time.Time
+)
+
+// watchTSIGKeys loads the -tsig-keys file, then reloads it when it
+// changes, in background.
+func watchTSIGKeys() error {
+	if *tsigKeysFile == "" {
+		return nil
+	}
+	if err := loadTSIGKeys(); err != nil {
+		return fmt.Errorf("-tsig-keys: %v", err)
+	}
+	go func() {
+		for range time.Tick(*tsigRefresh) {
+			fi, err := os.Stat(*tsigKeysFile)
+			if err == nil && fi.ModTime().Equal(tsigModTime) {
+				continue
+			}
+			if err := loadTSIGKeys(); err != nil {
+				logf("tsig: reload: %v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// loadTSIGKeys parses the -tsig-keys file and swaps its keys, keeping the
+// previous ones if a key referred to is missing.
+func loadTSIGKeys() error {
+	fi, err := os.Stat(*tsigKeysFile)
+	if err != nil {
+		return err
+	}
+	tsigModTime = fi.ModTime()
+	f, err := os.Open(*tsigKeysFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	keys := make(map[string]*tsigKey)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := parseTSIGKey(line)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", n, err)
+		}
+		if _, ok := flagKeys[key.name]; ok {
+			return fmt.Errorf("line %d: key %v also given in a flag", n, key.name)
+		}
+		keys[key.name] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	tsigMu.Lock()
+	defer tsigMu.Unlock()
+	for name := range fileKeyRefs {
+		if _, ok := keys[name]; !ok {
+			return fmt.Errorf("key %v is missing", name)
+		}
+	}
+	for name, key := range flagKeys {
+		keys[name] = key
+	}
+	changed := len(keys) != len(tsigKeys)
+	for name, key := range keys {
+		if old, ok := tsigKeys[name]; !ok || *old != *key {
+			changed = true
+		}
+	}
+	tsigKeys = keys
+	if changed {
+		logf("tsig: loaded %d keys from %v", len(keys)-len(flagKeys), *tsigKeysFile)
+	}
+	return nil
+}
+
+// keyFlag returns the key of a -route-tsig or -view-tsig flag: either a
+// key in dig -y format, or the name of a -tsig-keys key.
+func keyFlag(s string) (*tsigKey, error) {
+	if !strings.Contains(s, ":") {
+		name := dns.CanonicalName(s)
+		key := currentTSIG(name)
+		if key == nil || flagKeys[name] != nil {
+			return nil, fmt.Errorf("no TSIG key %v in -tsig-keys", name)
+		}
+		tsigMu.Lock()
+		fileKeyRefs[name] = true
+		tsigMu.Unlock()
+		return &tsigKey{name: name}, nil
+	}
+	key, err := parseTSIGKey(s)
+	if err != nil {
+		return nil, err
+	}
+	tsigMu.Lock()
+	defer tsigMu.Unlock()
+	if old, ok := tsigKeys[key.name]; ok && (flagKeys[key.name] == nil || *old != *key) {
+		return nil, fmt.Errorf("TSIG key %v defined twice", key.name)
+	}
+	flagKeys[key.name] = key
+	tsigKeys[key.name] = key
+	return key, nil
+}
+
+// currentTSIG returns the current key of a canonical name, nil if none.
+func currentTSIG(name string) *tsigKey {
+	tsigMu.RLock()
+	defer tsigMu.RUnlock()
+	return tsigKeys[name]
+}
+
+// tsigProvider signs and verifies messages with the current keys, and
+// counts their usage in the tsig.NAME.signed, verified and failed metrics.
+type tsigProvider struct{}
+
+func (tsigProvider) Generate(msg []byte, t *dns.TSIG) ([]byte, error) {
+	key := currentTSIG(dns.CanonicalName(t.Hdr.Name))
+	if key == nil {
+		return nil, dns.ErrSecret
+	}
+	mac, err := key.mac(msg, t)
+	if err != nil {
+		return nil, err
+	}
+	countMetric(metricName("tsig", key.name, "signed"))
+	return mac, nil
+}
+
+func (tsigProvider) Verify(msg []byte, t *dns.TSIG) error {
+	key := currentTSIG(dns.CanonicalName(t.Hdr.Name))
+	if key == nil {
+		return dns.ErrSecret
+	}
+	mac, err := key.mac(msg, t)
+	if err != nil {
+		return err
+	}
+	want, err := hex.DecodeString(t.MAC)
+	if err != nil || !hmac.Equal(mac, want) {
+		countMetric(metricName("tsig", key.name, "failed"))
+		return dns.ErrSig
+	}
+	countMetric(metricName("tsig", key.name, "verified"))
+	return nil
+}
+
+// mac returns the HMAC of msg with the key, which must be of the algorithm
+// of t.
+func (k *tsigKey) mac(msg []byte, t *dns.TSIG) ([]byte, error) {
+	if dns.CanonicalName(t.Algorithm) != k.algorithm {
+		return nil, dns.ErrKeyAlg
+	}
+	secret, err := base64.StdEncoding.DecodeString(k.secret)
+	if err != nil {
+		return nil, err
+	}
+	var h func() hash.Hash
+	switch k.algorithm {
+	case dns.HmacSHA1:
+		h = sha1.New
+	case dns.HmacSHA224:
+		h = sha256.New224
+	case dns.HmacSHA256:
+		h = sha256.New
+	case dns.HmacSHA384:
+		h = sha512.New384
+	case dns.HmacSHA512:
+		h = sha512.New
+	default:
+		return nil, dns.ErrKeyAlg
+	}
+	m := hmac.New(h, secret)
+	m.Write(msg)
+	return m.Sum(nil), nil
+}
+
+// serverTSIG returns the provider verifying the -view-tsig keys for
+// dns.Server, nil if none.
+func serverTSIG() dns.TsigProvider {
+	if len(viewKeys) == 0 {
+		return nil
+	}
+	return tsigProvider{}
+}
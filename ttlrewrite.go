@@ -0,0 +1,86 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var ttlRewrites flagStringList
+
+func init() {
+	flag.Var(&ttlRewrites, "ttl-rewrite", "TTL of the answers for a name and its subdomains, or only its subdomains "+
+		"with *., whatever the backends answer, e.g. *.gslb.example.com=30s (name=duration)")
+}
+
+// ttlRewrite sets the TTL of the answers for matching names.
+type ttlRewrite struct {
+	domain string // normalized
+	sub    bool   // subdomains only
+	ttl    uint32
+}
+
+// ttlRewriteRules are the -ttl-rewrite rules, the longest domain first so
+// that the most specific wins.
+var ttlRewriteRules []ttlRewrite
+
+// parseTTLRewrites parses the -ttl-rewrite flags.
+func parseTTLRewrites() error {
+	for _, s := range ttlRewrites {
+		name, value, ok := strings.Cut(s, "=")
+		if !ok || name == "" {
+			return fmt.Errorf("invalid -ttl-rewrite %q, must be name=duration", s)
+		}
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl < 0 || ttl.Seconds() > float64(^uint32(0)>>1) {
+			return fmt.Errorf("invalid -ttl-rewrite %q, must be a positive duration", s)
+		}
+		r := ttlRewrite{ttl: uint32(ttl.Seconds())}
+		if strings.HasPrefix(name, "*.") {
+			r.sub, name = true, name[2:]
+		}
+		r.domain = routeDomain(name)
+		for _, old := range ttlRewriteRules {
+			if old.domain == r.domain && old.sub == r.sub {
+				return fmt.Errorf("invalid -ttl-rewrite, duplicate name %v", name)
+			}
+		}
+		ttlRewriteRules = append(ttlRewriteRules, r)
+	}
+	sort.SliceStable(ttlRewriteRules, func(i, j int) bool {
+		return len(ttlRewriteRules[i].domain) > len(ttlRewriteRules[j].domain)
+	})
+	return nil
+}
+
+// matches returns whether a normalized name matches.
+func (r ttlRewrite) matches(name string) bool {
+	if name == r.domain {
+		return !r.sub
+	}
+	return strings.HasSuffix(name, "."+r.domain)
+}
+
+// rewriteTTLs sets the TTL of the answers of resp by -ttl-rewrite,
+// counting the responses changed in the ttl.rewritten metric.
+func rewriteTTLs(resp *dns.Msg) {
+	rewritten := false
+	for _, rr := range resp.Answer {
+		h := rr.Header()
+		name := normalizeName(h.Name)
+		for _, r := range ttlRewriteRules {
+			if r.matches(name) {
+				rewritten = rewritten || h.Ttl != r.ttl
+				h.Ttl = r.ttl
+				break
+			}
+		}
+	}
+	if rewritten {
+		countMetric("ttl.rewritten")
+	}
+}
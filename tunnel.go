@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	tunnelDetect = flag.String("tunnel-detect", "",
+		"DNS tunneling heuristics: log (flag only) or block (refuse) suspicious queries, default off")
+	tunnelEntropy = flag.Float64("tunnel-entropy", 4.0,
+		"Shannon entropy (bits per character) above which a long label looks like encoded data")
+	tunnelMaxName = flag.Int("tunnel-max-name", 150,
+		"Query name length (characters) above which a query looks like tunneling")
+	tunnelTXTRate = flag.Int("tunnel-txt-rate", 100,
+		"TXT/NULL queries per client per minute above which a client looks like tunneling")
+)
+
+// tunnelMinLabel is the shortest label considered for the entropy check,
+// shorter labels do not carry enough characters for a meaningful estimate.
+const tunnelMinLabel = 16
+
+// tunnelCounter counts TXT/NULL queries per client over a fixed window.
+type tunnelCounter struct {
+	sync.Mutex
+	start  time.Time
+	counts map[string]int
+}
+
+var tunnelTXT = &tunnelCounter{counts: make(map[string]int)}
+
+// add records one query for client and returns the count in the current window.
+func (t *tunnelCounter) add(client string) int {
+	t.Lock()
+	defer t.Unlock()
+	if now := time.Now(); now.Sub(t.start) > time.Minute {
+		t.start = now
+		t.counts = make(map[string]int)
+	}
+	t.counts[client]++
+	return t.counts[client]
+}
+
+// peek returns the count of client in the current window, as add would
+// return it for one more query, without recording one.
+func (t *tunnelCounter) peek(client string) int {
+	t.Lock()
+	defer t.Unlock()
+	if time.Since(t.start) > time.Minute {
+		return 1
+	}
+	return t.counts[client] + 1
+}
+
+func validTunnelDetect(s string) bool {
+	switch s {
+	case "", "log", "block":
+		return true
+	}
+	return false
+}
+
+// entropy returns the Shannon entropy of s in bits per character.
+func entropy(s string) float64 {
+	freq := make(map[rune]int)
+	for _, r := range s {
+		freq[r]++
+	}
+	var e float64
+	n := float64(len(s))
+	for _, c := range freq {
+		p := float64(c) / n
+		e -= p * math.Log2(p)
+	}
+	return e
+}
+
+// tunnelReason returns why a query looks like DNS tunneling, or "" if not.
+// The query is counted for client unless peek.
+func tunnelReason(client string, q dns.Question, peek bool) string {
+	if len(q.Name) > *tunnelMaxName {
+		return "long name"
+	}
+	for _, label := range dns.SplitDomainName(q.Name) {
+		if len(label) >= tunnelMinLabel && entropy(strings.ToLower(label)) > *tunnelEntropy {
+			return "high entropy label"
+		}
+	}
+	switch q.Qtype {
+	case dns.TypeTXT, dns.TypeNULL:
+		count := tunnelTXT.peek
+		if !peek {
+			count = tunnelTXT.add
+		}
+		if count(client) > *tunnelTXTRate {
+			return "TXT/NULL volume"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// unixPrefix marks a backend listening on a unix socket, e.g. a local
+// resolver at unix:/run/resolver.sock, queried with the TCP framing.
+const unixPrefix = "unix:"
+
+// validBackend returns whether s is a backend address: host:port,
+// unix:/path, tls://host[:port] or https://host[:port]/path.
+func validBackend(s string) bool {
+	if isEncryptedBackend(s) {
+		_, _, ok := encryptedBackend(s)
+		return ok
+	}
+	if path, ok := strings.CutPrefix(s, unixPrefix); ok {
+		return path != ""
+	}
+	return validHostPort(s)
+}
+
+// upstreamClient returns a client to query the backend at addr over
+// transport, and the address to dial. Unix sockets are always streams.
+func upstreamClient(addr, transport string) (*dns.Client, string) {
+	if path, ok := strings.CutPrefix(addr, unixPrefix); ok {
+		return &dns.Client{Net: "unix"}, path
+	}
+	c := &dns.Client{Net: transport}
+	if transport == "tcp" && *tcpFastOpen {
+		c.Dialer = tfoDialer()
+	}
+	return c, addr
+}
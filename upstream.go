@@ -0,0 +1,232 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var healthChaos = flag.Bool("health-chaos", false,
+	"Answer CH TXT "+healthName+" with the health of the backends and "+listenerHealthName+" with the state of the listeners")
+
+// healthName is the CHAOS TXT name answered with -health-chaos.
+const healthName = "health.upstreams.proxy."
+
+// downFailures is the number of consecutive failures after which
+// a backend is reported down.
+const downFailures = 3
+
+// downHoldDown is the interval after which a backend down takes one query
+// again, so that it is back in turn once it answers even without probes.
+const downHoldDown = 30 * time.Second
+
+// upstream is the health of a backend, as observed from forwarded queries
+// and reported by cluster peers.
+type upstream struct {
+	sync.Mutex
+	failures  int       // consecutive
+	held      time.Time // last failure or trial while down
+	queries   uint64
+	errors    uint64
+	srtt      time.Duration        // smoothed round trip time
+	success   float64              // smoothed success rate, 0 to 1
+	peersDown map[string]time.Time // last report by peer
+	caps      *capabilities        // nil if not probed
+}
+
+// smoothing is the weight of a new observation in the smoothed round trip
+// time and success rate, as for TCP's SRTT.
+const smoothing = 0.125
+
+var (
+	upstreamsMu sync.Mutex
+	upstreams   = make(map[string]*upstream) // by address
+)
+
+// getUpstream returns the health of the backend at addr.
+func getUpstream(addr string) *upstream {
+	upstreamsMu.Lock()
+	defer upstreamsMu.Unlock()
+	u, ok := upstreams[addr]
+	if !ok {
+		u = &upstream{}
+		upstreams[addr] = u
+	}
+	return u
+}
+
+// observe records the result of a query to the backend which took rtt.
+func (u *upstream) observe(rtt time.Duration, err error) {
+	u.Lock()
+	defer u.Unlock()
+	u.queries++
+	ok := 0.0
+	if err == nil {
+		ok = 1
+	}
+	if u.queries == 1 {
+		u.success = ok
+	} else {
+		u.success += smoothing * (ok - u.success)
+	}
+	if err != nil {
+		u.errors++
+		u.failures++
+		u.held = time.Now()
+		return
+	}
+	u.failures = 0
+	if u.srtt == 0 {
+		u.srtt = rtt
+	} else {
+		u.srtt += time.Duration(smoothing * float64(rtt-u.srtt))
+	}
+}
+
+// stats returns the smoothed round trip time, success rate and
+// consecutive failures of the backend.
+func (u *upstream) stats() (time.Duration, float64, int) {
+	u.Lock()
+	defer u.Unlock()
+	return u.srtt, u.success, u.failures
+}
+
+// probed records the result of a health probe of the backend: a failure
+// counts as a failed query, without counting in the query statistics.
+// It returns whether the backend went up or down.
+func (u *upstream) probed(err error) bool {
+	u.Lock()
+	defer u.Unlock()
+	before := u.locallyDown()
+	if err != nil {
+		u.failures++
+		u.held = time.Now()
+	} else {
+		u.failures = 0
+	}
+	return u.locallyDown() != before
+}
+
+// down returns whether the backend is down, locally or for a peer.
+func (u *upstream) down() bool {
+	return u.downAfter(downFailures)
+}
+
+// downAfter is down for a backend down after n consecutive failures.
+func (u *upstream) downAfter(n int) bool {
+	u.Lock()
+	defer u.Unlock()
+	return u.failures >= n || u.peerReports() > 0
+}
+
+// tryAfter returns whether to try the backend in turn, for a backend down
+// after n consecutive failures: when it is up, or once every downHoldDown
+// since its last failure or trial while down.
+func (u *upstream) tryAfter(n int, now time.Time) bool {
+	u.Lock()
+	defer u.Unlock()
+	if u.failures < n && u.peerReports() == 0 {
+		return true
+	}
+	if now.Sub(u.held) < downHoldDown {
+		return false
+	}
+	u.held = now
+	return true
+}
+
+func (u *upstream) locallyDown() bool {
+	return u.failures >= downFailures
+}
+
+// peerReports returns the number of peers currently reporting the backend down.
+func (u *upstream) peerReports() int {
+	n := 0
+	for peer, t := range u.peersDown {
+		if time.Since(t) > clusterReportTTL() {
+			delete(u.peersDown, peer)
+			continue
+		}
+		n++
+	}
+	return n
+}
+
+// report records whether a peer sees the backend down.
+func (u *upstream) report(peer string, down bool) {
+	u.Lock()
+	defer u.Unlock()
+	if !down {
+		delete(u.peersDown, peer)
+		return
+	}
+	if u.peersDown == nil {
+		u.peersDown = make(map[string]time.Time)
+	}
+	u.peersDown[peer] = time.Now()
+}
+
+func (u *upstream) String() string {
+	u.Lock()
+	defer u.Unlock()
+	state := "up"
+	peers := u.peerReports()
+	if u.locallyDown() || peers > 0 {
+		state = "down"
+	}
+	s := fmt.Sprintf("%s failures=%d queries=%d errors=%d srtt_ms=%.3f success=%.3f",
+		state, u.failures, u.queries, u.errors, u.srtt.Seconds()*1000, u.success)
+	if peers > 0 {
+		s += fmt.Sprintf(" peers_down=%d", peers)
+	}
+	if u.caps != nil {
+		s += fmt.Sprintf(" capabilities=%v", u.caps)
+	}
+	return s
+}
+
+// isHealthQuery returns whether req asks for a CHAOS health summary.
+func isHealthQuery(req *dns.Msg) bool {
+	q := req.Question[0]
+	if !*healthChaos || q.Qclass != dns.ClassCHAOS || q.Qtype != dns.TypeTXT {
+		return false
+	}
+	name := normalizeName(q.Name)
+	return name == healthName || name == listenerHealthName
+}
+
+// answerHealth answers req with one TXT record per known backend, or per
+// listener.
+func answerHealth(w dns.ResponseWriter, req *dns.Msg) {
+	var lines []string
+	if normalizeName(req.Question[0].Name) == listenerHealthName {
+		for _, l := range listeners {
+			lines = append(lines, l.String())
+		}
+	} else {
+		upstreamsMu.Lock()
+		var addrs []string
+		for addr := range upstreams {
+			addrs = append(addrs, addr)
+		}
+		upstreamsMu.Unlock()
+		sort.Strings(addrs)
+		for _, addr := range addrs {
+			lines = append(lines, addr+" "+getUpstream(addr).String())
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+	for _, line := range lines {
+		m.Answer = append(m.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+			Txt: []string{line},
+		})
+	}
+	w.WriteMsg(m)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	upstreamStateFile = flag.String("upstream-state", "",
+		"File to save the health and latency of the backends to, restored on startup so that a backend down stays so")
+	upstreamStateInterval = flag.Duration("upstream-state-interval", time.Minute,
+		"Interval between saves of the -upstream-state file, also saved on shutdown")
+)
+
+// upstreamStateMaxAge is the age after which a saved state is ignored, as
+// a backend down so long ago may well be up again.
+const upstreamStateMaxAge = time.Hour
+
+// savedUpstream is the state of a backend in the -upstream-state file.
+type savedUpstream struct {
+	Failures int           `json:"failures"`
+	Queries  uint64        `json:"queries"`
+	Errors   uint64        `json:"errors"`
+	SRTT     time.Duration `json:"srtt_ns"`
+	Success  float64       `json:"success"`
+}
+
+// savedState is the -upstream-state file.
+type savedState struct {
+	Saved     time.Time                `json:"saved"`
+	Upstreams map[string]savedUpstream `json:"upstreams"`
+}
+
+// restoreUpstreamState restores the state of the known backends from the
+// -upstream-state file, if recent enough, then saves it every
+// -upstream-state-interval and on shutdown.
+func restoreUpstreamState() {
+	if *upstreamStateFile == "" {
+		return
+	}
+	if err := loadUpstreamState(); err != nil && !os.IsNotExist(err) {
+		logf("upstream state: %v: %v, starting afresh", *upstreamStateFile, err)
+	}
+	save := func() {
+		if err := saveUpstreamState(); err != nil {
+			logf("upstream state: %v: %v", *upstreamStateFile, err)
+		}
+	}
+	go func() {
+		for range time.Tick(*upstreamStateInterval) {
+			save()
+		}
+	}()
+	onShutdown(save)
+}
+
+func loadUpstreamState() error {
+	b, err := os.ReadFile(*upstreamStateFile)
+	if err != nil {
+		return err
+	}
+	var state savedState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return err
+	}
+	if time.Since(state.Saved) > upstreamStateMaxAge {
+		logf("upstream state: %v saved %v ago, ignored", *upstreamStateFile, time.Since(state.Saved).Round(time.Second))
+		return nil
+	}
+	restored := 0
+	for addr, s := range state.Upstreams {
+		upstreamsMu.Lock()
+		u, ok := upstreams[addr]
+		upstreamsMu.Unlock()
+		if !ok {
+			continue // no longer a backend
+		}
+		u.Lock()
+		u.failures, u.queries, u.errors, u.srtt, u.success = s.Failures, s.Queries, s.Errors, s.SRTT, s.Success
+		u.Unlock()
+		restored++
+	}
+	logf("upstream state: restored %d backends from %v", restored, *upstreamStateFile)
+	return nil
+}
+
+// saveUpstreamState writes the -upstream-state file, replacing it at once
+// so that it is never read half written.
+func saveUpstreamState() error {
+	state := savedState{Saved: time.Now(), Upstreams: make(map[string]savedUpstream)}
+	upstreamsMu.Lock()
+	for addr, u := range upstreams {
+		u.Lock()
+		state.Upstreams[addr] = savedUpstream{u.failures, u.queries, u.errors, u.srtt, u.success}
+		u.Unlock()
+	}
+	upstreamsMu.Unlock()
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(*upstreamStateFile), filepath.Base(*upstreamStateFile)+".*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), *upstreamStateFile)
+}
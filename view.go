@@ -0,0 +1,358 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// view is a routing table with its own default server and transfer ACL,
+// serving the queries received on its listen addresses.
+type view struct {
+	name            string
+	addresses       []string
+	routes          map[string]*routeEntry
+	order           []*routeEntry // routes in matching order, see sortRoutes
+	exceptions      []domainMatch // falling through to the default
+	synth           []*synthEntry // answered locally, most specific first
+	defaultRoute    *routeEntry   // optional
+	scopedDefaults  []*routeEntry // defaults under a domain, most specific first
+	defaultImported bool          // defaultRoute comes from an imported config
+	transferNets    []clientNet
+	signed          bool         // selected by a -view-tsig key
+	sources         []*net.IPNet // of the clients selecting it, -view-source
+	// current is the version of the view as last reloaded from -config,
+	// shared by all versions, nil without -config.
+	current *atomic.Pointer[view]
+}
+
+// views by name, the default view built from -address, -route, -default
+// and -allow-transfer is named "".
+var views map[string]*view
+
+var (
+	viewLists          flagStringList
+	viewRoutes         flagStringList
+	viewDefaults       flagStringList
+	viewTSIGs          flagStringList
+	viewSourceLists    flagStringList
+	viewAllowTransfers flagStringList
+	viewInterfaces     flagStringList
+)
+
+func init() {
+	flag.Var(&viewLists, "view", "View with its own routes listening to addresses (TCP and UDP) (name[=[ip]:port,[[ip]:port,...]])")
+	flag.Var(&viewRoutes, "view-route", "List of routes of a view (name/domain=host:port,[host:port,...])")
+	flag.Var(&viewDefaults, "view-default", "Default DNS server of a view, or only for names under a domain (name=[domain=]host:port)")
+	flag.Var(&viewInterfaces, "view-interface", "Interfaces whose addresses a view listens to, on the -address port (name=interface,[interface,...])")
+	flag.Var(&viewTSIGs, "view-tsig", "TSIG key selecting a view for the queries it signs, whatever address received them (name=[algorithm:]keyname:secret|keyname)")
+	flag.Var(&viewSourceLists, "view-source", "Client subnets selecting a view for their queries, whatever address received them, "+
+		"the longest prefix first (name=cidr,[cidr,...])")
+	flag.Var(&viewAllowTransfers, "view-allow-transfer", "List of IPs or CIDRs allowed to transfer from a view (name=ip|cidr,[ip|cidr,...])")
+}
+
+func (v *view) handler() dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		v := v.live()
+		if sv := sourceView(remoteIP(w)); sv != nil {
+			v = sv.live()
+		}
+		countMetric(metricName("queries", clientTransport(w)))
+		countRetry(w, req)
+		if len(req.Question) > 0 {
+			countMetric(metricName("qtype", dns.Type(req.Question[0].Qtype).String()))
+		}
+		w = metricsWriter{w}
+		if v.rateLimited(w, req) {
+			return
+		}
+		if !v.admit(w, req) {
+			return
+		}
+		defer release()
+		if t := req.IsTsig(); t != nil {
+			if vk, ok := viewKeys[dns.CanonicalName(t.Hdr.Name)]; ok {
+				if err := w.TsigStatus(); err != nil {
+					logf("tsig: query from %v signed by %v: %v", addrHost(w.RemoteAddr()), t.Hdr.Name, err)
+					v.reply(w, req, dns.RcodeNotAuth)
+					return
+				}
+				req = req.Copy()
+				stripTSIG(req)
+				route(vk.view.live(), tsigWriter{w, vk.key}, req)
+				return
+			}
+		}
+		route(v, w, req)
+	})
+}
+
+// addRoute adds a route flag to v: domain=host:port,[host:port,...],
+// or !domain for an exception so that the domain goes to the default.
+func (v *view) addRoute(s string) error {
+	if strings.HasPrefix(s, "!") {
+		v.addException(s[1:])
+		return nil
+	}
+	domain, r, err := parseRoute(s)
+	if err != nil {
+		return err
+	}
+	r.fallback = *fallbackToDefault
+	v.routes[domain] = r
+	return nil
+}
+
+func (v *view) addException(domain string) {
+	v.exceptions = append(v.exceptions, domainMatch{domain: routeDomain(domain)})
+}
+
+// registerUpstreams makes the backends of v known before they are queried.
+func (v *view) registerUpstreams() {
+	for _, r := range v.routes {
+		for _, addr := range r.backends {
+			getUpstream(addr)
+		}
+	}
+	for _, r := range append([]*routeEntry{v.defaultRoute}, v.scopedDefaults...) {
+		if r == nil {
+			continue
+		}
+		for _, addr := range r.backends {
+			getUpstream(addr)
+		}
+	}
+}
+
+// setDefault sets the default server of v, or adds a scoped default:
+// [domain=]host:port.
+func (v *view) setDefault(s string) error {
+	if !strings.Contains(s, "=") {
+		if strings.HasPrefix(s, poolPrefix) {
+			r, err := poolRoute(s)
+			if err != nil {
+				return err
+			}
+			v.defaultRoute = r
+			return nil
+		}
+		if !validBackend(s) {
+			return fmt.Errorf("invalid host:port or unix:/path for %v", s)
+		}
+		v.defaultRoute = defaultRoute(s)
+		return nil
+	}
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts[0]) == 0 || !validBackend(parts[1]) && !strings.HasPrefix(parts[1], poolPrefix) {
+		return fmt.Errorf("invalid scoped default %q, must be domain=host:port", s)
+	}
+	r := defaultRoute(parts[1])
+	if strings.HasPrefix(parts[1], poolPrefix) {
+		var err error
+		if r, err = poolRoute(parts[1]); err != nil {
+			return err
+		}
+	}
+	r.domain = routeDomain(parts[0])
+	v.scopedDefaults = append(v.scopedDefaults, r)
+	sort.SliceStable(v.scopedDefaults, func(i, j int) bool {
+		return len(v.scopedDefaults[i].domain) > len(v.scopedDefaults[j].domain)
+	})
+	return nil
+}
+
+// defaultFor returns the default route of a normalized name: the most
+// specific scoped default matching, else the default route.
+func (v *view) defaultFor(name string) *routeEntry {
+	for _, r := range v.scopedDefaults {
+		if r.matches(name) {
+			return r
+		}
+	}
+	return v.defaultRoute
+}
+
+// splitViewFlag splits a name=value view flag.
+func splitViewFlag(flagName, s string) (*view, string, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		return nil, "", fmt.Errorf("invalid -%v %q, must be name=value", flagName, s)
+	}
+	v, ok := views[parts[0]]
+	if !ok || parts[0] == "" {
+		return nil, "", fmt.Errorf("invalid -%v, no -view %v", flagName, parts[0])
+	}
+	return v, parts[1], nil
+}
+
+// parseViews adds the views defined by the -view flags to views.
+func parseViews() error {
+	for _, viewList := range viewLists {
+		s := strings.SplitN(viewList, "=", 2)
+		if len(s[0]) == 0 || strings.Contains(s[0], "/") || len(s) == 2 && len(s[1]) == 0 {
+			return fmt.Errorf("invalid -view, must be name[=[ip]:port,[[ip]:port,...]]")
+		}
+		if _, ok := views[s[0]]; ok {
+			return fmt.Errorf("invalid -view, duplicate view %v", s[0])
+		}
+		v := &view{name: s[0], routes: make(map[string]*routeEntry)}
+		views[v.name] = v
+		if len(s) == 1 {
+			continue
+		}
+		for _, addr := range strings.Split(s[1], ",") {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return fmt.Errorf("invalid -view address for %v: %v", s[0], err)
+			}
+			v.addresses = append(v.addresses, addr)
+		}
+	}
+	for _, viewInterface := range viewInterfaces {
+		v, names, err := splitViewFlag("view-interface", viewInterface)
+		if err != nil {
+			return err
+		}
+		for _, name := range strings.Split(names, ",") {
+			addrs, err := interfaceAddresses(name)
+			if err != nil {
+				return fmt.Errorf("invalid -view-interface for %v: %v", v.name, err)
+			}
+			v.addresses = append(v.addresses, addrs...)
+		}
+	}
+	for _, viewTSIG := range viewTSIGs {
+		v, s, err := splitViewFlag("view-tsig", viewTSIG)
+		if err != nil {
+			return err
+		}
+		key, err := keyFlag(s)
+		if err != nil {
+			return fmt.Errorf("invalid -view-tsig for %v: %v", v.name, err)
+		}
+		if _, ok := viewKeys[key.name]; ok {
+			return fmt.Errorf("invalid -view-tsig, duplicate key %v", key.name)
+		}
+		viewKeys[key.name] = &viewKey{key, v}
+		v.signed = true
+	}
+	for _, viewSourceList := range viewSourceLists {
+		v, cidrs, err := splitViewFlag("view-source", viewSourceList)
+		if err != nil {
+			return err
+		}
+		nets, err := parseCIDRs(cidrs)
+		if err != nil {
+			return fmt.Errorf("invalid -view-source for %v: %v", v.name, err)
+		}
+		for _, n := range nets {
+			for _, s := range viewSources {
+				if s.net.String() == n.String() {
+					return fmt.Errorf("invalid -view-source, %v selects both %v and %v", n, s.view.name, v.name)
+				}
+			}
+			viewSources = append(viewSources, viewSource{n, v})
+		}
+		v.sources = append(v.sources, nets...)
+	}
+	sort.SliceStable(viewSources, func(i, j int) bool {
+		bi, _ := viewSources[i].net.Mask.Size()
+		bj, _ := viewSources[j].net.Mask.Size()
+		return bi > bj
+	})
+	for _, v := range views {
+		if len(v.addresses) == 0 && !v.signed && len(v.sources) == 0 {
+			return fmt.Errorf("invalid -view %v, no address, interface, client subnet or TSIG key to select it", v.name)
+		}
+	}
+	for _, viewRoute := range viewRoutes {
+		s := strings.SplitN(viewRoute, "/", 2)
+		if len(s) != 2 {
+			return fmt.Errorf("invalid -view-route, must be name/domain=host:port,[host:port,...]")
+		}
+		v, ok := views[s[0]]
+		if !ok || s[0] == "" {
+			return fmt.Errorf("invalid -view-route, no -view %v", s[0])
+		}
+		if err := v.addRoute(s[1]); err != nil {
+			return fmt.Errorf("invalid -view-route: %v", err)
+		}
+	}
+	for _, viewDefault := range viewDefaults {
+		v, server, err := splitViewFlag("view-default", viewDefault)
+		if err != nil {
+			return err
+		}
+		if err := v.setDefault(server); err != nil {
+			return fmt.Errorf("invalid -view-default: %v", err)
+		}
+	}
+	for _, viewAllowTransfer := range viewAllowTransfers {
+		v, ips, err := splitViewFlag("view-allow-transfer", viewAllowTransfer)
+		if err != nil {
+			return err
+		}
+		if v.transferNets, err = parseClientNets(ips); err != nil {
+			return fmt.Errorf("invalid -view-allow-transfer: %v", err)
+		}
+	}
+	return nil
+}
+
+// viewSource is a -view-source subnet and the view it selects.
+type viewSource struct {
+	net  *net.IPNet
+	view *view
+}
+
+// viewSources are the -view-source subnets, the longest prefix first.
+var viewSources []viewSource
+
+// sourceView returns the view selected by the subnet of a client, nil if
+// none.
+func sourceView(ip net.IP) *view {
+	for _, s := range viewSources {
+		if s.net.Contains(ip) {
+			return s.view
+		}
+	}
+	return nil
+}
+
+// interfaceAddresses returns the listen addresses for the IPs of a local
+// interface on the port of -address, so that the view of a query is selected
+// by the interface which received it.
+func interfaceAddresses(name string) ([]string, error) {
+	_, port, err := net.SplitHostPort(*address)
+	if err != nil {
+		return nil, err
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var listen []string
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		host := ipnet.IP.String()
+		if ipnet.IP.IsLinkLocalUnicast() {
+			host += "%" + name
+		}
+		listen = append(listen, net.JoinHostPort(host, port))
+	}
+	if len(listen) == 0 {
+		return nil, fmt.Errorf("no address on interface %v", name)
+	}
+	return listen, nil
+}